@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/mih-kopylov/our-spb-bot/internal/app"
 	"github.com/mih-kopylov/our-spb-bot/internal/log"
 	"go.uber.org/zap"
@@ -12,7 +14,12 @@ var (
 )
 
 func main() {
-	err := app.RunApplication(version, commit)
+	var err error
+	if len(os.Args) > 1 {
+		err = app.RunCommand(os.Args[1:])
+	} else {
+		err = app.RunApplication(version, commit)
+	}
 	if err != nil {
 		log.NewLogger().With(zap.Error(err)).Fatal("")
 	}
@@ -1,6 +1,8 @@
 package app
 
 import (
+	"context"
+
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot/api"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
@@ -11,20 +13,40 @@ import (
 	"github.com/mih-kopylov/our-spb-bot/internal/config"
 	"github.com/mih-kopylov/our-spb-bot/internal/info"
 	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/metrics"
 	"github.com/mih-kopylov/our-spb-bot/internal/migration"
+	"github.com/mih-kopylov/our-spb-bot/internal/notify"
 	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
 	"github.com/mih-kopylov/our-spb-bot/internal/spb"
-	"github.com/mih-kopylov/our-spb-bot/internal/state"
 	"github.com/mih-kopylov/our-spb-bot/internal/storage"
 	"go.uber.org/fx"
 	"go.uber.org/fx/fxevent"
 	"go.uber.org/zap"
 )
 
+// RunApplication Runs the bot until it receives a termination signal.
+// Then in-flight work is given SHUTDOWN_TIMEOUT to complete
 func RunApplication(version string, commit string) error {
-	fx.New(createApp(version, commit)).Run()
+	var conf *config.Config
+	app := fx.New(createApp(version, commit), fx.Populate(&conf))
+	err := app.Err()
+	if err != nil {
+		return err
+	}
+
+	startCtx, cancelStart := context.WithTimeout(context.Background(), app.StartTimeout())
+	defer cancelStart()
+	err = app.Start(startCtx)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	<-app.Done()
+
+	stopCtx, cancelStop := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancelStop()
+	return app.Stop(stopCtx)
 }
 
 func createApp(version string, commit string) fx.Option {
@@ -39,13 +61,11 @@ func createApp(version string, commit string) fx.Option {
 			log.NewLogger,
 			config.NewConfig,
 			api.NewApi,
-			storage.NewFirebaseStorage,
-			fx.Annotate(
-				state.NewFirebaseState, fx.As(new(state.States)),
-			),
-			fx.Annotate(
-				queue.NewFirebaseQueue, fx.As(new(queue.MessageQueue)),
-			),
+			storage.NewStorage,
+			secret.NewCipher,
+			newStates,
+			newMessageQueue,
+			newMigrationJournal,
 			category.NewService,
 
 			service.NewService,
@@ -53,6 +73,20 @@ func createApp(version string, commit string) fx.Option {
 				bot.NewTgBot, fx.ParamTags(``, ``, ``, `group:"commands"`, `group:"callbacks"`, `group:"forms"`),
 			),
 			queue.NewMessageSender,
+			queue.NewLeaseReaper,
+			queue.NewProblemWatcher,
+			func(service *service.Service) queue.ProblemNotifier {
+				return service
+			},
+			notify.NewFailureDigest,
+			func(digest *notify.FailureDigest) queue.FailureNotifier {
+				return digest
+			},
+			notify.NewAccountEvents,
+			func(events *notify.AccountEvents) queue.AccountNotifier {
+				return events
+			},
+			metrics.NewServer,
 			fx.Annotate(
 				spb.NewReqClient, fx.As(new(spb.Client)),
 			),
@@ -66,6 +100,9 @@ func createApp(version string, commit string) fx.Option {
 			fx.Annotate(
 				command.NewMessageCommand, fx.ResultTags(`group:"commands"`),
 			),
+			fx.Annotate(
+				command.NewQueueCommand, fx.ResultTags(`group:"commands"`),
+			),
 			fx.Annotate(
 				command.NewLoginCommand, fx.ResultTags(`group:"commands"`),
 			),
@@ -109,6 +146,48 @@ func createApp(version string, commit string) fx.Option {
 					return cb
 				}, fx.ResultTags(`group:"callbacks"`),
 			),
+			callback.NewMessageBuildingCallback,
+			fx.Annotate(
+				func(cb *callback.MessageBuildingCallback) bot.Callback {
+					return cb
+				}, fx.ResultTags(`group:"callbacks"`),
+			),
+			callback.NewDraftPriorityCallback,
+			fx.Annotate(
+				func(cb *callback.DraftPriorityCallback) bot.Callback {
+					return cb
+				}, fx.ResultTags(`group:"callbacks"`),
+			),
+			callback.NewMessagePriorityCallback,
+			fx.Annotate(
+				func(cb *callback.MessagePriorityCallback) bot.Callback {
+					return cb
+				}, fx.ResultTags(`group:"callbacks"`),
+			),
+			callback.NewSendAtCallback,
+			fx.Annotate(
+				func(cb *callback.SendAtCallback) bot.Callback {
+					return cb
+				}, fx.ResultTags(`group:"callbacks"`),
+			),
+			callback.NewQueueCallback,
+			fx.Annotate(
+				func(cb *callback.QueueCallback) bot.Callback {
+					return cb
+				}, fx.ResultTags(`group:"callbacks"`),
+			),
+			callback.NewEditMessageCallback,
+			fx.Annotate(
+				func(cb *callback.EditMessageCallback) bot.Callback {
+					return cb
+				}, fx.ResultTags(`group:"callbacks"`),
+			),
+			callback.NewFailedMessageCallback,
+			fx.Annotate(
+				func(cb *callback.FailedMessageCallback) bot.Callback {
+					return cb
+				}, fx.ResultTags(`group:"callbacks"`),
+			),
 			callback.NewDeletePhotoCallback,
 			fx.Annotate(
 				func(cb *callback.DeletePhotoCallback) bot.Callback {
@@ -134,25 +213,64 @@ func createApp(version string, commit string) fx.Option {
 			fx.Annotate(
 				form.NewAccountTimeForm, fx.ResultTags(`group:"forms"`),
 			),
-			//migrations
 			fx.Annotate(
-				migration.NewMigrations, fx.ParamTags(``, `group:"migrations"`),
+				form.NewAccountPinnedCategoriesForm, fx.ResultTags(`group:"forms"`),
 			),
 			fx.Annotate(
-				migration.NewAccountTimeMigration, fx.ResultTags(`group:"migrations"`),
+				form.NewSendAtForm, fx.ResultTags(`group:"forms"`),
 			),
 		),
+		migrationProviders(),
 
 		fx.Invoke(func(migrations *migration.Migrations) error {
-			return migrations.RunAll()
+			return migrations.RunAll(context.Background())
+		}),
+
+		fx.Invoke(func(lc fx.Lifecycle, server *metrics.Server) {
+			lc.Append(fx.Hook{OnStart: server.Start, OnStop: server.Stop})
+		}),
+
+		fx.Invoke(func(lc fx.Lifecycle, bot *bot.TgBot) {
+			lc.Append(fx.Hook{OnStart: bot.Start, OnStop: bot.Stop})
 		}),
 
-		fx.Invoke(func(bot *bot.TgBot) error {
-			return bot.Start()
+		// the digest is stopped after the sender, so that the last failures are sent too
+		fx.Invoke(func(lc fx.Lifecycle, digest *notify.FailureDigest) {
+			lc.Append(fx.Hook{OnStart: digest.Start, OnStop: digest.Stop})
 		}),
 
-		fx.Invoke(func(sender *queue.MessageSender) error {
-			return sender.Start()
+		fx.Invoke(func(lc fx.Lifecycle, events *notify.AccountEvents) {
+			lc.Append(fx.Hook{OnStart: events.Start, OnStop: events.Stop})
 		}),
+
+		fx.Invoke(func(lc fx.Lifecycle, sender *queue.MessageSender) {
+			lc.Append(fx.Hook{OnStart: sender.Start, OnStop: sender.Stop})
+		}),
+
+		fx.Invoke(func(lc fx.Lifecycle, reaper *queue.LeaseReaper) {
+			lc.Append(fx.Hook{OnStart: reaper.Start, OnStop: reaper.Stop})
+		}),
+
+		fx.Invoke(func(lc fx.Lifecycle, watcher *queue.ProblemWatcher) {
+			lc.Append(fx.Hook{OnStart: watcher.Start, OnStop: watcher.Stop})
+		}),
+	)
+}
+
+// migrationProviders are shared by the bot and the migrate command
+func migrationProviders() fx.Option {
+	return fx.Provide(
+		fx.Annotate(
+			migration.NewMigrations, fx.ParamTags(``, ``, `group:"migrations"`),
+		),
+		fx.Annotate(
+			migration.NewAccountTimeMigration, fx.ResultTags(`group:"migrations"`),
+		),
+		fx.Annotate(
+			migration.NewStateEncryptionMigration, fx.ResultTags(`group:"migrations"`),
+		),
+		fx.Annotate(
+			migration.NewMessagePriorityMigration, fx.ResultTags(`group:"migrations"`),
+		),
 	)
 }
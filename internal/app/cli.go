@@ -0,0 +1,261 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/migration"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/mih-kopylov/our-spb-bot/internal/storage"
+	"github.com/mih-kopylov/our-spb-bot/internal/transfer"
+	"github.com/samber/lo"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	generateCategoriesCommand = "generate-categories"
+	migrateDataCommand        = "migrate-data"
+	migrateCommand            = "migrate"
+	migrateUsage              = "usage: migrate status | up | run <id> | down <id>"
+)
+
+// RunCommand runs a maintenance command instead of the bot. The command is cancelled on a termination signal
+func RunCommand(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch args[0] {
+	case generateCategoriesCommand:
+		return generateCategories(ctx, args[1:])
+	case migrateDataCommand:
+		return migrateData(ctx, args[1:])
+	case migrateCommand:
+		return migrate(ctx, args[1:])
+	default:
+		return errorx.IllegalArgument.New("unsupported command: %v", args[0])
+	}
+}
+
+func generateCategories(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet(generateCategoriesCommand, flag.ContinueOnError)
+	endpoint := flags.String("endpoint", "https://gorod.gov.spb.ru", "portal api endpoint")
+	timeout := flags.Duration("timeout", 30*time.Second, "portal client timeout")
+	output := flags.String("output", "", "file to write categories to, stdout if empty")
+	err := flags.Parse(args)
+	if err != nil {
+		return errorx.IllegalArgument.Wrap(err, "failed to parse arguments")
+	}
+
+	conf := &config.Config{
+		OurSpbApiEndpoint:   *endpoint,
+		OurSpbClientTimeout: *timeout,
+	}
+	categoryService := category.NewService(spb.NewReqClient(log.NewLogger(), conf))
+	bytes, err := categoryService.GenerateCategoriesText(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(bytes)
+	} else {
+		err = os.WriteFile(*output, bytes, 0644)
+	}
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to write categories")
+	}
+
+	return nil
+}
+
+// migrateData copies user states and messages between storages.
+// Firebase and encryption settings are read from the same environment variables the bot uses
+func migrateData(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet(migrateDataCommand, flag.ContinueOnError)
+	from := flags.String("from", string(config.StorageTypeFirebase), "source storage type: firebase or bolt")
+	to := flags.String("to", string(config.StorageTypeBolt), "target storage type: firebase or bolt")
+	fromBoltPath := flags.String("from-bolt-path", "our-spb-bot.db", "source bolt database file")
+	toBoltPath := flags.String("to-bolt-path", "our-spb-bot.db", "target bolt database file")
+	dryRun := flags.Bool("dry-run", false, "read the source and report what would be transferred")
+	checkpointPath := flags.String(
+		"checkpoint", "", "file with transferred records to resume an interrupted transfer from, disabled if empty",
+	)
+	err := flags.Parse(args)
+	if err != nil {
+		return errorx.IllegalArgument.Wrap(err, "failed to parse arguments")
+	}
+
+	sourceConf := newStorageConfig(config.StorageType(*from), *fromBoltPath)
+	targetConf := newStorageConfig(config.StorageType(*to), *toBoltPath)
+	if sourceConf.StorageType == targetConf.StorageType &&
+		(sourceConf.StorageType != config.StorageTypeBolt || sourceConf.BoltPath == targetConf.BoltPath) {
+		return errorx.IllegalArgument.New("source and target storages are the same")
+	}
+
+	logger := log.NewLogger()
+	cipher, err := secret.NewCipher(logger, sourceConf)
+	if err != nil {
+		return err
+	}
+
+	sourceStorage, source, err := openBackend(logger, sourceConf, cipher)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(logger, sourceStorage)
+
+	// the target is not touched in a dry run, it doesn't even have to exist
+	target := transfer.Backend{}
+	if !*dryRun {
+		var targetStorage *storage.Storage
+		targetStorage, target, err = openBackend(logger, targetConf, cipher)
+		if err != nil {
+			return err
+		}
+		defer closeStorage(logger, targetStorage)
+	}
+
+	report, err := transfer.Run(ctx, logger, source, target, transfer.Options{
+		DryRun:         *dryRun,
+		CheckpointPath: *checkpointPath,
+		Source:         describeStorage(sourceConf),
+		Target:         describeStorage(targetConf),
+	})
+	if report != nil {
+		fmt.Print(report.String())
+	}
+
+	return err
+}
+
+// migrate manages schema migrations of the storage configured with STORAGE_TYPE and BOLT_PATH
+func migrate(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errorx.IllegalArgument.New(migrateUsage)
+	}
+
+	conf := newStorageConfig(
+		config.StorageType(lo.CoalesceOrEmpty(os.Getenv("STORAGE_TYPE"), string(config.StorageTypeFirebase))),
+		lo.CoalesceOrEmpty(os.Getenv("BOLT_PATH"), "our-spb-bot.db"),
+	)
+	var migrations *migration.Migrations
+	app := fx.New(
+		fx.NopLogger,
+		fx.Supply(conf),
+		fx.Provide(
+			log.NewLogger,
+			storage.NewStorage,
+			secret.NewCipher,
+			newStates,
+			newMessageQueue,
+			newMigrationJournal,
+		),
+		migrationProviders(),
+		fx.Populate(&migrations),
+	)
+	if app.Err() != nil {
+		return app.Err()
+	}
+
+	switch {
+	case args[0] == "status":
+		statuses, err := migrations.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			line := status.Id + "\t"
+			if status.Applied {
+				line += "applied at " + status.AppliedAt.Format(time.RFC3339)
+			} else {
+				line += "pending"
+			}
+			if status.Reversible {
+				line += "\treversible"
+			}
+			fmt.Println(line)
+		}
+		return nil
+	case args[0] == "up":
+		return migrations.RunAll(ctx)
+	case args[0] == "run" && len(args) == 2:
+		return migrations.Run(ctx, args[1])
+	case args[0] == "down" && len(args) == 2:
+		return migrations.Rollback(ctx, args[1])
+	default:
+		return errorx.IllegalArgument.New(migrateUsage)
+	}
+}
+
+func newStorageConfig(storageType config.StorageType, boltPath string) *config.Config {
+	return &config.Config{
+		StorageType:            storageType,
+		FirebaseServiceAccount: os.Getenv("FIREBASE_SERVICE_ACCOUNT"),
+		FirebaseProjectId:      lo.CoalesceOrEmpty(os.Getenv("FIREBASE_PROJECT_ID"), "ourspbbot"),
+		FirestoreEmulatorHost:  os.Getenv("FIRESTORE_EMULATOR_HOST"),
+		BoltPath:               boltPath,
+		StateEncryptionKeys:    strings.Split(os.Getenv("STATE_ENCRYPTION_KEYS"), ","),
+	}
+}
+
+// openBackend Opens the storage and creates the transfer backend on top of it. The caller closes the storage
+func openBackend(
+	logger *zap.Logger, conf *config.Config, cipher *secret.Cipher,
+) (*storage.Storage, transfer.Backend, error) {
+	if conf.StorageType != config.StorageTypeFirebase && conf.StorageType != config.StorageTypeBolt {
+		return nil, transfer.Backend{}, errorx.IllegalArgument.New("unsupported storage type: %v", conf.StorageType)
+	}
+
+	dataStorage, err := storage.NewStorage(conf)
+	if err != nil {
+		return nil, transfer.Backend{}, err
+	}
+
+	states, err := newStates(logger, dataStorage, cipher)
+	if err != nil {
+		closeStorage(logger, dataStorage)
+		return nil, transfer.Backend{}, err
+	}
+
+	messageQueue, err := newMessageQueue(logger, conf, dataStorage)
+	if err != nil {
+		closeStorage(logger, dataStorage)
+		return nil, transfer.Backend{}, err
+	}
+
+	return dataStorage, transfer.Backend{States: states, Queue: messageQueue}, nil
+}
+
+func closeStorage(logger *zap.Logger, dataStorage *storage.Storage) {
+	err := dataStorage.Close()
+	if err != nil {
+		logger.Warn("failed to close storage", zap.Error(err))
+	}
+}
+
+// describeStorage Identifies the storage a checkpoint is written for
+func describeStorage(conf *config.Config) string {
+	if conf.StorageType == config.StorageTypeBolt {
+		path, err := filepath.Abs(conf.BoltPath)
+		if err != nil {
+			path = conf.BoltPath
+		}
+		return string(conf.StorageType) + ":" + path
+	}
+
+	return string(conf.StorageType) + ":" + conf.FirebaseProjectId
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/docker/go-connections/nat"
 	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/storage/storagetest"
 	"github.com/testcontainers/testcontainers-go"
 	testcontainersLog "github.com/testcontainers/testcontainers-go/log"
 	"github.com/testcontainers/testcontainers-go/wait"
@@ -54,19 +55,7 @@ func NewMocks(t *testing.T) (*Mocks, error) {
 
 	wiremockClient := wiremock.NewClient(fmt.Sprintf("http://localhost:%v", wiremockPort.Port()))
 
-	firestoreContainer, err := testcontainers.GenericContainer(
-		ctx, testcontainers.GenericContainerRequest{
-			ContainerRequest: testcontainers.ContainerRequest{
-				Image:        "mtlynch/firestore-emulator-docker:latest",
-				ExposedPorts: []string{"8080/tcp"},
-				Env: map[string]string{
-					"FIRESTORE_PROJECT_ID": "ourspbbot",
-				},
-				WaitingFor: wait.ForLog("Dev App Server is now running"),
-			},
-			Started: true,
-		},
-	)
+	firestoreContainer, firestorePort, err := storagetest.RunFirestoreEmulator(ctx)
 	if err != nil {
 		defer teardown(t, wiremockContainer)
 		return nil, err
@@ -78,12 +67,6 @@ func NewMocks(t *testing.T) (*Mocks, error) {
 		defer teardown(t, wiremockContainer, firestoreContainer)
 	}
 
-	firestorePort, err := firestoreContainer.MappedPort(ctx, "8080/tcp")
-	if err != nil {
-		defer teardown(t, wiremockContainer, firestoreContainer)
-		return nil, err
-	}
-
 	return &Mocks{
 		WiremockContainer:  wiremockContainer,
 		WiremockPort:       wiremockPort,
@@ -101,7 +84,7 @@ func (m *Mocks) BeforeAll(t *testing.T) {
 	t.Setenv("OURSPB_SECRET", "OURSPB_SECRET")
 	t.Setenv("OURSPB_CLIENT_TIMEOUT", "1s")
 	t.Setenv("FIRESTORE_EMULATOR_HOST", fmt.Sprintf("localhost:%v", m.FirestorePort.Port()))
-	t.Setenv("FIREBASE_SERVICE_ACCOUNT", base64.StdEncoding.EncodeToString([]byte("FIREBASE_SERVICE_ACCOUNT")))
+	t.Setenv("STATE_ENCRYPTION_KEYS", "test:"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
 	t.Setenv("SENDER_SLEEP_DURATION", "1s")
 	t.Setenv("INACTIVIRY_DURATION", "1s")
 }
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/migration"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/mih-kopylov/our-spb-bot/internal/storage"
+	"go.uber.org/zap"
+)
+
+func newStates(logger *zap.Logger, storage *storage.Storage, cipher *secret.Cipher) (state.States, error) {
+	if storage.Type == config.StorageTypeBolt {
+		return state.NewBoltStates(logger, storage.Bolt, cipher)
+	}
+
+	return state.NewFirebaseState(logger, storage.Firestore, cipher), nil
+}
+
+func newMessageQueue(logger *zap.Logger, conf *config.Config, storage *storage.Storage) (queue.MessageQueue, error) {
+	if storage.Type == config.StorageTypeBolt {
+		return queue.NewBoltQueue(logger, conf, storage.Bolt)
+	}
+
+	return queue.NewFirebaseQueue(logger, conf, storage.Firestore), nil
+}
+
+func newMigrationJournal(storage *storage.Storage) (migration.Journal, error) {
+	if storage.Type == config.StorageTypeBolt {
+		return migration.NewBoltJournal(storage.Bolt)
+	}
+
+	return migration.NewFirebaseJournal(storage.Firestore), nil
+}
@@ -1,6 +1,7 @@
 package bot
 
 import (
+	"context"
 	"maps"
 	"slices"
 	"strings"
@@ -24,6 +25,9 @@ type TgBot struct {
 	commands  map[string]Command
 	callbacks map[string]Callback
 	forms     map[string]Form
+	stopping  chan struct{}
+	done      chan struct{}
+	cancel    context.CancelFunc
 }
 
 func NewTgBot(
@@ -52,26 +56,63 @@ func NewTgBot(
 	}
 }
 
-func (b *TgBot) Start() error {
+func (b *TgBot) Start(_ context.Context) error {
 	err := b.registerCommands()
 	if err != nil {
 		return err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopping = make(chan struct{})
+	b.done = make(chan struct{})
+	b.cancel = cancel
+
 	go func() {
-		b.processUpdates()
+		defer close(b.done)
+		b.processUpdates(ctx)
 	}()
 
 	return nil
 }
 
-func (b *TgBot) processUpdates() {
+// Stop Stops receiving updates and waits for the update in progress to be handled.
+// The handler is cancelled when it doesn't complete in time
+func (b *TgBot) Stop(ctx context.Context) error {
+	if b.done == nil {
+		return nil
+	}
+
+	b.logger.Info("stopping bot")
+	b.api.StopReceivingUpdates()
+	close(b.stopping)
+	select {
+	case <-b.done:
+		b.cancel()
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return errorx.EnhanceStackTrace(ctx.Err(), "bot didn't stop in time")
+	}
+}
+
+func (b *TgBot) processUpdates(ctx context.Context) {
 	updateConfig := tgbotapi.NewUpdate(0)
 	updateConfig.Timeout = 30
 
 	updates := b.api.GetUpdatesChan(updateConfig)
-	for update := range updates {
-		err := b.callHandler(update)
+	for {
+		var update tgbotapi.Update
+		var ok bool
+		select {
+		case <-b.stopping:
+			return
+		case update, ok = <-updates:
+			if !ok {
+				return
+			}
+		}
+
+		err := b.callHandler(ctx, update)
 		if err != nil {
 			err = errorx.EnhanceStackTrace(err, "failed to handle update")
 			b.logger.Error(
@@ -83,12 +124,12 @@ func (b *TgBot) processUpdates() {
 	}
 }
 
-func (b *TgBot) callHandler(update tgbotapi.Update) error {
+func (b *TgBot) callHandler(ctx context.Context, update tgbotapi.Update) error {
 	switch {
 	case update.Message != nil:
-		return b.handleMessage(update.Message)
+		return b.handleMessage(ctx, update.Message)
 	case update.CallbackQuery != nil:
-		return b.handleCallback(update.CallbackQuery)
+		return b.handleCallback(ctx, update.CallbackQuery)
 	default:
 		return errorx.IllegalArgument.New("unsupported update type")
 	}
@@ -113,7 +154,7 @@ func (b *TgBot) registerCommands() error {
 	return nil
 }
 
-func (b *TgBot) handleCallback(callbackQuery *tgbotapi.CallbackQuery) error {
+func (b *TgBot) handleCallback(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery) error {
 	data := callbackQuery.Data
 	callbackName, value, found := strings.Cut(data, CallbackSectionSeparator)
 	if !found {
@@ -125,7 +166,7 @@ func (b *TgBot) handleCallback(callbackQuery *tgbotapi.CallbackQuery) error {
 		return errorx.IllegalArgument.New("unsupported callback name: name=%v", callbackName)
 	}
 
-	err := handler.Handle(callbackQuery, value)
+	err := handler.Handle(ctx, callbackQuery, value)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to handle callback")
 	}
@@ -133,7 +174,7 @@ func (b *TgBot) handleCallback(callbackQuery *tgbotapi.CallbackQuery) error {
 	return nil
 }
 
-func (b *TgBot) handleMessage(message *tgbotapi.Message) error {
+func (b *TgBot) handleMessage(ctx context.Context, message *tgbotapi.Message) error {
 	commandName := message.Command()
 
 	if commandName != "" {
@@ -142,12 +183,12 @@ func (b *TgBot) handleMessage(message *tgbotapi.Message) error {
 			return errorx.IllegalArgument.New("unsupported command name: name=%v", commandName)
 		}
 
-		err := comm.Handle(message)
+		err := comm.Handle(ctx, message)
 		if err != nil {
 			return errorx.EnhanceStackTrace(err, "failed to handle command")
 		}
 	} else {
-		userState, err := b.states.GetState(message.Chat.ID)
+		userState, err := b.states.GetState(ctx, message.Chat.ID)
 		if err != nil {
 			return errorx.EnhanceStackTrace(err, "failed to get user state")
 		}
@@ -157,7 +198,7 @@ func (b *TgBot) handleMessage(message *tgbotapi.Message) error {
 			return errorx.IllegalState.New("no message handler is waiting for a message")
 		}
 
-		err = form.Handle(message)
+		err = form.Handle(ctx, message)
 		if err != nil {
 			return errorx.EnhanceStackTrace(err, "failed to handle message")
 		}
@@ -1,6 +1,7 @@
 package callback
 
 import (
+	"context"
 	"fmt"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -33,13 +34,13 @@ func (h *DeleteMessageCallback) Name() string {
 	return DeleteMessageCallbackName
 }
 
-func (h *DeleteMessageCallback) Handle(callbackQuery *tgbotapi.CallbackQuery, data string) error {
-	userState, err := h.states.GetState(callbackQuery.Message.Chat.ID)
+func (h *DeleteMessageCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	userState, err := h.states.GetState(ctx, callbackQuery.Message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
 
-	message, err := h.messageQueue.GetMessage(data)
+	message, err := h.messageQueue.GetMessage(ctx, data)
 	if err != nil {
 		return h.service.SendMessage(callbackQuery.Message.Chat, fmt.Sprintf(`Не удалось удалить сообщение %v.
 Возможно, уже было отправлено.`, data))
@@ -49,7 +50,17 @@ func (h *DeleteMessageCallback) Handle(callbackQuery *tgbotapi.CallbackQuery, da
 		return errorx.EnhanceStackTrace(err, "can't delete a message of another user")
 	}
 
-	err = h.messageQueue.DeleteMessage(message)
+	if message.Status == queue.StatusSent {
+		return h.service.SendMessage(callbackQuery.Message.Chat, fmt.Sprintf(`Не удалось удалить сообщение %v.
+Сообщение уже отправлено: %v`, data, message.ProblemUrl()))
+	}
+
+	if message.Status == queue.StatusInProgress {
+		return h.service.SendMessage(callbackQuery.Message.Chat, fmt.Sprintf(`Не удалось удалить сообщение %v.
+Сообщение отправляется в данный момент.`, data))
+	}
+
+	err = h.messageQueue.DeleteMessage(ctx, message)
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package callback
 
 import (
+	"context"
 	"strconv"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -33,24 +34,21 @@ func (h *DeletePhotoCallback) Name() string {
 	return DeletePhotoCallbackName
 }
 
-func (h *DeletePhotoCallback) Handle(callbackQuery *tgbotapi.CallbackQuery, data string) error {
-	userState, err := h.states.GetState(callbackQuery.Message.Chat.ID)
-	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to get user state")
-	}
-
-	fileId, exists := userState.GetStringMap(state.FormFieldMessageIdFile)[data]
-	if !exists {
-		return errorx.IllegalArgument.New("failed to find fileId by messageid: %v", data)
-	}
-
+func (h *DeletePhotoCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
 	messageIdInt, err := strconv.Atoi(data)
 	if err != nil {
 		return errorx.IllegalArgument.New("failed to parse messageId from callback data: %v", data)
 	}
 
-	userState.RemoveValueFromStringSlice(state.FormFieldFiles, fileId)
-	err = h.states.SetState(userState)
+	userState, err := h.states.Update(ctx, callbackQuery.Message.Chat.ID, func(userState *state.UserState) error {
+		fileId, exists := userState.GetStringMap(state.FormFieldMessageIdFile)[data]
+		if !exists {
+			return errorx.IllegalArgument.New("failed to find fileId by messageid: %v", data)
+		}
+
+		userState.RemoveValueFromStringSlice(state.FormFieldFiles, fileId)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
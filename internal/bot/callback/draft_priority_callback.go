@@ -0,0 +1,67 @@
+package callback
+
+import (
+	"context"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+)
+
+const (
+	DraftPriorityCallbackName = "DraftPriorityCallback"
+)
+
+// DraftPriorityCallback toggles the priority of the message being composed
+type DraftPriorityCallback struct {
+	states                  state.States
+	service                 *service.Service
+	messageCategoryCallback *MessageCategoryCallback
+}
+
+func NewDraftPriorityCallback(
+	states state.States, service *service.Service, messageCategoryCallback *MessageCategoryCallback,
+) *DraftPriorityCallback {
+	return &DraftPriorityCallback{
+		states:                  states,
+		service:                 service,
+		messageCategoryCallback: messageCategoryCallback,
+	}
+}
+
+func (h *DraftPriorityCallback) Name() string {
+	return DraftPriorityCallbackName
+}
+
+func (h *DraftPriorityCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, _ string) error {
+	userState, err := h.states.Update(ctx, callbackQuery.Message.Chat.ID, func(userState *state.UserState) error {
+		userState.SetFormField(state.FormFieldPriority, !userState.GetBoolFormField(state.FormFieldPriority))
+		return nil
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
+	}
+
+	reply := tgbotapi.NewEditMessageReplyMarkup(
+		callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+		h.messageCategoryCallback.CreateCategoriesReplyMarkup(userState),
+	)
+	return h.service.Send(reply)
+}
+
+// createDraftPriorityButton is shown when a category is chosen, so that the draft is ready to be filled in
+func createDraftPriorityButton(priority bool) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData(
+		priorityButtonText(priority), DraftPriorityCallbackName+bot.CallbackSectionSeparator,
+	)
+}
+
+func priorityButtonText(priority bool) string {
+	if priority {
+		return "⚡ Приоритет: высокий"
+	}
+
+	return "Приоритет: обычный"
+}
@@ -0,0 +1,232 @@
+package callback
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/samber/lo"
+)
+
+const (
+	EditMessageCallbackName = "EditMessageCallback"
+
+	editStartButtonId = "start"
+	editSaveButtonId  = "save"
+)
+
+// EditMessageCallback loads a queued message to the form, so that it's changed the same way a new message is composed.
+// The changes are saved with MessageBuildingCallback.SubmitMessage
+type EditMessageCallback struct {
+	states                  state.States
+	service                 *service.Service
+	messageQueue            queue.MessageQueue
+	categoryService         *category.Service
+	messageCategoryCallback *MessageCategoryCallback
+	deletePhotoCallback     *DeletePhotoCallback
+	messageBuildingCallback *MessageBuildingCallback
+}
+
+func NewEditMessageCallback(
+	states state.States, service *service.Service, messageQueue queue.MessageQueue, categoryService *category.Service,
+	messageCategoryCallback *MessageCategoryCallback, deletePhotoCallback *DeletePhotoCallback,
+	messageBuildingCallback *MessageBuildingCallback,
+) *EditMessageCallback {
+	return &EditMessageCallback{
+		states:                  states,
+		service:                 service,
+		messageQueue:            messageQueue,
+		categoryService:         categoryService,
+		messageCategoryCallback: messageCategoryCallback,
+		deletePhotoCallback:     deletePhotoCallback,
+		messageBuildingCallback: messageBuildingCallback,
+	}
+}
+
+func (h *EditMessageCallback) Name() string {
+	return EditMessageCallbackName
+}
+
+func (h *EditMessageCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	action, messageId, _ := strings.Cut(data, bot.CallbackSectionSeparator)
+	switch action {
+	case editStartButtonId:
+		return h.startEditing(ctx, callbackQuery.Message.Chat, messageId)
+
+	case editSaveButtonId:
+		return h.saveChanges(ctx, callbackQuery.Message.Chat)
+
+	default:
+		return errorx.IllegalArgument.New("unsupported data: %v", data)
+	}
+}
+
+func (h *EditMessageCallback) startEditing(ctx context.Context, chat *tgbotapi.Chat, messageId string) error {
+	message, err := h.messageQueue.GetMessage(ctx, messageId)
+	if err != nil {
+		return h.service.SendMessage(chat, fmt.Sprintf(`Не удалось найти сообщение %v.
+Возможно, оно было удалено.`, messageId))
+	}
+
+	if message.UserId != chat.ID {
+		return errorx.IllegalArgument.New("can't change a message of another user")
+	}
+
+	if !message.IsEditable() {
+		return h.service.SendMessage(chat, fmt.Sprintf(`Не удалось изменить сообщение %v.
+Сообщение отправляется в данный момент или уже отправлено.`, messageId))
+	}
+
+	userState, err := h.states.GetState(ctx, chat.ID)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	categoryNodeId := ""
+	categoriesTree, err := h.categoryService.ParseCategoriesTree(userState.Categories)
+	if err != nil {
+		return err
+	}
+
+	categoryNode, found := lo.Find(categoriesTree.Leaves(), func(item *category.UserCategoryTreeNode) bool {
+		return item.Category.Id == message.CategoryId
+	})
+	if found {
+		categoryNodeId = categoryNode.Id()
+	}
+
+	userState, err = h.states.Update(ctx, chat.ID, func(userState *state.UserState) error {
+		userState.ClearForm()
+		userState.SetFormField(state.FormFieldEditMessageId, message.Id)
+		userState.SetFormField(state.FormFieldCurrentCategoryNode, categoryNodeId)
+		userState.SetFormField(state.FormFieldMessageText, message.Text)
+		userState.SetFormField(state.FormFieldFiles, message.Files)
+		userState.SetFormField(state.FormFieldLatitude, message.Latitude)
+		userState.SetFormField(state.FormFieldLongitude, message.Longitude)
+		userState.SetFormField(state.FormFieldBuildingId, strconv.FormatInt(message.BuildingId, 10))
+		userState.SetFormField(state.FormFieldPriority, message.Priority)
+		if message.IsScheduled(time.Now()) {
+			userState.SetTimeFormField(state.FormFieldSendAt, message.ScheduledAt)
+		}
+		userState.MessageHandlerName = "MessageForm"
+		return nil
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
+	}
+
+	categoryText := "не найдена, выберите новую"
+	if found {
+		categoryText = categoryNode.GetFullName()
+	}
+	replyText := fmt.Sprintf(`Изменение сообщения %v
+Категория: %v
+Текст: %v
+
+Выберите другую категорию, отправьте новый текст, добавьте или удалите фотографии, отправьте новую локацию.`,
+		message.Id, categoryText, message.Text)
+	_, err = h.service.SendMessageCustom(chat, replyText, func(reply *tgbotapi.MessageConfig) {
+		reply.ReplyMarkup = h.messageCategoryCallback.CreateCategoriesReplyMarkup(userState)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = h.sendPhotos(ctx, chat, message.Files)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.service.SendMessageCustom(chat, `Когда всё будет готово, сохраните изменения.
+Если отправить новую локацию, изменения сохранятся сразу.`, func(reply *tgbotapi.MessageConfig) {
+		saveButton := tgbotapi.NewInlineKeyboardButtonData(
+			"✅ Сохранить изменения", EditMessageCallbackName+bot.CallbackSectionSeparator+editSaveButtonId,
+		)
+		reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(saveButton))
+	})
+	return err
+}
+
+// sendPhotos Shows the photos of the message the same way the photos of a new message are, so that they can be deleted
+func (h *EditMessageCallback) sendPhotos(ctx context.Context, chat *tgbotapi.Chat, files []string) error {
+	messageIdFiles := map[string]string{}
+	for _, fileId := range files {
+		photoMessage, err := h.service.SendPhotoCustom(chat, fileId, func(photo *tgbotapi.PhotoConfig) {})
+		if err != nil {
+			return err
+		}
+
+		_, err = h.service.SendMessageCustom(chat, "Фотография из сообщения", func(reply *tgbotapi.MessageConfig) {
+			reply.ReplyToMessageID = photoMessage.MessageID
+			reply.ReplyMarkup = h.deletePhotoCallback.CreateMarkup(photoMessage.MessageID)
+		})
+		if err != nil {
+			return err
+		}
+
+		messageIdFiles[strconv.Itoa(photoMessage.MessageID)] = fileId
+	}
+
+	_, err := h.states.Update(ctx, chat.ID, func(userState *state.UserState) error {
+		for messageId, fileId := range messageIdFiles {
+			userState.PutValueToMap(state.FormFieldMessageIdFile, messageId, fileId)
+		}
+		return nil
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
+	}
+
+	return nil
+}
+
+func (h *EditMessageCallback) saveChanges(ctx context.Context, chat *tgbotapi.Chat) error {
+	userState, err := h.states.GetState(ctx, chat.ID)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	if userState.GetStringFormField(state.FormFieldEditMessageId) == "" {
+		return h.service.SendMessage(chat, `Изменения уже сохранены или отменены.
+
+/queue - управление очередью обращений`)
+	}
+
+	categoriesTree, err := h.categoryService.ParseCategoriesTree(userState.Categories)
+	if err != nil {
+		return err
+	}
+
+	categoryNode := categoriesTree.FindNodeById(userState.GetStringFormField(state.FormFieldCurrentCategoryNode))
+	if categoryNode == nil || categoryNode.Category == nil {
+		return h.service.SendMessage(chat, "Выберите категорию")
+	}
+
+	if len(userState.GetStringSlice(state.FormFieldFiles)) == 0 {
+		return h.service.SendMessage(chat, "Нужно прикрепить хотя бы одно фото")
+	}
+
+	buildingId, err := strconv.ParseInt(userState.GetStringFormField(state.FormFieldBuildingId), 10, 64)
+	if err != nil {
+		return errorx.IllegalArgument.Wrap(err, "failed to parse building id of the edited message")
+	}
+
+	return h.messageBuildingCallback.SubmitMessage(ctx, chat, userState, buildingId)
+}
+
+func createEditMessageButton(messageId string) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData("✏ Изменить", editMessageButtonData(messageId))
+}
+
+func editMessageButtonData(messageId string) string {
+	return EditMessageCallbackName + bot.CallbackSectionSeparator + editStartButtonId + bot.CallbackSectionSeparator + messageId
+}
@@ -0,0 +1,181 @@
+package callback
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const (
+	FailedMessageCallbackName = "FailedMessageCallback"
+
+	failedRetryButtonId  = "retry"
+	failedDeleteButtonId = "delete"
+	// maxDigestMessages keeps the digest within the telegram message size limit
+	maxDigestMessages   = 10
+	failureReasonLength = 200
+)
+
+// FailedMessageCallback retries or deletes a message listed in the digest of messages that failed to be sent
+type FailedMessageCallback struct {
+	logger          *zap.Logger
+	states          state.States
+	service         *service.Service
+	messageQueue    queue.MessageQueue
+	categoryService *category.Service
+}
+
+func NewFailedMessageCallback(
+	logger *zap.Logger, states state.States, service *service.Service, messageQueue queue.MessageQueue,
+	categoryService *category.Service,
+) *FailedMessageCallback {
+	return &FailedMessageCallback{
+		logger:          logger,
+		states:          states,
+		service:         service,
+		messageQueue:    messageQueue,
+		categoryService: categoryService,
+	}
+}
+
+func (h *FailedMessageCallback) Name() string {
+	return FailedMessageCallbackName
+}
+
+func (h *FailedMessageCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	action, messageId, found := strings.Cut(data, bot.CallbackSectionSeparator)
+	if !found {
+		return errorx.IllegalArgument.New("failed to parse callback data: %v", data)
+	}
+
+	var err error
+	var replyText string
+	userId := callbackQuery.Message.Chat.ID
+	switch action {
+	case failedRetryButtonId:
+		_, err = RetryMessage(ctx, h.messageQueue, userId, messageId)
+		replyText = fmt.Sprintf("Сообщение %v будет отправлено повторно", messageId)
+
+	case failedDeleteButtonId:
+		_, err = deleteUserMessage(ctx, h.messageQueue, userId, messageId)
+		replyText = fmt.Sprintf("Сообщение %v удалено", messageId)
+
+	default:
+		return errorx.IllegalArgument.New("unsupported data: %v", data)
+	}
+	if errorx.IsOfType(err, queue.ErrMessageNotEditable) {
+		replyText = fmt.Sprintf(`Не удалось изменить сообщение %v.
+Сообщение отправляется в данный момент или уже отправлено.`, messageId)
+	} else if errorx.IsOfType(err, errorx.DataUnavailable) {
+		replyText = fmt.Sprintf(`Не удалось найти сообщение %v.
+Возможно, оно было удалено.`, messageId)
+	} else if err != nil {
+		return err
+	}
+
+	if callbackQuery.Message.ReplyMarkup != nil {
+		// the message is handled, so its buttons are not needed in the digest anymore
+		reply := tgbotapi.NewEditMessageReplyMarkup(
+			callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+			withoutMessageButtons(*callbackQuery.Message.ReplyMarkup, messageId),
+		)
+		err = h.service.Send(reply)
+		if err != nil {
+			return err
+		}
+	}
+
+	return h.service.SendMessage(callbackQuery.Message.Chat, replyText)
+}
+
+// CreateDigest Describes the messages of the user that failed to be sent, each of them can be retried, edited or deleted
+func (h *FailedMessageCallback) CreateDigest(
+	ctx context.Context, userId int64, messages []*queue.Message,
+) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	userState, err := h.states.GetState(ctx, userId)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	categoryNames := getCategoryNames(h.logger, h.categoryService, userState)
+	markup := tgbotapi.NewInlineKeyboardMarkup()
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{}
+	var lines []string
+	for i, message := range lo.Slice(messages, 0, maxDigestMessages) {
+		number := strconv.Itoa(i + 1)
+		lines = append(lines, fmt.Sprintf(`%v. %v
+Категория: %v
+Текст: %v
+Причина: %v`,
+			number,
+			message.Id,
+			lo.ValueOr(categoryNames, message.CategoryId, strconv.FormatInt(message.CategoryId, 10)),
+			TextSnippet(message.Text, queueTextSnippetLength),
+			TextSnippet(describeFailure(message), failureReasonLength),
+		))
+
+		markup.InlineKeyboard = append(markup.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				"🔁 "+number, FailedMessageCallbackName+bot.CallbackSectionSeparator+failedRetryButtonId+bot.CallbackSectionSeparator+message.Id,
+			),
+			tgbotapi.NewInlineKeyboardButtonData("✏ "+number, editMessageButtonData(message.Id)),
+			tgbotapi.NewInlineKeyboardButtonData(
+				"🗑 "+number, FailedMessageCallbackName+bot.CallbackSectionSeparator+failedDeleteButtonId+bot.CallbackSectionSeparator+message.Id,
+			),
+		))
+	}
+
+	text := fmt.Sprintf("Не удалось отправить обращения: %v шт.\n\n%v", len(messages), strings.Join(lines, "\n\n"))
+	if len(messages) > maxDigestMessages {
+		text += fmt.Sprintf("\n\nи ещё %v шт.", len(messages)-maxDigestMessages)
+	}
+	text += "\n\n🔁 - отправить снова, ✏ - изменить, 🗑 - удалить\n/queue - управление очередью обращений"
+	return text, markup, nil
+}
+
+// describeFailure Explains why the message is not going to be sent anymore by its last attempt
+func describeFailure(message *queue.Message) string {
+	if len(message.Attempts) == 0 {
+		return message.FailDescription
+	}
+
+	attempt := message.Attempts[len(message.Attempts)-1]
+	switch {
+	case attempt.ErrorType == spb.ErrBadRequest.FullName():
+		return "портал отклонил обращение: " + attempt.Description
+	case attempt.ErrorType == queue.ErrNoAccounts.FullName() || attempt.ErrorType == queue.ErrAllAccountsDisabled.FullName():
+		return "нет доступных аккаунтов, авторизуйтесь с помощью /login"
+	case message.Tries >= queue.MaxTries:
+		return fmt.Sprintf("не удалось отправить за %v попыток: %v", message.Tries, attempt.Description)
+	default:
+		return attempt.Description
+	}
+}
+
+// withoutMessageButtons Removes the buttons that manage the given message
+func withoutMessageButtons(markup tgbotapi.InlineKeyboardMarkup, messageId string) tgbotapi.InlineKeyboardMarkup {
+	result := tgbotapi.NewInlineKeyboardMarkup()
+	result.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{}
+	for _, row := range markup.InlineKeyboard {
+		row = lo.Filter(row, func(button tgbotapi.InlineKeyboardButton, _ int) bool {
+			return button.CallbackData == nil ||
+				!strings.HasSuffix(*button.CallbackData, bot.CallbackSectionSeparator+messageId)
+		})
+		if len(row) > 0 {
+			result.InlineKeyboard = append(result.InlineKeyboard, row)
+		}
+	}
+	return result
+}
@@ -0,0 +1,253 @@
+package callback
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/samber/lo"
+)
+
+const (
+	MessageBuildingCallbackName = "MessageBuilding"
+)
+
+type MessageBuildingCallback struct {
+	states                  state.States
+	service                 *service.Service
+	messageQueue            queue.MessageQueue
+	categoryService         *category.Service
+	messagePriorityCallback *MessagePriorityCallback
+}
+
+func NewMessageBuildingCallback(
+	states state.States, service *service.Service, messageQueue queue.MessageQueue,
+	categoryService *category.Service, messagePriorityCallback *MessagePriorityCallback,
+) *MessageBuildingCallback {
+	return &MessageBuildingCallback{
+		states:                  states,
+		service:                 service,
+		messageQueue:            messageQueue,
+		categoryService:         categoryService,
+		messagePriorityCallback: messagePriorityCallback,
+	}
+}
+
+func (h *MessageBuildingCallback) Name() string {
+	return MessageBuildingCallbackName
+}
+
+func (h *MessageBuildingCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	userState, err := h.states.GetState(ctx, callbackQuery.Message.Chat.ID)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	address, exists := userState.GetStringMap(state.FormFieldBuildings)[data]
+	if !exists {
+		return errorx.IllegalArgument.New("failed to find building by id: %v", data)
+	}
+
+	buildingId, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return errorx.IllegalArgument.New("failed to parse buildingId from callback data: %v", data)
+	}
+
+	reply := tgbotapi.NewEditMessageText(
+		callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, "Выбран дом: "+address,
+	)
+	err = h.service.Send(reply)
+	if err != nil {
+		return err
+	}
+
+	return h.SubmitMessage(ctx, callbackQuery.Message.Chat, userState, buildingId)
+}
+
+// SubmitMessage Adds the message from the user form to the queue, or applies the form to the edited message,
+// and clears the form
+func (h *MessageBuildingCallback) SubmitMessage(ctx context.Context, chat *tgbotapi.Chat, userState *state.UserState, buildingId int64) error {
+	categoriesTree, err := h.categoryService.ParseCategoriesTree(userState.Categories)
+	if err != nil {
+		return err
+	}
+
+	categoryTreeNode := categoriesTree.FindNodeById(userState.GetStringFormField(state.FormFieldCurrentCategoryNode))
+	if categoryTreeNode == nil || categoryTreeNode.Category == nil {
+		return errorx.AssertionFailed.New("category is expected to be selected at this phase")
+	}
+
+	text := userState.GetStringFormField(state.FormFieldMessageText)
+	createdAt := time.Now()
+	messageId := createdAt.Format("06-01-02") + "_" + shortuuid.New()
+
+	queueMessage := queue.Message{
+		Id:         messageId,
+		UserId:     userState.UserId,
+		CategoryId: categoryTreeNode.Category.Id,
+		Files:      userState.GetStringSlice(state.FormFieldFiles),
+		Text:       text,
+		Longitude:  userState.GetFloatFormField(state.FormFieldLongitude),
+		Latitude:   userState.GetFloatFormField(state.FormFieldLatitude),
+		BuildingId: buildingId,
+		Priority:   userState.GetBoolFormField(state.FormFieldPriority),
+		CreatedAt:  createdAt,
+		Status:     queue.StatusCreated,
+	}
+	// the time might have passed while the message was composed
+	sendAt := userState.GetTimeFormField(state.FormFieldSendAt)
+	editMessageId := userState.GetStringFormField(state.FormFieldEditMessageId)
+	if editMessageId == "" {
+		if sendAt.After(createdAt) {
+			queueMessage.Schedule(sendAt)
+		}
+		err = h.messageQueue.Add(ctx, &queueMessage)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to add message to queue")
+		}
+	} else {
+		editedMessage, err := h.editMessage(ctx, editMessageId, &queueMessage, sendAt)
+		if errorx.IsOfType(err, queue.ErrMessageNotEditable) {
+			err = h.service.SendMessage(chat, fmt.Sprintf(`Не удалось изменить сообщение %v.
+Сообщение отправляется в данный момент или уже отправлено.`, editMessageId))
+			if err != nil {
+				return err
+			}
+
+			return h.clearForm(ctx, userState)
+		}
+		if err != nil {
+			return err
+		}
+
+		queueMessage = *editedMessage
+	}
+
+	sendTime := FormatSendAt(lo.Ternary(queueMessage.IsScheduled(createdAt), queueMessage.ScheduledAt, time.Time{}))
+	if queueMessage.Status == queue.StatusAwaitingAuthorization {
+		sendTime = "после авторизации с помощью /login"
+	}
+
+	building := "ближайший"
+	if buildingId != 0 {
+		buildingIdString := strconv.FormatInt(buildingId, 10)
+		building = lo.ValueOr(userState.GetStringMap(state.FormFieldBuildings), buildingIdString, buildingIdString)
+	}
+
+	replyText := fmt.Sprintf(
+		`
+Сообщение %v и будет отправлено %v.
+
+Пользователь: @%v
+Сообщение: %v
+Категория: %v
+Текст: %v
+Локация: %v %v
+Дом: %v
+Приоритет: %v
+Файлы: %v шт.: %v
+`, lo.Ternary(editMessageId == "", "добавлено в очередь", "изменено"),
+		sendTime,
+		chat.UserName,
+		queueMessage.Id,
+		queueMessage.CategoryId,
+		queueMessage.Text,
+		queueMessage.Longitude,
+		queueMessage.Latitude,
+		building,
+		lo.Ternary(queueMessage.Priority, "высокий", "обычный"),
+		len(queueMessage.Files),
+		queueMessage.Files,
+	)
+	_, err = h.service.SendMessageCustom(
+		chat, replyText, func(reply *tgbotapi.MessageConfig) {
+			reply.ReplyMarkup = h.messagePriorityCallback.CreateReplyMarkup(&queueMessage)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	nextCommandsMessageText := `/message - отправить новое обращение 
+
+/status - статус обращений
+`
+
+	_, err = h.service.SendMessageCustom(
+		chat, nextCommandsMessageText, func(reply *tgbotapi.MessageConfig) {
+			reply.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return h.clearForm(ctx, userState)
+}
+
+// editMessage Copies the fields the user can change to the queued message
+func (h *MessageBuildingCallback) editMessage(
+	ctx context.Context, messageId string, source *queue.Message, sendAt time.Time,
+) (*queue.Message, error) {
+	return h.messageQueue.EditMessage(ctx, messageId, func(message *queue.Message) error {
+		if message.UserId != source.UserId {
+			return errorx.IllegalArgument.New("can't change a message of another user")
+		}
+
+		message.CategoryId = source.CategoryId
+		message.Files = source.Files
+		message.Text = source.Text
+		message.Longitude = source.Longitude
+		message.Latitude = source.Latitude
+		message.BuildingId = source.BuildingId
+		message.Priority = source.Priority
+		if message.Status == queue.StatusFailed {
+			// the changes might fix the failure, so the message is sent again the same way it's retried
+			message.Tries = 0
+			message.Status = queue.StatusCreated
+			message.FailDescription = ""
+			message.Schedule(time.Time{})
+		}
+		now := time.Now()
+		if sendAt.After(now) {
+			message.Schedule(sendAt)
+		} else if message.IsScheduled(now) {
+			message.Schedule(time.Time{})
+		}
+		return nil
+	})
+}
+
+func (h *MessageBuildingCallback) clearForm(ctx context.Context, userState *state.UserState) error {
+	_, err := h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.ClearForm()
+		userState.MessageHandlerName = ""
+		return nil
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
+	}
+
+	return nil
+}
+
+func (h *MessageBuildingCallback) CreateReplyMarkup(buildings []spb.BuildingResponse) tgbotapi.InlineKeyboardMarkup {
+	result := tgbotapi.NewInlineKeyboardMarkup()
+	for _, building := range buildings {
+		buildingButton := tgbotapi.NewInlineKeyboardButtonData(
+			building.Address, MessageBuildingCallbackName+bot.CallbackSectionSeparator+strconv.FormatInt(building.Id, 10),
+		)
+		result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(buildingButton))
+	}
+	return result
+}
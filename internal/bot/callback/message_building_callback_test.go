@@ -0,0 +1,56 @@
+package callback
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestEditFailedMessage(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	messageQueue, err := queue.NewBoltQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: time.Minute}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	failed := &queue.Message{
+		Id:              "failed",
+		UserId:          1,
+		CategoryId:      1,
+		Text:            "text",
+		CreatedAt:       time.Now(),
+		RetryAfter:      time.Now().Add(time.Hour),
+		Tries:           queue.MaxTries,
+		Status:          queue.StatusFailed,
+		FailDescription: "failed to send a message",
+	}
+	if !assert.NoError(t, messageQueue.Add(ctx, failed)) {
+		return
+	}
+
+	callback := &MessageBuildingCallback{messageQueue: messageQueue}
+	edited, err := callback.editMessage(ctx, failed.Id, &queue.Message{UserId: 1, CategoryId: 2, Text: "new text"}, time.Time{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, int64(2), edited.CategoryId)
+	assert.Equal(t, "new text", edited.Text)
+	assert.Equal(t, queue.StatusCreated, edited.Status)
+	assert.Zero(t, edited.Tries)
+	assert.Empty(t, edited.FailDescription)
+	assert.False(t, edited.RetryAfter.After(time.Now()))
+}
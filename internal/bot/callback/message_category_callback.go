@@ -1,6 +1,7 @@
 package callback
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -38,8 +39,8 @@ func (h *MessageCategoryCallback) Name() string {
 	return MessageCategoryCallbackName
 }
 
-func (h *MessageCategoryCallback) Handle(callbackQuery *tgbotapi.CallbackQuery, data string) error {
-	userState, err := h.states.GetState(callbackQuery.Message.Chat.ID)
+func (h *MessageCategoryCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	userState, err := h.states.GetState(ctx, callbackQuery.Message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
@@ -72,11 +73,8 @@ func (h *MessageCategoryCallback) Handle(callbackQuery *tgbotapi.CallbackQuery,
 		markup = tgbotapi.NewInlineKeyboardMarkup()
 		markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{}
 	} else {
-		userState.SetFormField(state.FormFieldCurrentCategoryNode, childFound.Id())
-
 		if childFound.Category == nil {
 			replyText = strings.TrimSpace(fmt.Sprintf("Выберите категорию\n%v", childFound.GetFullName()))
-			markup = h.CreateCategoriesReplyMarkup(userState)
 		} else {
 			replyText = fmt.Sprintf(`Выбранная категория: %v
 Текст по умолчанию: %v
@@ -84,19 +82,24 @@ func (h *MessageCategoryCallback) Handle(callbackQuery *tgbotapi.CallbackQuery,
 Прикрепите фотографии.
 
 Для того, чтобы заменить текст по умолчанию, так же отправьте его в ответ.
-Если текст будет содержать "!", то сообщение будет отправлено с повышенным приоритетом, в первую очередь`,
+Сообщения с высоким приоритетом отправляются в первую очередь.
+Время отправки можно выбрать заранее`,
 				childFound.GetFullName(),
 				childFound.Category.Message,
 			)
-			markup = h.CreateCategoriesReplyMarkup(userState)
-			userState.SetFormField(state.FormFieldMessageText, childFound.Category.Message)
-			userState.SetFormField(state.FormFieldCurrentCategoryNode, childFound.Id())
 		}
 
-		err = h.states.SetState(userState)
+		userState, err = h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+			userState.SetFormField(state.FormFieldCurrentCategoryNode, childFound.Id())
+			if childFound.Category != nil {
+				userState.SetFormField(state.FormFieldMessageText, childFound.Category.Message)
+			}
+			return nil
+		})
 		if err != nil {
-			return errorx.EnhanceStackTrace(err, "failed to set user state")
+			return errorx.EnhanceStackTrace(err, "failed to update user state")
 		}
+		markup = h.CreateCategoriesReplyMarkup(userState)
 	}
 
 	reply := tgbotapi.NewEditMessageTextAndMarkup(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, replyText, markup)
@@ -127,6 +130,10 @@ func (h *MessageCategoryCallback) CreateCategoriesReplyMarkup(userState *state.U
 		if currentCategoryNode == nil {
 			h.logger.Error("can't find current category node by id",
 				zap.String("id", currentCategoryNodeId))
+		} else if currentCategoryNode.Category != nil {
+			priorityButton := createDraftPriorityButton(userState.GetBoolFormField(state.FormFieldPriority))
+			sendAtButton := createDraftSendAtButton(userState.GetTimeFormField(state.FormFieldSendAt))
+			result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(priorityButton, sendAtButton))
 		} else {
 			buttonsPerRow := 2
 
@@ -0,0 +1,79 @@
+package callback
+
+import (
+	"context"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+)
+
+const (
+	MessagePriorityCallbackName = "MessagePriorityCallback"
+)
+
+// MessagePriorityCallback toggles the priority of a message waiting in the queue
+type MessagePriorityCallback struct {
+	service               *service.Service
+	messageQueue          queue.MessageQueue
+	deleteMessageCallback *DeleteMessageCallback
+}
+
+func NewMessagePriorityCallback(
+	service *service.Service, messageQueue queue.MessageQueue, deleteMessageCallback *DeleteMessageCallback,
+) *MessagePriorityCallback {
+	return &MessagePriorityCallback{
+		service:               service,
+		messageQueue:          messageQueue,
+		deleteMessageCallback: deleteMessageCallback,
+	}
+}
+
+func (h *MessagePriorityCallback) Name() string {
+	return MessagePriorityCallbackName
+}
+
+func (h *MessagePriorityCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	message, err := ToggleMessagePriority(ctx, h.messageQueue, callbackQuery.Message.Chat.ID, data)
+	if errorx.IsOfType(err, queue.ErrMessageNotEditable) {
+		return h.service.SendMessage(callbackQuery.Message.Chat, fmt.Sprintf(`Не удалось изменить приоритет сообщения %v.
+Сообщение отправляется в данный момент или уже отправлено.`, data))
+	}
+	if err != nil {
+		return err
+	}
+
+	reply := tgbotapi.NewEditMessageReplyMarkup(
+		callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, h.CreateReplyMarkup(message),
+	)
+	return h.service.Send(reply)
+}
+
+// ToggleMessagePriority Changes the priority of a queued message of the user to the opposite one
+func ToggleMessagePriority(
+	ctx context.Context, messageQueue queue.MessageQueue, userId int64, messageId string,
+) (*queue.Message, error) {
+	return messageQueue.EditMessage(ctx, messageId, func(message *queue.Message) error {
+		if message.UserId != userId {
+			return errorx.IllegalArgument.New("can't change a message of another user")
+		}
+
+		message.Priority = !message.Priority
+		return nil
+	})
+}
+
+// CreateReplyMarkup Buttons to manage a queued message: change its priority, send time, edit or delete it
+func (h *MessagePriorityCallback) CreateReplyMarkup(message *queue.Message) tgbotapi.InlineKeyboardMarkup {
+	result := h.deleteMessageCallback.CreateReplyMarkup(message.Id)
+	priorityButton := tgbotapi.NewInlineKeyboardButtonData(
+		priorityButtonText(message.Priority), MessagePriorityCallbackName+bot.CallbackSectionSeparator+message.Id,
+	)
+	result.InlineKeyboard[0] = append([]tgbotapi.InlineKeyboardButton{priorityButton}, result.InlineKeyboard[0]...)
+	result.InlineKeyboard = append(result.InlineKeyboard, createScheduleButtons(message))
+	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(createEditMessageButton(message.Id)))
+	return result
+}
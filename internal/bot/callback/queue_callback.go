@@ -0,0 +1,443 @@
+package callback
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const (
+	QueueCallbackName = "QueueCallback"
+
+	queuePageSize          = 5
+	queueTextSnippetLength = 40
+
+	queuePageButtonId     = "page"
+	queueNextButtonId     = "next"
+	queuePrevButtonId     = "prev"
+	queueItemButtonId     = "item"
+	queuePhotosButtonId   = "photos"
+	queueRetryButtonId    = "retry"
+	queuePriorityButtonId = "priority"
+	queueDeleteButtonId   = "delete"
+
+	// scheduled messages are listed in a separate section of the queue
+	queuePendingSection   = "q"
+	queueScheduledSection = "s"
+)
+
+var statusNames = map[queue.Status]string{
+	queue.StatusCreated:               "ожидает отправки",
+	queue.StatusInProgress:            "отправляется",
+	queue.StatusFailed:                "не удалось отправить",
+	queue.StatusAwaitingAuthorization: "ожидает авторизации",
+	queue.StatusSent:                  "отправлено",
+}
+
+// QueueCallback browses the pages of user's messages that are not sent yet and manages a chosen message.
+// The data is an action, the section and the message id. The pages are navigated from the first or the last
+// message of the current page, so that the pages don't shift when the queue changes meanwhile
+type QueueCallback struct {
+	logger          *zap.Logger
+	states          state.States
+	service         *service.Service
+	messageQueue    queue.MessageQueue
+	categoryService *category.Service
+}
+
+func NewQueueCallback(
+	logger *zap.Logger, states state.States, service *service.Service, messageQueue queue.MessageQueue,
+	categoryService *category.Service,
+) *QueueCallback {
+	return &QueueCallback{
+		logger:          logger,
+		states:          states,
+		service:         service,
+		messageQueue:    messageQueue,
+		categoryService: categoryService,
+	}
+}
+
+func (h *QueueCallback) Name() string {
+	return QueueCallbackName
+}
+
+func (h *QueueCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	userState, err := h.states.GetState(ctx, callbackQuery.Message.Chat.ID)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	parts := strings.SplitN(data, bot.CallbackSectionSeparator, 3)
+	if len(parts) < 3 {
+		return errorx.IllegalArgument.New("failed to parse callback data: %v", data)
+	}
+
+	action := parts[0]
+	scheduled := parts[1] == queueScheduledSection
+	messageId := parts[2]
+
+	var message *queue.Message
+	switch action {
+	case queuePageButtonId, queueNextButtonId, queuePrevButtonId:
+		anchor, err := h.getAnchorMessage(ctx, userState.UserId, messageId)
+		if err != nil {
+			return err
+		}
+
+		query := queue.MessageListQuery{Scheduled: scheduled}
+		switch action {
+		case queuePageButtonId:
+			query.From = anchor
+		case queueNextButtonId:
+			query.After = anchor
+		case queuePrevButtonId:
+			query.Before = anchor
+		}
+		return h.showPage(ctx, callbackQuery, userState, query)
+
+	case queueItemButtonId:
+		message, err = getUserMessage(ctx, h.messageQueue, userState.UserId, messageId)
+
+	case queuePhotosButtonId:
+		message, err = getUserMessage(ctx, h.messageQueue, userState.UserId, messageId)
+		if err == nil {
+			return h.service.SendPhotos(callbackQuery.Message.Chat, message.Files)
+		}
+
+	case queueRetryButtonId:
+		message, err = RetryMessage(ctx, h.messageQueue, userState.UserId, messageId)
+
+	case queuePriorityButtonId:
+		message, err = ToggleMessagePriority(ctx, h.messageQueue, userState.UserId, messageId)
+
+	case queueDeleteButtonId:
+		message, err = deleteUserMessage(ctx, h.messageQueue, userState.UserId, messageId)
+		if err == nil {
+			// the page that contained the message is shown
+			return h.showPage(ctx, callbackQuery, userState, queue.MessageListQuery{Scheduled: scheduled, From: message})
+		}
+
+	default:
+		return errorx.IllegalArgument.New("unsupported data: %v", data)
+	}
+	if errorx.IsOfType(err, queue.ErrMessageNotEditable) {
+		return h.service.SendMessage(callbackQuery.Message.Chat, fmt.Sprintf(`Не удалось изменить сообщение %v.
+Сообщение отправляется в данный момент или уже отправлено.`, messageId))
+	}
+	if errorx.IsOfType(err, errorx.DataUnavailable) {
+		h.logger.Debug("message not found", zap.Error(err))
+		return h.showPage(ctx, callbackQuery, userState, queue.MessageListQuery{Scheduled: scheduled})
+	}
+	if err != nil {
+		return err
+	}
+
+	reply := tgbotapi.NewEditMessageTextAndMarkup(
+		callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+		h.describeMessage(userState, message), h.createItemReplyMarkup(message, scheduled),
+	)
+	return h.service.Send(reply)
+}
+
+// CreatePage Lists the page of user's messages, each message can be chosen to be managed.
+// Scheduled messages are listed in a separate section
+func (h *QueueCallback) CreatePage(
+	ctx context.Context, userState *state.UserState, query queue.MessageListQuery,
+) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	scheduled := query.Scheduled
+	query.Limit = queuePageSize
+	page, err := h.messageQueue.ListUserMessages(ctx, userState.UserId, query)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, errorx.EnhanceStackTrace(err, "failed to list messages")
+	}
+
+	if query.Before != nil && !page.HasPrevious {
+		// the first messages have been deleted meanwhile, so the first page is shown in full
+		return h.CreatePage(ctx, userState, queue.MessageListQuery{Scheduled: scheduled})
+	}
+
+	if anchor := lo.CoalesceOrEmpty(query.From, query.After); len(page.Messages) == 0 && anchor != nil {
+		// the last messages of the list have been deleted
+		return h.CreatePage(ctx, userState, queue.MessageListQuery{Scheduled: scheduled, Before: anchor})
+	}
+
+	markup := tgbotapi.NewInlineKeyboardMarkup()
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{}
+	sectionRow := tgbotapi.NewInlineKeyboardRow(createQueueSectionButton(!scheduled))
+	if len(page.Messages) == 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, sectionRow)
+		return lo.Ternary(scheduled, "Нет запланированных сообщений", "Нет сообщений, ожидающих отправки"), markup, nil
+	}
+
+	categoryNames := getCategoryNames(h.logger, h.categoryService, userState)
+	now := time.Now()
+	var lines []string
+	for i, message := range page.Messages {
+		number := i + 1
+		lines = append(lines, fmt.Sprintf("%v. %v\n%v\n%v", number, describeStatus(message, now),
+			lo.ValueOr(categoryNames, message.CategoryId, strconv.FormatInt(message.CategoryId, 10)),
+			TextSnippet(message.Text, queueTextSnippetLength)))
+		if message.FailDescription != "" {
+			lines[i] += "\nОшибка: " + message.FailDescription
+		}
+
+		itemButton := tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("%v. %v", number, message.Id),
+			createQueueButtonData(queueItemButtonId, scheduled, message.Id),
+		)
+		markup.InlineKeyboard = append(markup.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(itemButton))
+	}
+
+	var navigationRow []tgbotapi.InlineKeyboardButton
+	if page.HasPrevious {
+		navigationRow = append(navigationRow, tgbotapi.NewInlineKeyboardButtonData(
+			"⬅ Назад", createQueueButtonData(queuePrevButtonId, scheduled, lo.FirstOrEmpty(page.Messages).Id),
+		))
+	}
+	if page.HasMore {
+		navigationRow = append(navigationRow, tgbotapi.NewInlineKeyboardButtonData(
+			"Далее ➡", createQueueButtonData(queueNextButtonId, scheduled, lo.LastOrEmpty(page.Messages).Id),
+		))
+	}
+	if len(navigationRow) > 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, navigationRow)
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, sectionRow)
+
+	title := lo.Ternary(scheduled, "Запланированные сообщения:", "Сообщения, ожидающие отправки:")
+	text := title + "\n\n" + strings.Join(lines, "\n\n")
+	return text, markup, nil
+}
+
+func (h *QueueCallback) showPage(
+	ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, userState *state.UserState,
+	query queue.MessageListQuery,
+) error {
+	text, markup, err := h.CreatePage(ctx, userState, query)
+	if err != nil {
+		return err
+	}
+
+	reply := tgbotapi.NewEditMessageTextAndMarkup(
+		callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, text, markup,
+	)
+	return h.service.Send(reply)
+}
+
+// getAnchorMessage Reads the message the page is navigated from. The first page is shown when there's no such
+// message anymore
+func (h *QueueCallback) getAnchorMessage(
+	ctx context.Context, userId int64, messageId string,
+) (*queue.Message, error) {
+	if messageId == "" {
+		return nil, nil
+	}
+
+	message, err := getUserMessage(ctx, h.messageQueue, userId, messageId)
+	if errorx.IsOfType(err, errorx.DataUnavailable) {
+		h.logger.Debug("message not found", zap.Error(err))
+		return nil, nil
+	}
+
+	return message, err
+}
+
+// deleteUserMessage Deletes a message of the user unless it's being sent or is sent already.
+// Returns the deleted message
+func deleteUserMessage(
+	ctx context.Context, messageQueue queue.MessageQueue, userId int64, messageId string,
+) (*queue.Message, error) {
+	message, err := getUserMessage(ctx, messageQueue, userId, messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !message.IsEditable() {
+		return nil, queue.ErrMessageNotEditable.New("message is being sent or is sent already: id=%v", messageId)
+	}
+
+	return message, messageQueue.DeleteMessage(ctx, message)
+}
+
+// getUserMessage Any failure to read the message means it's not available anymore, e.g. deleted or migrated
+func getUserMessage(
+	ctx context.Context, messageQueue queue.MessageQueue, userId int64, messageId string,
+) (*queue.Message, error) {
+	message, err := messageQueue.GetMessage(ctx, messageId)
+	if err != nil {
+		return nil, errorx.DataUnavailable.Wrap(err, "failed to find message: id=%v", messageId)
+	}
+
+	if message.UserId != userId {
+		return nil, errorx.IllegalArgument.New("can't access a message of another user")
+	}
+
+	return message, nil
+}
+
+func (h *QueueCallback) describeMessage(userState *state.UserState, message *queue.Message) string {
+	result := fmt.Sprintf(`Сообщение: %v
+Статус: %v
+Категория: %v
+Текст: %v
+Приоритет: %v
+Файлы: %v шт.
+Попыток: %v`,
+		message.Id,
+		describeStatus(message, time.Now()),
+		lo.ValueOr(getCategoryNames(h.logger, h.categoryService, userState), message.CategoryId, strconv.FormatInt(message.CategoryId, 10)),
+		message.Text,
+		lo.Ternary(message.Priority, "высокий", "обычный"),
+		len(message.Files),
+		message.Tries,
+	)
+	if message.FailDescription != "" {
+		result += "\nОшибка: " + message.FailDescription
+	}
+	return result
+}
+
+func (h *QueueCallback) createItemReplyMarkup(message *queue.Message, scheduled bool) tgbotapi.InlineKeyboardMarkup {
+	var actionsRow []tgbotapi.InlineKeyboardButton
+	if len(message.Files) > 0 {
+		actionsRow = append(actionsRow, tgbotapi.NewInlineKeyboardButtonData(
+			"🖼 Фото", createQueueButtonData(queuePhotosButtonId, scheduled, message.Id),
+		))
+	}
+	if message.Status == queue.StatusCreated {
+		actionsRow = append(actionsRow, createRescheduleButton(message))
+	}
+	if canRetry(message, time.Now()) {
+		actionsRow = append(actionsRow, tgbotapi.NewInlineKeyboardButtonData(
+			"▶ Отправить сейчас", createQueueButtonData(queueRetryButtonId, scheduled, message.Id),
+		))
+	}
+
+	if message.IsEditable() {
+		actionsRow = append(actionsRow, createEditMessageButton(message.Id))
+	}
+
+	result := tgbotapi.NewInlineKeyboardMarkup()
+	if len(actionsRow) > 0 {
+		result.InlineKeyboard = append(result.InlineKeyboard, actionsRow)
+	}
+	result.InlineKeyboard = append(result.InlineKeyboard,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				priorityButtonText(message.Priority),
+				createQueueButtonData(queuePriorityButtonId, scheduled, message.Id),
+			),
+			tgbotapi.NewInlineKeyboardButtonData(
+				"🗑 Удалить", createQueueButtonData(queueDeleteButtonId, scheduled, message.Id),
+			),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				"⬆ К списку", createQueueButtonData(queuePageButtonId, scheduled, message.Id),
+			),
+		),
+	)
+	return result
+}
+
+// getCategoryNames Maps category ids to the full names from the user's categories tree
+func getCategoryNames(
+	logger *zap.Logger, categoryService *category.Service, userState *state.UserState,
+) map[int64]string {
+	result := map[int64]string{}
+	categoriesTree, err := categoryService.ParseCategoriesTree(userState.Categories)
+	if err != nil {
+		logger.Error("failed to parse user categories", zap.Error(err))
+		return result
+	}
+
+	for _, leaf := range categoriesTree.Leaves() {
+		result[leaf.Category.Id] = leaf.GetFullName()
+	}
+	return result
+}
+
+// RetryMessage Makes a failed or postponed message of the user to be sent as soon as possible
+func RetryMessage(
+	ctx context.Context, messageQueue queue.MessageQueue, userId int64, messageId string,
+) (*queue.Message, error) {
+	return messageQueue.EditMessage(ctx, messageId, func(message *queue.Message) error {
+		if message.UserId != userId {
+			return errorx.IllegalArgument.New("can't change a message of another user")
+		}
+
+		if !canRetry(message, time.Now()) {
+			return nil
+		}
+
+		message.Tries = 0
+		message.Status = queue.StatusCreated
+		message.FailDescription = ""
+		message.Schedule(time.Time{})
+		return nil
+	})
+}
+
+func canRetry(message *queue.Message, now time.Time) bool {
+	return message.Status == queue.StatusFailed ||
+		message.Status == queue.StatusCreated && message.RetryAfter.After(now)
+}
+
+func describeStatus(message *queue.Message, now time.Time) string {
+	result := statusNames[message.Status]
+	if message.IsScheduled(now) {
+		result = "запланировано на " + FormatSendAt(message.ScheduledAt)
+	} else if message.Status == queue.StatusCreated && message.RetryAfter.After(now) {
+		result += ", следующая попытка " + message.RetryAfter.In(util.SpbLocation).Format(sendAtFormattingTemplate)
+	}
+
+	if message.Priority {
+		result += " ⚡"
+	}
+	return result
+}
+
+// TextSnippet Cuts the text by runes, since the texts are mostly in cyrillic
+func TextSnippet(text string, length int) string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) <= length {
+		return string(runes)
+	}
+
+	return strings.TrimSpace(string(runes[:length])) + "…"
+}
+
+// CreateOpenQueueMarkup Offers to open the first page of the queue
+func CreateOpenQueueMarkup() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("📋 Очередь обращений", createQueueButtonData(queuePageButtonId, false, "")),
+	))
+}
+
+// createQueueSectionButton Opens the first page of the scheduled messages or of the other ones
+func createQueueSectionButton(scheduled bool) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData(
+		lo.Ternary(scheduled, "🕒 Запланированные", "📋 Ожидающие отправки"),
+		createQueueButtonData(queuePageButtonId, scheduled, ""),
+	)
+}
+
+func createQueueButtonData(action string, scheduled bool, messageId string) string {
+	section := lo.Ternary(scheduled, queueScheduledSection, queuePendingSection)
+	return QueueCallbackName + bot.CallbackSectionSeparator + action + bot.CallbackSectionSeparator + section +
+		bot.CallbackSectionSeparator + messageId
+}
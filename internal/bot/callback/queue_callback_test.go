@@ -0,0 +1,105 @@
+package callback
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestScheduledMessageActions(t *testing.T) {
+	message := &queue.Message{Id: "24-03-10_" + shortuuid.New(), Status: queue.StatusCreated}
+	message.Schedule(time.Now().Add(time.Hour))
+
+	markup := (&QueueCallback{}).createItemReplyMarkup(message, true)
+	buttons := lo.Flatten(markup.InlineKeyboard)
+	texts := lo.Map(buttons, func(button tgbotapi.InlineKeyboardButton, _ int) string {
+		return button.Text
+	})
+
+	assert.Contains(t, texts, "🕒 Перенести")
+	assert.Contains(t, texts, "▶ Отправить сейчас")
+	for _, button := range buttons {
+		// telegram limits callback data to 64 bytes
+		assert.LessOrEqual(t, len(*button.CallbackData), 64, *button.CallbackData)
+	}
+}
+
+func TestQueuePages(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	messageQueue, err := queue.NewBoltQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: time.Minute}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var messages []*queue.Message
+	for i := range queuePageSize + 2 {
+		message := &queue.Message{
+			Id:        fmt.Sprintf("24-03-10_%v", i),
+			UserId:    1,
+			Text:      "text",
+			CreatedAt: time.Now().Add(time.Duration(i) * time.Minute),
+			Status:    queue.StatusCreated,
+		}
+		if !assert.NoError(t, messageQueue.Add(ctx, message)) {
+			return
+		}
+		messages = append(messages, message)
+	}
+
+	callback := NewQueueCallback(log.NewLogger(), nil, nil, messageQueue, category.NewService(nil))
+	userState := &state.UserState{UserId: 1}
+	callbackData := func(markup tgbotapi.InlineKeyboardMarkup) []string {
+		return lo.Map(lo.Flatten(markup.InlineKeyboard), func(button tgbotapi.InlineKeyboardButton, _ int) string {
+			return *button.CallbackData
+		})
+	}
+
+	_, markup, err := callback.CreatePage(ctx, userState, queue.MessageListQuery{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	lastMessage := messages[queuePageSize-1]
+	assert.Contains(t, callbackData(markup), createQueueButtonData(queueNextButtonId, false, lastMessage.Id))
+	assert.NotContains(t, callbackData(markup), createQueueButtonData(queuePrevButtonId, false, messages[0].Id))
+
+	_, markup, err = callback.CreatePage(ctx, userState, queue.MessageListQuery{After: lastMessage})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Len(t, markup.InlineKeyboard, 4)
+	assert.Contains(t, callbackData(markup), createQueueButtonData(queuePrevButtonId, false, messages[queuePageSize].Id))
+
+	// the messages of the last page are deleted meanwhile, so the first page is shown
+	for _, message := range messages[queuePageSize:] {
+		if !assert.NoError(t, messageQueue.DeleteMessage(ctx, message)) {
+			return
+		}
+	}
+	text, _, err := callback.CreatePage(ctx, userState, queue.MessageListQuery{After: lastMessage})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Contains(t, text, fmt.Sprintf("%v. ", queuePageSize))
+}
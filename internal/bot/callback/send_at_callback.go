@@ -0,0 +1,163 @@
+package callback
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
+	"github.com/samber/lo"
+)
+
+const (
+	SendAtCallbackName = "SendAtCallback"
+
+	draftSendAtButtonId      = "draft"
+	rescheduleButtonId       = "later"
+	sendNowButtonId          = "now"
+	sendAtFormattingTemplate = "02.01 15:04"
+)
+
+// SendAtCallback asks when to send the message being composed or a queued message, or sends a queued message now
+type SendAtCallback struct {
+	states                  state.States
+	service                 *service.Service
+	messageQueue            queue.MessageQueue
+	messagePriorityCallback *MessagePriorityCallback
+}
+
+func NewSendAtCallback(
+	states state.States, service *service.Service, messageQueue queue.MessageQueue,
+	messagePriorityCallback *MessagePriorityCallback,
+) *SendAtCallback {
+	return &SendAtCallback{
+		states:                  states,
+		service:                 service,
+		messageQueue:            messageQueue,
+		messagePriorityCallback: messagePriorityCallback,
+	}
+}
+
+func (h *SendAtCallback) Name() string {
+	return SendAtCallbackName
+}
+
+func (h *SendAtCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	if data == draftSendAtButtonId {
+		return h.askSendAt(ctx, callbackQuery.Message.Chat, "")
+	}
+
+	action, messageId, found := strings.Cut(data, bot.CallbackSectionSeparator)
+	if !found {
+		return errorx.IllegalArgument.New("failed to parse callback data: %v", data)
+	}
+
+	switch action {
+	case rescheduleButtonId:
+		return h.askSendAt(ctx, callbackQuery.Message.Chat, messageId)
+
+	case sendNowButtonId:
+		return h.sendNow(ctx, callbackQuery, messageId)
+
+	default:
+		return errorx.IllegalArgument.New("unsupported data: %v", data)
+	}
+}
+
+// askSendAt Switches to the form that reads the time, then the user returns to the current form
+func (h *SendAtCallback) askSendAt(ctx context.Context, chat *tgbotapi.Chat, messageId string) error {
+	_, err := h.states.Update(ctx, chat.ID, func(userState *state.UserState) error {
+		if userState.MessageHandlerName != "SendAtForm" {
+			userState.SetFormField(state.FormFieldReturnHandler, userState.MessageHandlerName)
+		}
+		userState.SetFormField(state.FormFieldSendAtMessageId, messageId)
+		userState.MessageHandlerName = "SendAtForm"
+		return nil
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
+	}
+
+	return h.service.SendMessage(chat, `Когда отправить сообщение? Время указывается по Москве.
+`+util.SendTimeHint+`
+  сейчас - при первой возможности`)
+}
+
+func (h *SendAtCallback) sendNow(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, messageId string) error {
+	message, err := RescheduleMessage(ctx, h.messageQueue, callbackQuery.Message.Chat.ID, messageId, time.Time{})
+	if errorx.IsOfType(err, queue.ErrMessageNotEditable) {
+		return h.service.SendMessage(callbackQuery.Message.Chat, fmt.Sprintf(`Не удалось изменить время отправки сообщения %v.
+Сообщение отправляется в данный момент или уже отправлено.`, messageId))
+	}
+	if err != nil {
+		return err
+	}
+
+	reply := tgbotapi.NewEditMessageReplyMarkup(
+		callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+		h.messagePriorityCallback.CreateReplyMarkup(message),
+	)
+	return h.service.Send(reply)
+}
+
+// RescheduleMessage Changes the time a queued message of the user is sent at
+func RescheduleMessage(
+	ctx context.Context, messageQueue queue.MessageQueue, userId int64, messageId string, sendAt time.Time,
+) (*queue.Message, error) {
+	return messageQueue.EditMessage(ctx, messageId, func(message *queue.Message) error {
+		if message.UserId != userId {
+			return errorx.IllegalArgument.New("can't change a message of another user")
+		}
+
+		message.Schedule(sendAt)
+		return nil
+	})
+}
+
+// FormatSendAt Describes when a message is sent
+func FormatSendAt(sendAt time.Time) string {
+	if sendAt.IsZero() {
+		return "при первой возможности"
+	}
+
+	return sendAt.In(util.SpbLocation).Format(sendAtFormattingTemplate)
+}
+
+func createDraftSendAtButton(sendAt time.Time) tgbotapi.InlineKeyboardButton {
+	text := "🕒 Отправить позже"
+	if !sendAt.IsZero() {
+		text = "🕒 " + FormatSendAt(sendAt)
+	}
+
+	return tgbotapi.NewInlineKeyboardButtonData(text, SendAtCallbackName+bot.CallbackSectionSeparator+draftSendAtButtonId)
+}
+
+// createScheduleButtons Scheduled messages can be rescheduled or sent now
+func createScheduleButtons(message *queue.Message) []tgbotapi.InlineKeyboardButton {
+	if !message.IsScheduled(time.Now()) {
+		return []tgbotapi.InlineKeyboardButton{createRescheduleButton(message)}
+	}
+
+	return []tgbotapi.InlineKeyboardButton{
+		createRescheduleButton(message),
+		tgbotapi.NewInlineKeyboardButtonData(
+			"▶ Отправить сейчас",
+			SendAtCallbackName+bot.CallbackSectionSeparator+sendNowButtonId+bot.CallbackSectionSeparator+message.Id,
+		),
+	}
+}
+
+// createRescheduleButton Asks for the time to send a queued message at
+func createRescheduleButton(message *queue.Message) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData(
+		lo.Ternary(message.IsScheduled(time.Now()), "🕒 Перенести", "🕒 Отправить позже"),
+		SendAtCallbackName+bot.CallbackSectionSeparator+rescheduleButtonId+bot.CallbackSectionSeparator+message.Id,
+	)
+}
@@ -1,7 +1,9 @@
 package callback
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -20,7 +22,11 @@ const (
 	enableAccountButtonId        = "enable"
 	configureTimeAccountButtonId = "time"
 	deleteAccountButtonId        = "delete"
+	reloginAccountButtonId       = "relogin"
 	listAccountsButtonId         = "list"
+	pinAccountButtonId           = "pin"
+	strategyButtonId             = "strategy"
+	setStrategyButtonId          = "setStrategy"
 )
 
 type SettingsAccountsCallback struct {
@@ -39,14 +45,18 @@ func (h *SettingsAccountsCallback) Name() string {
 	return SettingsAccountsCallbackName
 }
 
-func (h *SettingsAccountsCallback) Handle(callbackQuery *tgbotapi.CallbackQuery, data string) error {
-	userState, err := h.states.GetState(callbackQuery.Message.Chat.ID)
+func (h *SettingsAccountsCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	userState, err := h.states.GetState(ctx, callbackQuery.Message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
 
 	if data == listAccountsButtonId {
-		return h.HandleCategoryAccountsButtonClick(callbackQuery)
+		return h.HandleCategoryAccountsButtonClick(ctx, callbackQuery)
+	}
+
+	if data == strategyButtonId {
+		return h.handleStrategyButton(callbackQuery, userState)
 	}
 
 	action, value, found := strings.Cut(data, bot.CallbackSectionSeparator)
@@ -59,16 +69,25 @@ func (h *SettingsAccountsCallback) Handle(callbackQuery *tgbotapi.CallbackQuery,
 		return h.handleActionsAccountButton(callbackQuery, value, userState)
 
 	case disableAccountButtonId:
-		return h.setAccountStateButton(callbackQuery, value, userState, state.AccountStateDisabled)
+		return h.setAccountStateButton(ctx, callbackQuery, value, userState, state.AccountStateDisabled)
 
 	case enableAccountButtonId:
-		return h.setAccountStateButton(callbackQuery, value, userState, state.AccountStateEnabled)
+		return h.setAccountStateButton(ctx, callbackQuery, value, userState, state.AccountStateEnabled)
 
 	case configureTimeAccountButtonId:
-		return h.configureAccountTimeButton(callbackQuery, value, userState)
+		return h.configureAccountTimeButton(ctx, callbackQuery, value, userState)
 
 	case deleteAccountButtonId:
-		return h.handleDeleteAccountButton(callbackQuery, value, userState)
+		return h.handleDeleteAccountButton(ctx, callbackQuery, value, userState)
+
+	case reloginAccountButtonId:
+		return h.reloginAccountButton(ctx, callbackQuery, value, userState)
+
+	case pinAccountButtonId:
+		return h.pinAccountButton(ctx, callbackQuery, value, userState)
+
+	case setStrategyButtonId:
+		return h.handleSetStrategyButton(ctx, callbackQuery, value, userState)
 
 	default:
 		return errorx.IllegalArgument.New("unsupported data: %v", data)
@@ -76,43 +95,95 @@ func (h *SettingsAccountsCallback) Handle(callbackQuery *tgbotapi.CallbackQuery,
 
 }
 
-func (h *SettingsAccountsCallback) handleDeleteAccountButton(callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState) error {
+func (h *SettingsAccountsCallback) handleDeleteAccountButton(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState) error {
 	accountLogin := value
-	_, index, found := lo.FindIndexOf(userState.Accounts, func(item state.Account) bool {
-		return item.Login == accountLogin
+	_, err := h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		_, index, found := lo.FindIndexOf(userState.Accounts, func(item state.Account) bool {
+			return item.Login == accountLogin
+		})
+		if !found {
+			return errorx.IllegalArgument.New("failed to find account: %v", accountLogin)
+		}
+
+		userState.Accounts = append(userState.Accounts[0:index], userState.Accounts[index+1:]...)
+		return nil
 	})
-	if !found {
-		return errorx.IllegalArgument.New("failed to find account: %v", accountLogin)
+	if err != nil {
+		return err
+	}
+
+	return h.HandleCategoryAccountsButtonClick(ctx, callbackQuery)
+}
+
+func (h *SettingsAccountsCallback) setAccountStateButton(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState, accountState state.AccountState) error {
+	accountLogin := value
+	account := userState.FindAccount(accountLogin)
+	if accountState == state.AccountStateEnabled && account != nil && account.Password == "" {
+		return h.reloginAccountButton(ctx, callbackQuery, value, userState)
 	}
 
-	userState.Accounts = append(userState.Accounts[0:index], userState.Accounts[index+1:]...)
-	err := h.states.SetState(userState)
+	_, err := h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		account := userState.FindAccount(accountLogin)
+		if account == nil {
+			return errorx.IllegalArgument.New("failed to find account: %v", accountLogin)
+		}
+
+		account.State = accountState
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	return h.HandleCategoryAccountsButtonClick(callbackQuery)
+	return h.Handle(ctx, callbackQuery, actionsAccountButtonId+bot.CallbackSectionSeparator+accountLogin)
 }
 
-func (h *SettingsAccountsCallback) setAccountStateButton(callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState, accountState state.AccountState) error {
+func (h *SettingsAccountsCallback) configureAccountTimeButton(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState) error {
 	accountLogin := value
-	_, index, found := lo.FindIndexOf(userState.Accounts, func(item state.Account) bool {
+	_, found := lo.Find(userState.Accounts, func(item state.Account) bool {
 		return item.Login == accountLogin
 	})
 	if !found {
-		return errorx.IllegalArgument.New("failed to find account: %v", accountLogin)
+		replyText := fmt.Sprintf(`Не удалось найти аккаунт по логину %v`, accountLogin)
+		return h.service.SendMessage(callbackQuery.Message.Chat, replyText)
 	}
 
-	userState.Accounts[index].State = accountState
-	err := h.states.SetState(userState)
+	_, err := h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.MessageHandlerName = "AccountTimeForm"
+		userState.SetFormField(state.FormFieldLogin, accountLogin)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	return h.Handle(callbackQuery, actionsAccountButtonId+bot.CallbackSectionSeparator+accountLogin)
+	replyText := `Напишите время, до которого будет заблокирован аккаунт в случае превышения количества обращений в сутки.
+
+Формат времени: ЧЧ:ММ`
+	return h.service.SendMessage(callbackQuery.Message.Chat, replyText)
 }
 
-func (h *SettingsAccountsCallback) configureAccountTimeButton(callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState) error {
+// reloginAccountButton Asks for a new password of the account, the account is enabled again once the login succeeds
+func (h *SettingsAccountsCallback) reloginAccountButton(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState) error {
+	accountLogin := value
+	if userState.FindAccount(accountLogin) == nil {
+		replyText := fmt.Sprintf(`Не удалось найти аккаунт по логину %v`, accountLogin)
+		return h.service.SendMessage(callbackQuery.Message.Chat, replyText)
+	}
+
+	_, err := h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.MessageHandlerName = "PasswordForm"
+		userState.SetFormField(state.FormFieldLogin, accountLogin)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return h.service.SendMessage(callbackQuery.Message.Chat, fmt.Sprintf("Введите пароль от аккаунта %v", accountLogin))
+}
+
+func (h *SettingsAccountsCallback) pinAccountButton(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState) error {
 	accountLogin := value
 	_, found := lo.Find(userState.Accounts, func(item state.Account) bool {
 		return item.Login == accountLogin
@@ -122,19 +193,53 @@ func (h *SettingsAccountsCallback) configureAccountTimeButton(callbackQuery *tgb
 		return h.service.SendMessage(callbackQuery.Message.Chat, replyText)
 	}
 
-	userState.MessageHandlerName = "AccountTimeForm"
-	userState.SetFormField(state.FormFieldLogin, accountLogin)
-	err := h.states.SetState(userState)
+	_, err := h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.MessageHandlerName = "AccountPinnedCategoriesForm"
+		userState.SetFormField(state.FormFieldLogin, accountLogin)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	replyText := `Напишите время, до которого будет заблокирован аккаунт в случае превышения количества обращений в сутки.
+	replyText := `Напишите через запятую id категорий, которые всегда будут отправляться с этого аккаунта.
+Закрепление работает, если выбран способ выбора аккаунта "Закреплённый за категорией".
 
-Формат времени: ЧЧ:ММ`
+Для того, чтобы убрать закрепление, отправьте "-"`
 	return h.service.SendMessage(callbackQuery.Message.Chat, replyText)
 }
 
+func (h *SettingsAccountsCallback) handleStrategyButton(callbackQuery *tgbotapi.CallbackQuery, userState *state.UserState) error {
+	replyText := fmt.Sprintf(`Способ выбора аккаунта для отправки обращений.
+
+По очереди - аккаунт, который дольше всех не отправлял обращения.
+Наименее загруженный сегодня - аккаунт, который отправил меньше всех обращений сегодня.
+Закреплённый за категорией - аккаунт, за которым закреплена категория обращения, остальные отправляются по очереди.
+
+Текущий: %v`, userState.GetAccountStrategy().Name())
+
+	reply := tgbotapi.NewEditMessageTextAndMarkup(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+		replyText, h.createStrategyMarkup(userState.GetAccountStrategy()))
+	return h.service.Send(reply)
+}
+
+func (h *SettingsAccountsCallback) handleSetStrategyButton(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState) error {
+	strategy := state.AccountStrategy(value)
+	if !lo.Contains(state.AccountStrategies, strategy) {
+		return errorx.IllegalArgument.New("unsupported account strategy: %v", value)
+	}
+
+	userState, err := h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.AccountStrategy = strategy
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return h.handleStrategyButton(callbackQuery, userState)
+}
+
 func (h *SettingsAccountsCallback) handleActionsAccountButton(callbackQuery *tgbotapi.CallbackQuery, value string, userState *state.UserState) error {
 	accountLogin := value
 	account, found := lo.Find(userState.Accounts, func(item state.Account) bool {
@@ -149,15 +254,24 @@ func (h *SettingsAccountsCallback) handleActionsAccountButton(callbackQuery *tgb
 		return err
 	}
 
-	accountTime := account.RateLimitNextDayTime.In(util.SpbLocation).Format("15:04 MST")
+	accountTime := account.NextDayTime().In(util.SpbLocation).Format("15:04 MST")
+
+	pinnedCategories := "нет"
+	if len(account.PinnedCategories) > 0 {
+		pinnedCategories = strings.Join(lo.Map(account.PinnedCategories, func(item int64, index int) string {
+			return strconv.FormatInt(item, 10)
+		}), ", ")
+	}
 
 	replyText := fmt.Sprintf(`Аккаунт %v
 Состояние: %v
 Время отправки обращений: %v
+Закреплённые категории: %v
 Выберите действие`,
 		accountLogin,
 		accountStateName,
 		accountTime,
+		pinnedCategories,
 	)
 
 	reply := tgbotapi.NewEditMessageTextAndMarkup(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
@@ -170,8 +284,8 @@ func (h *SettingsAccountsCallback) handleActionsAccountButton(callbackQuery *tgb
 	return nil
 }
 
-func (h *SettingsAccountsCallback) HandleCategoryAccountsButtonClick(callbackQuery *tgbotapi.CallbackQuery) error {
-	replyMarkup, err := h.createListAccountsReplyMarkup(callbackQuery)
+func (h *SettingsAccountsCallback) HandleCategoryAccountsButtonClick(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery) error {
+	replyMarkup, err := h.createListAccountsReplyMarkup(ctx, callbackQuery)
 	if err != nil {
 		return err
 	}
@@ -187,10 +301,10 @@ func (h *SettingsAccountsCallback) HandleCategoryAccountsButtonClick(callbackQue
 	return nil
 }
 
-func (h *SettingsAccountsCallback) createListAccountsReplyMarkup(callbackQuery *tgbotapi.CallbackQuery) (tgbotapi.InlineKeyboardMarkup, error) {
+func (h *SettingsAccountsCallback) createListAccountsReplyMarkup(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery) (tgbotapi.InlineKeyboardMarkup, error) {
 	result := tgbotapi.NewInlineKeyboardMarkup()
 	result.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{}
-	userState, err := h.states.GetState(callbackQuery.Message.Chat.ID)
+	userState, err := h.states.GetState(ctx, callbackQuery.Message.Chat.ID)
 	if err != nil {
 		return result, err
 	}
@@ -207,6 +321,9 @@ func (h *SettingsAccountsCallback) createListAccountsReplyMarkup(callbackQuery *
 		result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(accountButton))
 	}
 
+	strategyButton := tgbotapi.NewInlineKeyboardButtonData("Выбор аккаунта: "+userState.GetAccountStrategy().Name(), SettingsAccountsCallbackName+bot.CallbackSectionSeparator+strategyButtonId)
+	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(strategyButton))
+
 	return result, nil
 }
 
@@ -221,12 +338,54 @@ func (h *SettingsAccountsCallback) createActionMarkup(account state.Account) tgb
 	if account.State == state.AccountStateEnabled {
 		row = append(row, disableButton)
 	}
-	if account.State == state.AccountStateDisabled {
+	// an account without a password can only be enabled by logging in again
+	if account.State == state.AccountStateDisabled && account.Password != "" {
 		row = append(row, enableButton)
 	}
 	row = append(row, deleteButton)
 	result.InlineKeyboard = append(result.InlineKeyboard, row)
+	if account.State == state.AccountStateDisabled {
+		result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(createReloginButton(account.Login)))
+	}
+	pinButton := tgbotapi.NewInlineKeyboardButtonData("Закрепить категории", SettingsAccountsCallbackName+bot.CallbackSectionSeparator+pinAccountButtonId+bot.CallbackSectionSeparator+account.Login)
 	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(configureTimeButton))
+	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(pinButton))
+	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(listButton))
+	return result
+}
+
+func (h *SettingsAccountsCallback) createStrategyMarkup(current state.AccountStrategy) tgbotapi.InlineKeyboardMarkup {
+	result := tgbotapi.NewInlineKeyboardMarkup()
+	result.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{}
+	for _, strategy := range state.AccountStrategies {
+		buttonText := strategy.Name()
+		if strategy == current {
+			buttonText += " ✔️"
+		}
+		strategyButton := tgbotapi.NewInlineKeyboardButtonData(buttonText, SettingsAccountsCallbackName+bot.CallbackSectionSeparator+setStrategyButtonId+bot.CallbackSectionSeparator+string(strategy))
+		result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(strategyButton))
+	}
+	listButton := tgbotapi.NewInlineKeyboardButtonData("⬆ К списку", SettingsAccountsCallbackName+bot.CallbackSectionSeparator+listAccountsButtonId)
 	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(listButton))
 	return result
 }
+
+// CreateReloginMarkup Offers to log in with the account again or to open its settings
+func (h *SettingsAccountsCallback) CreateReloginMarkup(login string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		createReloginButton(login), createAccountSettingsButton(login),
+	))
+}
+
+// CreateAccountMarkup Offers to open the settings of the account
+func (h *SettingsAccountsCallback) CreateAccountMarkup(login string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(createAccountSettingsButton(login)))
+}
+
+func createReloginButton(login string) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData("🔑 Войти снова", SettingsAccountsCallbackName+bot.CallbackSectionSeparator+reloginAccountButtonId+bot.CallbackSectionSeparator+login)
+}
+
+func createAccountSettingsButton(login string) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData("⚙ Настройки аккаунта", SettingsAccountsCallbackName+bot.CallbackSectionSeparator+actionsAccountButtonId+bot.CallbackSectionSeparator+login)
+}
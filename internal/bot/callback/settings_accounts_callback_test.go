@@ -0,0 +1,29 @@
+package callback
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountActionsOfDisabledAccount(t *testing.T) {
+	buttonTexts := func(markup tgbotapi.InlineKeyboardMarkup) []string {
+		return lo.FlatMap(markup.InlineKeyboard, func(row []tgbotapi.InlineKeyboardButton, _ int) []string {
+			return lo.Map(row, func(button tgbotapi.InlineKeyboardButton, _ int) string {
+				return button.Text
+			})
+		})
+	}
+	h := &SettingsAccountsCallback{}
+
+	withPassword := h.createActionMarkup(state.Account{Login: "login", Password: "password", State: state.AccountStateDisabled})
+	assert.Contains(t, buttonTexts(withPassword), "Включить")
+	assert.Contains(t, buttonTexts(withPassword), "🔑 Войти снова")
+
+	withoutPassword := h.createActionMarkup(state.Account{Login: "login", State: state.AccountStateDisabled})
+	assert.NotContains(t, buttonTexts(withoutPassword), "Включить")
+	assert.Contains(t, buttonTexts(withoutPassword), "🔑 Войти снова")
+}
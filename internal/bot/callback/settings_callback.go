@@ -1,6 +1,7 @@
 package callback
 
 import (
+	"context"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joomcode/errorx"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
@@ -31,12 +32,12 @@ func (h *SettingsCallback) Name() string {
 	return SettingsCallbackName
 }
 
-func (h *SettingsCallback) Handle(callbackQuery *tgbotapi.CallbackQuery, data string) error {
+func (h *SettingsCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
 	switch data {
 	case categoriesButtonId:
 		return h.settingsCategoriesCallback.HandleCategorySettingsButtonClick(callbackQuery)
 	case accountsButtonId:
-		return h.settingsAccountsCallback.HandleCategoryAccountsButtonClick(callbackQuery)
+		return h.settingsAccountsCallback.HandleCategoryAccountsButtonClick(ctx, callbackQuery)
 	default:
 		return errorx.IllegalArgument.New("unsupported data: %v", data)
 	}
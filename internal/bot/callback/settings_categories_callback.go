@@ -1,6 +1,7 @@
 package callback
 
 import (
+	"context"
 	"encoding/json"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -18,19 +19,23 @@ const (
 	uploadButtonId                 = "Upload"
 	resetButtonId                  = "Reset"
 	downloadPortalButtonId         = "DownloadPortal"
+	validateButtonId               = "Validate"
+	generateButtonId               = "Generate"
 )
 
 type SettingsCategoriesCallback struct {
-	states    state.States
-	service   *service.Service
-	spbClient spb.Client
+	states          state.States
+	service         *service.Service
+	spbClient       spb.Client
+	categoryService *category.Service
 }
 
-func NewSettingsCategoriesCallback(states state.States, service *service.Service, spbClient spb.Client) *SettingsCategoriesCallback {
+func NewSettingsCategoriesCallback(states state.States, service *service.Service, spbClient spb.Client, categoryService *category.Service) *SettingsCategoriesCallback {
 	return &SettingsCategoriesCallback{
-		states:    states,
-		service:   service,
-		spbClient: spbClient,
+		states:          states,
+		service:         service,
+		spbClient:       spbClient,
+		categoryService: categoryService,
 	}
 }
 
@@ -38,8 +43,8 @@ func (h *SettingsCategoriesCallback) Name() string {
 	return SettingsCategoriesCallbackName
 }
 
-func (h *SettingsCategoriesCallback) Handle(callbackQuery *tgbotapi.CallbackQuery, data string) error {
-	userState, err := h.states.GetState(callbackQuery.Message.Chat.ID)
+func (h *SettingsCategoriesCallback) Handle(ctx context.Context, callbackQuery *tgbotapi.CallbackQuery, data string) error {
+	userState, err := h.states.GetState(ctx, callbackQuery.Message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
@@ -56,23 +61,27 @@ func (h *SettingsCategoriesCallback) Handle(callbackQuery *tgbotapi.CallbackQuer
 		return h.service.SendMessage(callbackQuery.Message.Chat, `В выложенном документе структура категорий.
 Его нужно скачать, отредактировать и загрузить обновлённые категории.`)
 	case uploadButtonId:
-		userState.MessageHandlerName = "UploadCategoriesForm"
-		err = h.states.SetState(userState)
+		_, err = h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+			userState.MessageHandlerName = "UploadCategoriesForm"
+			return nil
+		})
 		if err != nil {
 			return err
 		}
 
 		return h.service.SendMessage(callbackQuery.Message.Chat, "Загрузите документ с категориями")
 	case resetButtonId:
-		userState.Categories = string(category.DefaultCategoriesText)
-		err = h.states.SetState(userState)
+		_, err = h.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+			userState.Categories = string(category.DefaultCategoriesText)
+			return nil
+		})
 		if err != nil {
 			return err
 		}
 
 		return h.service.SendMessage(callbackQuery.Message.Chat, "Установлены категории по умолчанию")
 	case downloadPortalButtonId:
-		reasons, err := h.spbClient.GetReasons()
+		reasons, err := h.spbClient.GetReasons(ctx)
 		if err != nil {
 			return err
 		}
@@ -83,6 +92,31 @@ func (h *SettingsCategoriesCallback) Handle(callbackQuery *tgbotapi.CallbackQuer
 		}
 
 		return h.service.SendDocument(callbackQuery.Message.Chat, bytes, "portalCategories.json")
+	case validateButtonId:
+		categoriesTree, err := h.categoryService.ParseCategoriesTree(userState.Categories)
+		if err != nil {
+			return err
+		}
+
+		report, err := h.categoryService.ValidateCategoriesTree(ctx, categoriesTree)
+		if err != nil {
+			return err
+		}
+
+		return h.service.SendLongMessage(callbackQuery.Message.Chat, report.String())
+	case generateButtonId:
+		bytes, err := h.categoryService.GenerateCategoriesText(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = h.service.SendDocument(callbackQuery.Message.Chat, bytes, "generatedCategories.yaml")
+		if err != nil {
+			return err
+		}
+
+		return h.service.SendMessage(callbackQuery.Message.Chat, `В выложенном документе все причины портала с сообщениями по умолчанию.
+Его можно скачать, удалить лишнее, поправить сообщения и загрузить как свои категории.`)
 	default:
 		return errorx.IllegalArgument.New("unsupported data: %v", data)
 	}
@@ -108,8 +142,12 @@ func (h *SettingsCategoriesCallback) CreateReplyMarkup() tgbotapi.InlineKeyboard
 	uploadButton := tgbotapi.NewInlineKeyboardButtonData("Загрузить новые категории", SettingsCategoriesCallbackName+bot.CallbackSectionSeparator+uploadButtonId)
 	resetButton := tgbotapi.NewInlineKeyboardButtonData("Сбросить на значения по умолчанию", SettingsCategoriesCallbackName+bot.CallbackSectionSeparator+resetButtonId)
 	downloadPortalButton := tgbotapi.NewInlineKeyboardButtonData("Скачать категории портала", SettingsCategoriesCallbackName+bot.CallbackSectionSeparator+downloadPortalButtonId)
+	validateButton := tgbotapi.NewInlineKeyboardButtonData("Проверить свои категории", SettingsCategoriesCallbackName+bot.CallbackSectionSeparator+validateButtonId)
 	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(downloadButton, uploadButton))
 	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(resetButton))
 	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(downloadPortalButton))
+	generateButton := tgbotapi.NewInlineKeyboardButtonData("Сгенерировать категории из портала", SettingsCategoriesCallbackName+bot.CallbackSectionSeparator+generateButtonId)
+	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(validateButton))
+	result.InlineKeyboard = append(result.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(generateButton))
 	return result
 }
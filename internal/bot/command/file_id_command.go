@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joomcode/errorx"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
@@ -33,16 +34,13 @@ func (c *FileIdCommand) Description() string {
 	return "Узнать идентификатор фото"
 }
 
-func (c *FileIdCommand) Handle(message *tgbotapi.Message) error {
-	userState, err := c.states.GetState(message.Chat.ID)
+func (c *FileIdCommand) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	_, err := c.states.Update(ctx, message.Chat.ID, func(userState *state.UserState) error {
+		userState.MessageHandlerName = form.FileIdFormName
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to get user state")
-	}
-
-	userState.MessageHandlerName = form.FileIdFormName
-	err = c.states.SetState(userState)
-	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
 	return c.service.SendMessage(message.Chat, `Отправляйте файлы, в ответ я напишу их идентификатор.
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	_ "embed"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -34,16 +35,13 @@ func (c *LoginCommand) Description() string {
 	return "Авторизация на портале"
 }
 
-func (c *LoginCommand) Handle(message *tgbotapi.Message) error {
-	userState, err := c.states.GetState(message.Chat.ID)
+func (c *LoginCommand) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	_, err := c.states.Update(ctx, message.Chat.ID, func(userState *state.UserState) error {
+		userState.MessageHandlerName = form.LoginFormName
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to get user state")
-	}
-
-	userState.MessageHandlerName = form.LoginFormName
-	err = c.states.SetState(userState)
-	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
 	err = c.service.SendMessage(message.Chat, "Введите логин от аккаунта на портале")
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	_ "embed"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -38,8 +39,8 @@ func (c *MessageCommand) Description() string {
 	return "Отправить обращение"
 }
 
-func (c *MessageCommand) Handle(message *tgbotapi.Message) error {
-	userState, err := c.states.GetState(message.Chat.ID)
+func (c *MessageCommand) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := c.states.GetState(ctx, message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
@@ -52,11 +53,13 @@ func (c *MessageCommand) Handle(message *tgbotapi.Message) error {
 Используйте команду /login для этого.`)
 	}
 
-	userState.ClearForm()
-	userState.MessageHandlerName = form.MessageFormName
-	err = c.states.SetState(userState)
+	userState, err = c.states.Update(ctx, message.Chat.ID, func(userState *state.UserState) error {
+		userState.ClearForm()
+		userState.MessageHandlerName = form.MessageFormName
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
 	_, err = c.service.SendMessageCustom(message.Chat, "Выберите категорию", func(reply *tgbotapi.MessageConfig) {
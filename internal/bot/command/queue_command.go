@@ -0,0 +1,56 @@
+package command
+
+import (
+	"context"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+)
+
+const (
+	QueueCommandName = "queue"
+)
+
+type QueueCommand struct {
+	states        state.States
+	service       *service.Service
+	queueCallback *callback.QueueCallback
+}
+
+func NewQueueCommand(states state.States, service *service.Service, queueCallback *callback.QueueCallback) bot.Command {
+	return &QueueCommand{
+		states:        states,
+		service:       service,
+		queueCallback: queueCallback,
+	}
+}
+
+func (c *QueueCommand) Name() string {
+	return QueueCommandName
+}
+
+func (c *QueueCommand) Description() string {
+	return "Очередь обращений"
+}
+
+func (c *QueueCommand) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := c.states.GetState(ctx, message.Chat.ID)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	text, markup, err := c.queueCallback.CreatePage(ctx, userState, queue.MessageListQuery{})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.service.SendMessageCustom(message.Chat, text, func(reply *tgbotapi.MessageConfig) {
+		reply.ReplyMarkup = markup
+	})
+	return err
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
 	"time"
@@ -36,18 +37,12 @@ func (c *ResetStatusCommand) Description() string {
 	return "Сбросить статус ошибки у всех обращений"
 }
 
-func (c *ResetStatusCommand) Handle(message *tgbotapi.Message) error {
-	counter := 0
-
-	err := c.messageQueue.UpdateEachMessage(message.Chat.ID, func(message *queue.Message) {
-		if message.Status == queue.StatusFailed {
-			message.Tries = 0
-			message.RetryAfter = time.Now()
-			message.Status = queue.StatusCreated
-			message.FailDescription = ""
-
-			counter++
-		}
+func (c *ResetStatusCommand) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	counter, err := c.messageQueue.UpdateEachMessage(ctx, message.Chat.ID, queue.StatusFailed, func(message *queue.Message) {
+		message.Tries = 0
+		message.RetryAfter = time.Now()
+		message.Status = queue.StatusCreated
+		message.FailDescription = ""
 	})
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to update each message")
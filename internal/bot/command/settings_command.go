@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
@@ -31,7 +32,7 @@ func (c *SettingsCommand) Description() string {
 	return "Настройки"
 }
 
-func (c *SettingsCommand) Handle(message *tgbotapi.Message) error {
+func (c *SettingsCommand) Handle(ctx context.Context, message *tgbotapi.Message) error {
 	_, err := c.service.SendMessageCustom(message.Chat, `Выберите настройку`, func(reply *tgbotapi.MessageConfig) {
 		reply.ReplyMarkup = c.settingsCallback.CreateReplyMarkup()
 	})
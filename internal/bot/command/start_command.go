@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
 	"strings"
@@ -44,8 +45,20 @@ func (c *StartCommand) Description() string {
 	return "Запустить бота"
 }
 
-func (c *StartCommand) Handle(message *tgbotapi.Message) error {
-	userState, err := c.states.GetState(message.Chat.ID)
+func (c *StartCommand) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	_, err := c.states.Update(ctx, message.Chat.ID, func(userState *state.UserState) error {
+		if message.Chat.IsPrivate() {
+			userState.FullName = strings.TrimSpace(fmt.Sprintf("user / @%v %v %v", message.Chat.UserName, message.Chat.FirstName, message.Chat.LastName))
+		} else {
+			userState.FullName = strings.TrimSpace(fmt.Sprintf("%v / %v",
+				message.Chat.Type, message.Chat.Title))
+		}
+		userState.MessageHandlerName = ""
+		if userState.Categories == "" {
+			userState.Categories = string(category.DefaultCategoriesText)
+		}
+		return nil
+	})
 	if err != nil {
 		if errorx.IsOfType(err, state.ErrRateLimited) {
 			err = c.service.SendMessage(message.Chat, "Превышен лимит подключений к базе данных")
@@ -56,22 +69,7 @@ func (c *StartCommand) Handle(message *tgbotapi.Message) error {
 			return nil
 		}
 
-		return errorx.EnhanceStackTrace(err, "failed to get user state")
-	}
-
-	if message.Chat.IsPrivate() {
-		userState.FullName = strings.TrimSpace(fmt.Sprintf("user / @%v %v %v", message.Chat.UserName, message.Chat.FirstName, message.Chat.LastName))
-	} else {
-		userState.FullName = strings.TrimSpace(fmt.Sprintf("%v / %v",
-			message.Chat.Type, message.Chat.Title))
-	}
-	userState.MessageHandlerName = ""
-	if userState.Categories == "" {
-		userState.Categories = string(category.DefaultCategoriesText)
-	}
-	err = c.states.SetState(userState)
-	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
 	parsedTemplate, err := template.New("start").Parse(startTextTemplate)
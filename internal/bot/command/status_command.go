@@ -1,22 +1,31 @@
 package command
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joomcode/errorx"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
 	"github.com/mih-kopylov/our-spb-bot/internal/queue"
 	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
 	"github.com/samber/lo"
 )
 
 const (
-	StatusCommandName = "status"
+	StatusCommandName          = "status"
+	lastSentMessagesCount      = 5
+	lastFailedMessagesCount    = 3
+	lastAttemptsCount          = 3
+	attemptTextLength          = 300
+	nextScheduledMessagesCount = 5
 )
 
 type StatusCommand struct {
@@ -41,8 +50,8 @@ func (c *StatusCommand) Description() string {
 	return "Статус обращений"
 }
 
-func (c *StatusCommand) Handle(message *tgbotapi.Message) error {
-	userState, err := c.states.GetState(message.Chat.ID)
+func (c *StatusCommand) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := c.states.GetState(ctx, message.Chat.ID)
 	if err != nil {
 		if errorx.IsOfType(err, state.ErrRateLimited) {
 			err = c.service.SendMessage(message.Chat, "Превышен лимит подключений к базе данных")
@@ -56,11 +65,67 @@ func (c *StatusCommand) Handle(message *tgbotapi.Message) error {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
 
-	messagesCount, err := c.messageQueue.UserMessagesCount(userState.UserId)
+	messagesCount, err := c.messageQueue.UserMessagesCount(ctx, userState.UserId)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to count messages in the queue")
 	}
 
+	createdMessages, err := c.messageQueue.FindUserMessages(ctx, userState.UserId, queue.StatusCreated)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to find queued messages")
+	}
+
+	now := time.Now()
+	scheduledMessages := lo.Filter(createdMessages, func(item *queue.Message, index int) bool {
+		return item.IsScheduled(now)
+	})
+	sort.Slice(scheduledMessages, func(i, j int) bool {
+		return scheduledMessages[i].ScheduledAt.Before(scheduledMessages[j].ScheduledAt)
+	})
+	nextScheduledMessages := "нет"
+	if len(scheduledMessages) > 0 {
+		nextScheduledMessages = strings.Join(lo.Map(lo.Slice(scheduledMessages, 0, nextScheduledMessagesCount), func(item *queue.Message, index int) string {
+			return fmt.Sprintf("  %v %v", item.ScheduledAt.In(util.SpbLocation).Format("02.01 15:04"), item.Id)
+		}), "\n")
+	}
+
+	sentMessages, err := c.messageQueue.FindUserMessages(ctx, userState.UserId, queue.StatusSent)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to find sent messages")
+	}
+
+	sort.Slice(sentMessages, func(i, j int) bool {
+		return sentMessages[i].SentAt.After(sentMessages[j].SentAt)
+	})
+	lastSentMessages := "нет"
+	if len(sentMessages) > 0 {
+		lastSentMessages = strings.Join(lo.Map(lo.Slice(sentMessages, 0, lastSentMessagesCount), func(item *queue.Message, index int) string {
+			return fmt.Sprintf("  %v %v", item.SentAt.In(util.SpbLocation).Format("02.01 15:04"), item.ProblemUrl())
+		}), "\n")
+	}
+
+	failedMessages, err := c.messageQueue.FindUserMessages(ctx, userState.UserId, queue.StatusFailed)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to find failed messages")
+	}
+
+	sort.Slice(failedMessages, func(i, j int) bool {
+		return failedMessages[i].LastTriedAt.After(failedMessages[j].LastTriedAt)
+	})
+	lastFailedMessages := "нет"
+	if len(failedMessages) > 0 {
+		lastFailedMessages = strings.Join(lo.Map(lo.Slice(failedMessages, 0, lastFailedMessagesCount), func(item *queue.Message, index int) string {
+			header := "  " + item.Id
+			if len(item.Attempts) > lastAttemptsCount {
+				header += fmt.Sprintf(", последние %v попытки из %v", lastAttemptsCount, len(item.Attempts))
+			}
+			attempts := lo.Map(lo.Subset(item.Attempts, -lastAttemptsCount, lastAttemptsCount), func(attempt queue.Attempt, index int) string {
+				return "    " + callback.TextSnippet(attempt.String(), attemptTextLength)
+			})
+			return strings.Join(append([]string{header}, attempts...), "\n")
+		}), "\n")
+	}
+
 	var accounts string
 	if len(userState.Accounts) == 0 {
 		accounts = "нет"
@@ -69,35 +134,67 @@ func (c *StatusCommand) Handle(message *tgbotapi.Message) error {
 			result := "  " + item.Login
 			if item.State == state.AccountStateDisabled {
 				result += " - отключён"
-			} else if item.RateLimitedUntil.After(time.Now()) {
+			} else if item.RateLimitedUntil.After(now) {
 				result += " - заблокирован до " + item.RateLimitedUntil.Format(time.RFC3339)
+			} else if item.QuotaExhausted(now) {
+				result += " - исчерпан дневной лимит"
 			} else {
 				result += " - готов к отправке обращений"
 			}
+			result += fmt.Sprintf(", использовано сегодня %v/%v, сброс в %v",
+				item.UsedToday(now), state.AccountDailyQuota,
+				item.NextQuotaReset(now).In(util.SpbLocation).Format("15:04"))
 			return result
 		}), "\n")
 	}
 
+	nextAccount := "нет доступных"
+	account, err := queue.NewAccountStrategy(userState.GetAccountStrategy()).
+		Choose(userState, queue.AvailableAccounts(userState, time.Now()), 0)
+	if err == nil {
+		nextAccount = account.Login
+	}
+
 	reply := fmt.Sprintf(`
 Пользователь: %v id=%v
 Аккаунты:
 %v
+Выбор аккаунта: %v
+Следующий аккаунт: %v
 Сообщений отправлено: %v
 Ожидает отправки: %v
+Запланировано: %v
+Отправляется: %v
 Не удалось отправить: %v
 Ожидают авторизации: %v
+Запланированные:
+%v
+Последние отправленные:
+%v
+Последние ошибки:
+%v
+
+/queue - управление очередью обращений
 
 /message - отправить новое обращение 
 `,
 		userState.FullName,
 		userState.UserId,
 		accounts,
+		userState.GetAccountStrategy().Name(),
+		nextAccount,
 		userState.SentMessagesCount,
-		messagesCount[queue.StatusCreated],
+		messagesCount[queue.StatusCreated]-len(scheduledMessages),
+		len(scheduledMessages),
+		messagesCount[queue.StatusInProgress],
 		messagesCount[queue.StatusFailed],
 		messagesCount[queue.StatusAwaitingAuthorization],
+		nextScheduledMessages,
+		lastSentMessages,
+		lastFailedMessages,
 	)
-	err = c.service.SendMessage(message.Chat, reply)
+	// attempt descriptions contain portal responses of any length
+	err = c.service.SendLongMessage(message.Chat, reply)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to send reply")
 	}
@@ -0,0 +1,99 @@
+package form
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/samber/lo"
+)
+
+const (
+	AccountPinnedCategoriesFormName = "AccountPinnedCategoriesForm"
+)
+
+type AccountPinnedCategoriesForm struct {
+	states  state.States
+	service *service.Service
+}
+
+func (f *AccountPinnedCategoriesForm) Name() string {
+	return AccountPinnedCategoriesFormName
+}
+
+func NewAccountPinnedCategoriesForm(states state.States, service *service.Service) bot.Form {
+	return &AccountPinnedCategoriesForm{
+		states:  states,
+		service: service,
+	}
+}
+
+func (f *AccountPinnedCategoriesForm) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := f.states.GetState(ctx, message.Chat.ID)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	accountLogin := userState.GetStringFormField(state.FormFieldLogin)
+	if accountLogin == "" {
+		return f.service.SendMessage(message.Chat, `Логин, сохранённый на предыдущем шаге, не найден.
+
+Введите команду /settings чтобы попробовать снова.`)
+	}
+
+	_, found := lo.Find(userState.Accounts, func(item state.Account) bool {
+		return item.Login == accountLogin
+	})
+	if !found {
+		replyText := fmt.Sprintf(`Не удалось найти аккаунт по логину %v`, accountLogin)
+		return f.service.SendMessage(message.Chat, replyText)
+	}
+
+	pinnedCategories, err := parsePinnedCategories(message.Text)
+	if err != nil {
+		return f.service.SendMessage(message.Chat, "Не удалось прочитать id категорий. Напишите числа через запятую")
+	}
+
+	_, err = f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		account := userState.FindAccount(accountLogin)
+		if account == nil {
+			return state.ErrAccountNotFound.New("account not found: login=%v", accountLogin)
+		}
+
+		account.PinnedCategories = pinnedCategories
+		userState.MessageHandlerName = ""
+		userState.ClearForm()
+		return nil
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
+	}
+
+	replyText := fmt.Sprintf(`Закреплённые категории для аккаунта %v сохранены.`, accountLogin)
+	return f.service.SendMessage(message.Chat, replyText)
+}
+
+func parsePinnedCategories(text string) ([]int64, error) {
+	text = strings.TrimSpace(text)
+	if text == "-" {
+		return nil, nil
+	}
+
+	var result []int64
+	for _, item := range strings.Split(text, ",") {
+		categoryId, err := strconv.ParseInt(strings.TrimSpace(item), 10, 64)
+		if err != nil {
+			return nil, errorx.IllegalArgument.Wrap(err, "failed to parse category id: %v", item)
+		}
+
+		result = append(result, categoryId)
+	}
+
+	return lo.Uniq(result), nil
+}
@@ -1,6 +1,7 @@
 package form
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -36,8 +37,8 @@ func NewAccountTimeForm(logger *zap.Logger, states state.States, service *servic
 	}
 }
 
-func (f *AccountTimeForm) Handle(message *tgbotapi.Message) error {
-	userState, err := f.states.GetState(message.Chat.ID)
+func (f *AccountTimeForm) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := f.states.GetState(ctx, message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
@@ -49,7 +50,7 @@ func (f *AccountTimeForm) Handle(message *tgbotapi.Message) error {
 Введите команду /settings чтобы попробовать снова.`)
 	}
 
-	_, accountIndex, found := lo.FindIndexOf(userState.Accounts, func(item state.Account) bool {
+	_, found := lo.Find(userState.Accounts, func(item state.Account) bool {
 		return item.Login == accountLogin
 	})
 	if !found {
@@ -71,13 +72,19 @@ func (f *AccountTimeForm) Handle(message *tgbotapi.Message) error {
 	hour, min, _ := timeValue.Clock()
 	year, month, day := util.DefaultSendTime.Date()
 	newTime := time.Date(year, month, day, hour, min, 0, 0, util.SpbLocation)
-	userState.Accounts[accountIndex].RateLimitNextDayTime = newTime
-	userState.MessageHandlerName = ""
-	userState.ClearForm()
+	_, err = f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		account := userState.FindAccount(accountLogin)
+		if account == nil {
+			return state.ErrAccountNotFound.New("account not found: login=%v", accountLogin)
+		}
 
-	err = f.states.SetState(userState)
+		account.RateLimitNextDayTime = newTime
+		userState.MessageHandlerName = ""
+		userState.ClearForm()
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
 	replyText := fmt.Sprintf(`Время отправки сообщений для аккаунта %v сохранено.`, accountLogin)
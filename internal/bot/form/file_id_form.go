@@ -1,6 +1,7 @@
 package form
 
 import (
+	"context"
 	"fmt"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -27,7 +28,7 @@ func (f *FileIdForm) Name() string {
 	return FileIdFormName
 }
 
-func (f *FileIdForm) Handle(message *tgbotapi.Message) error {
+func (f *FileIdForm) Handle(ctx context.Context, message *tgbotapi.Message) error {
 	if len(message.Photo) > 0 {
 		maxPhotoSize := lo.MaxBy(
 			message.Photo, func(a tgbotapi.PhotoSize, b tgbotapi.PhotoSize) bool {
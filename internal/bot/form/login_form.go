@@ -1,6 +1,7 @@
 package form
 
 import (
+	"context"
 	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -31,8 +32,8 @@ func (f *LoginForm) Name() string {
 	return LoginFormName
 }
 
-func (f *LoginForm) Handle(message *tgbotapi.Message) error {
-	userState, err := f.states.GetState(message.Chat.ID)
+func (f *LoginForm) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := f.states.GetState(ctx, message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
@@ -53,11 +54,13 @@ func (f *LoginForm) Handle(message *tgbotapi.Message) error {
 		return f.service.SendMessage(message.Chat, "Этот логин уже используется, введите новый")
 	}
 
-	userState.SetFormField(state.FormFieldLogin, login)
-	userState.MessageHandlerName = PasswordFormName
-	err = f.states.SetState(userState)
+	_, err = f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.SetFormField(state.FormFieldLogin, login)
+		userState.MessageHandlerName = PasswordFormName
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
 	return f.service.SendMessage(message.Chat, "Введите пароль")
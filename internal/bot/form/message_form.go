@@ -1,34 +1,37 @@
 package form
 
 import (
+	"context"
 	"fmt"
 	"strconv"
-	"strings"
-	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joomcode/errorx"
-	"github.com/lithammer/shortuuid/v4"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
 	"github.com/mih-kopylov/our-spb-bot/internal/category"
-	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
 	"github.com/mih-kopylov/our-spb-bot/internal/state"
 	"github.com/samber/lo"
+	"go.uber.org/zap"
 )
 
 const (
-	MessageFormName = "MessageForm"
+	MessageFormName      = "MessageForm"
+	maxBuildingsToChoose = 5
+	// maxFiles is the number of files the portal accepts in a problem
+	maxFiles = 5
 )
 
 type MessageForm struct {
-	states                state.States
-	service               *service.Service
-	messageQueue          queue.MessageQueue
-	categoryService       *category.Service
-	deleteMessageCallback *callback.DeleteMessageCallback
-	deletePhotoCallback   *callback.DeletePhotoCallback
+	logger                  *zap.Logger
+	states                  state.States
+	service                 *service.Service
+	spbClient               spb.Client
+	categoryService         *category.Service
+	deletePhotoCallback     *callback.DeletePhotoCallback
+	messageBuildingCallback *callback.MessageBuildingCallback
 }
 
 func (f *MessageForm) Name() string {
@@ -36,42 +39,43 @@ func (f *MessageForm) Name() string {
 }
 
 func NewMessageForm(
-	states state.States, service *service.Service,
-	messageQueue queue.MessageQueue, categoryService *category.Service,
-	deleteMessageCallback *callback.DeleteMessageCallback, deletePhotoCallback *callback.DeletePhotoCallback,
+	logger *zap.Logger, states state.States, service *service.Service,
+	spbClient spb.Client, categoryService *category.Service,
+	deletePhotoCallback *callback.DeletePhotoCallback, messageBuildingCallback *callback.MessageBuildingCallback,
 ) bot.Form {
 	return &MessageForm{
-		states:                states,
-		service:               service,
-		messageQueue:          messageQueue,
-		categoryService:       categoryService,
-		deleteMessageCallback: deleteMessageCallback,
-		deletePhotoCallback:   deletePhotoCallback,
+		logger:                  logger,
+		states:                  states,
+		service:                 service,
+		spbClient:               spbClient,
+		categoryService:         categoryService,
+		deletePhotoCallback:     deletePhotoCallback,
+		messageBuildingCallback: messageBuildingCallback,
 	}
 }
 
-func (f *MessageForm) Handle(message *tgbotapi.Message) error {
-	userState, err := f.states.GetState(message.Chat.ID)
+func (f *MessageForm) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := f.states.GetState(ctx, message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
 
 	if message.Text != "" {
-		return f.handleText(message, userState)
+		return f.handleText(ctx, message, userState)
 	}
 
 	if len(message.Photo) > 0 {
-		return f.handlePhoto(message, userState)
+		return f.handlePhoto(ctx, message, userState)
 	}
 
 	if message.Location != nil {
-		return f.handleLocation(message, userState)
+		return f.handleLocation(ctx, message, userState)
 	}
 
 	return nil
 }
 
-func (f *MessageForm) handleLocation(message *tgbotapi.Message, userState *state.UserState) error {
+func (f *MessageForm) handleLocation(ctx context.Context, message *tgbotapi.Message, userState *state.UserState) error {
 	categoriesTree, err := f.categoryService.ParseCategoriesTree(userState.Categories)
 	if err != nil {
 		return err
@@ -96,84 +100,95 @@ func (f *MessageForm) handleLocation(message *tgbotapi.Message, userState *state
 		return nil
 	}
 
-	text := userState.GetStringFormField(state.FormFieldMessageText)
-	createdAt := time.Now()
-	messageId := createdAt.Format("06-01-02") + "_" + shortuuid.New()
-	if strings.Contains(text, "!") {
-		messageId = "00_" + messageId
+	userState.SetFormField(state.FormFieldLatitude, message.Location.Latitude)
+	userState.SetFormField(state.FormFieldLongitude, message.Location.Longitude)
+
+	reason, err := f.spbClient.GetReason(ctx, categoryTreeNode.Category.Id)
+	if err != nil {
+		f.logger.Warn(
+			"failed to get reason, the nearest building will be resolved at send time",
+			zap.Int64("reasonId", categoryTreeNode.Category.Id),
+			zap.Error(err),
+		)
+		return f.messageBuildingCallback.SubmitMessage(ctx, message.Chat, userState, 0)
 	}
 
-	queueMessage := queue.Message{
-		Id:         messageId,
-		UserId:     userState.UserId,
-		CategoryId: categoryTreeNode.Category.Id,
-		Files:      userState.GetStringSlice(state.FormFieldFiles),
-		Text:       text,
-		Longitude:  message.Location.Longitude,
-		Latitude:   message.Location.Latitude,
-		CreatedAt:  createdAt,
-		Status:     queue.StatusCreated,
+	if !reason.PositionType.RequiresBuilding() {
+		return f.messageBuildingCallback.SubmitMessage(ctx, message.Chat, userState, 0)
 	}
-	err = f.messageQueue.Add(&queueMessage)
+
+	nearestBuildings, err := f.spbClient.GetNearestBuildings(ctx, message.Location.Latitude, message.Location.Longitude)
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to add message to queue")
+		return err
 	}
 
-	replyText := fmt.Sprintf(
-		`
-Сообщение добавлено в очередь и будет отправлено при первой возможности.
-
-Пользователь: @%v
-Сообщение: %v
-Категория: %v
-Текст: %v
-Локация: %v %v
-Файлы: %v шт.: %v
-`, message.Chat.UserName,
-		queueMessage.Id,
-		queueMessage.CategoryId,
-		queueMessage.Text,
-		queueMessage.Longitude,
-		queueMessage.Latitude,
-		len(queueMessage.Files),
-		queueMessage.Files,
-	)
-	_, err = f.service.SendMessageCustom(
-		message.Chat, replyText, func(reply *tgbotapi.MessageConfig) {
-			reply.ReplyMarkup = f.deleteMessageCallback.CreateReplyMarkup(queueMessage.Id)
-		},
-	)
-	if err != nil {
+	if len(nearestBuildings.Buildings) == 0 {
+		_, err := f.service.SendMessageCustom(
+			message.Chat, "Рядом с этой локацией не найдено ни одного дома. Отправьте другую локацию", func(reply *tgbotapi.MessageConfig) {
+				reply.ReplyToMessageID = message.MessageID
+			},
+		)
 		return err
 	}
 
-	nextCommandsMessageText := `/message - отправить новое обращение 
+	buildings := nearestBuildings.Buildings
+	if len(buildings) > maxBuildingsToChoose {
+		buildings = buildings[:maxBuildingsToChoose]
+	}
 
-/status - статус обращений
-`
+	buildingAddresses := map[string]string{}
+	for _, building := range buildings {
+		buildingAddresses[strconv.FormatInt(building.Id, 10)] = building.Address
+	}
+	userState.SetFormField(state.FormFieldBuildings, buildingAddresses)
+
+	if len(buildings) == 1 {
+		return f.messageBuildingCallback.SubmitMessage(ctx, message.Chat, userState, buildings[0].Id)
+	}
+
+	_, err = f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.SetFormField(state.FormFieldLatitude, message.Location.Latitude)
+		userState.SetFormField(state.FormFieldLongitude, message.Location.Longitude)
+		userState.SetFormField(state.FormFieldBuildings, buildingAddresses)
+		return nil
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
+	}
 
 	_, err = f.service.SendMessageCustom(
-		message.Chat, nextCommandsMessageText, func(reply *tgbotapi.MessageConfig) {
-			reply.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+		message.Chat, "Выберите дом", func(reply *tgbotapi.MessageConfig) {
+			reply.ReplyToMessageID = message.MessageID
+			reply.ReplyMarkup = f.messageBuildingCallback.CreateReplyMarkup(buildings)
+		},
+	)
+	return err
+}
+
+func (f *MessageForm) handlePhoto(ctx context.Context, message *tgbotapi.Message, userState *state.UserState) error {
+	maxPhotoSize := lo.MaxBy(
+		message.Photo, func(a tgbotapi.PhotoSize, b tgbotapi.PhotoSize) bool {
+			return a.Width*a.Height > b.Width*b.Height
 		},
 	)
-	if err != nil {
-		return err
-	}
 
-	userState.ClearForm()
-	userState.MessageHandlerName = ""
+	photoAdded := false
+	userState, err := f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		photoAdded = false
+		if len(userState.GetStringSlice(state.FormFieldFiles)) >= maxFiles {
+			return nil
+		}
 
-	err = f.states.SetState(userState)
+		userState.AddValueToStringSlice(state.FormFieldFiles, maxPhotoSize.FileID)
+		userState.PutValueToMap(state.FormFieldMessageIdFile, strconv.Itoa(message.MessageID), maxPhotoSize.FileID)
+		photoAdded = true
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
-	return nil
-}
-
-func (f *MessageForm) handlePhoto(message *tgbotapi.Message, userState *state.UserState) error {
-	if len(userState.GetStringSlice(state.FormFieldFiles)) == 5 {
+	if !photoAdded {
 		replyText := `Портал допускает максимум 5 файлов в обращении.
 Это фото не будет приложено. 
 Для того, чтобы использовать именно это фото, можно удалить одно из предыдущих.`
@@ -185,19 +200,6 @@ func (f *MessageForm) handlePhoto(message *tgbotapi.Message, userState *state.Us
 		return err
 	}
 
-	maxPhotoSize := lo.MaxBy(
-		message.Photo, func(a tgbotapi.PhotoSize, b tgbotapi.PhotoSize) bool {
-			return a.Width*a.Height > b.Width*b.Height
-		},
-	)
-
-	userState.AddValueToStringSlice(state.FormFieldFiles, maxPhotoSize.FileID)
-	userState.PutValueToMap(state.FormFieldMessageIdFile, strconv.Itoa(message.MessageID), maxPhotoSize.FileID)
-	err := f.states.SetState(userState)
-	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
-	}
-
 	replyText := fmt.Sprintf(
 		`Фотография добавлена.
 
@@ -240,20 +242,17 @@ Id: %v
 	return nil
 }
 
-func (f *MessageForm) handleText(message *tgbotapi.Message, userState *state.UserState) error {
-	userState.SetFormField(state.FormFieldMessageText, message.Text)
-
-	err := f.states.SetState(userState)
+func (f *MessageForm) handleText(ctx context.Context, message *tgbotapi.Message, userState *state.UserState) error {
+	_, err := f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.SetFormField(state.FormFieldMessageText, message.Text)
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
-	replyText := "Текст сообщения заменён."
-	if strings.Contains(message.Text, "!") {
-		replyText += "\nСообщение будет отправлено в первую очередь."
-	}
 	_, err = f.service.SendMessageCustom(
-		message.Chat, replyText, func(reply *tgbotapi.MessageConfig) {
+		message.Chat, "Текст сообщения заменён.", func(reply *tgbotapi.MessageConfig) {
 			reply.ReplyToMessageID = message.MessageID
 		},
 	)
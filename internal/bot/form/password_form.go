@@ -1,15 +1,19 @@
 package form
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joomcode/errorx"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
 	"github.com/mih-kopylov/our-spb-bot/internal/queue"
 	"github.com/mih-kopylov/our-spb-bot/internal/spb"
 	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
 )
 
 const (
@@ -36,8 +40,8 @@ func NewPasswordForm(states state.States, service *service.Service, spbClient sp
 	}
 }
 
-func (f *PasswordForm) Handle(message *tgbotapi.Message) error {
-	userState, err := f.states.GetState(message.Chat.ID)
+func (f *PasswordForm) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := f.states.GetState(ctx, message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
@@ -59,14 +63,15 @@ func (f *PasswordForm) Handle(message *tgbotapi.Message) error {
 Введите команду /login для авторизации.`)
 	}
 
-	userState.MessageHandlerName = ""
-	userState.ClearForm()
-
-	tokenResponse, err := f.spbClient.Login(login, password)
+	tokenResponse, err := f.spbClient.Login(ctx, login, password)
 	if err != nil {
-		err = f.states.SetState(userState)
+		_, err = f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+			userState.MessageHandlerName = ""
+			userState.ClearForm()
+			return nil
+		})
 		if err != nil {
-			return errorx.EnhanceStackTrace(err, "failed to set user state")
+			return errorx.EnhanceStackTrace(err, "failed to update user state")
 		}
 
 		return f.service.SendMessage(message.Chat, `Не удалось авторизоваться.
@@ -74,24 +79,48 @@ func (f *PasswordForm) Handle(message *tgbotapi.Message) error {
 Введите команду /login для авторизации.`)
 	}
 
-	userState.Accounts = append(userState.Accounts, state.Account{
-		Login:            login,
-		Password:         password,
-		Token:            tokenResponse.AccessToken,
-		RateLimitedUntil: time.Time{},
-		State:            state.AccountStateEnabled,
-	})
+	relogin := false
+	_, err = f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.MessageHandlerName = ""
+		userState.ClearForm()
+		// an account disabled after a failed authorization keeps its login and settings, so it's enabled again
+		account := userState.FindAccount(login)
+		relogin = account != nil
+		if relogin {
+			account.Password = password
+			account.Token = tokenResponse.AccessToken
+			account.State = state.AccountStateEnabled
+			return nil
+		}
 
-	err = f.states.SetState(userState)
+		userState.Accounts = append(userState.Accounts, state.Account{
+			Login:                login,
+			Password:             password,
+			Token:                tokenResponse.AccessToken,
+			RateLimitedUntil:     time.Time{},
+			RateLimitNextDayTime: util.DefaultSendTime,
+			State:                state.AccountStateEnabled,
+		})
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
-	err = f.queue.ResetAwaitingAuthorizationMessages(userState.UserId)
+	err = f.queue.ResetAwaitingAuthorizationMessages(ctx, userState.UserId)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to reset messages that are waiting for authorization")
 	}
 
+	if relogin {
+		_, err = f.service.SendMessageCustom(message.Chat, fmt.Sprintf(`Авторизация прошла успешно. Аккаунт %v снова включён.
+
+Обращения, ожидающие авторизации, будут отправлены.`, login), func(reply *tgbotapi.MessageConfig) {
+			reply.ReplyMarkup = callback.CreateOpenQueueMarkup()
+		})
+		return err
+	}
+
 	return f.service.SendMessage(message.Chat, `Авторизация прошла успешно. Учётные данные сохранены.
 
 Введите команду /message для отправки обращения.`)
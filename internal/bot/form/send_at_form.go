@@ -0,0 +1,101 @@
+package form
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
+	"go.uber.org/zap"
+)
+
+const (
+	SendAtFormName = "SendAtForm"
+	sendNowInput   = "сейчас"
+)
+
+// SendAtForm reads the time to send the message being composed or a queued message at
+type SendAtForm struct {
+	logger                  *zap.Logger
+	states                  state.States
+	service                 *service.Service
+	messageQueue            queue.MessageQueue
+	messagePriorityCallback *callback.MessagePriorityCallback
+}
+
+func (f *SendAtForm) Name() string {
+	return SendAtFormName
+}
+
+func NewSendAtForm(
+	logger *zap.Logger, states state.States, service *service.Service, messageQueue queue.MessageQueue,
+	messagePriorityCallback *callback.MessagePriorityCallback,
+) bot.Form {
+	return &SendAtForm{
+		logger:                  logger,
+		states:                  states,
+		service:                 service,
+		messageQueue:            messageQueue,
+		messagePriorityCallback: messagePriorityCallback,
+	}
+}
+
+func (f *SendAtForm) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := f.states.GetState(ctx, message.Chat.ID)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	var sendAt time.Time
+	if strings.ToLower(strings.TrimSpace(message.Text)) != sendNowInput {
+		sendAt, err = util.ParseSendTime(message.Text, time.Now())
+		if err != nil {
+			f.logger.Debug("failed to parse send time", zap.Error(err))
+			return f.service.SendMessage(message.Chat, "Не удалось распознать время.\n"+util.SendTimeHint)
+		}
+	}
+
+	messageId := userState.GetStringFormField(state.FormFieldSendAtMessageId)
+	_, err = f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		if messageId == "" {
+			userState.SetTimeFormField(state.FormFieldSendAt, sendAt)
+		}
+		userState.MessageHandlerName = userState.GetStringFormField(state.FormFieldReturnHandler)
+		userState.SetFormField(state.FormFieldReturnHandler, "")
+		userState.SetFormField(state.FormFieldSendAtMessageId, "")
+		return nil
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
+	}
+
+	if messageId == "" {
+		return f.service.SendMessage(message.Chat, "Сообщение будет отправлено "+callback.FormatSendAt(sendAt))
+	}
+
+	queueMessage, err := callback.RescheduleMessage(ctx, f.messageQueue, userState.UserId, messageId, sendAt)
+	if errorx.IsOfType(err, queue.ErrMessageNotEditable) {
+		return f.service.SendMessage(message.Chat, fmt.Sprintf(`Не удалось изменить время отправки сообщения %v.
+Сообщение отправляется в данный момент или уже отправлено.`, messageId))
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = f.service.SendMessageCustom(
+		message.Chat,
+		fmt.Sprintf("Сообщение %v будет отправлено %v", messageId, callback.FormatSendAt(sendAt)),
+		func(reply *tgbotapi.MessageConfig) {
+			reply.ReplyMarkup = f.messagePriorityCallback.CreateReplyMarkup(queueMessage)
+		},
+	)
+	return err
+}
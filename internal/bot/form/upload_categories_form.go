@@ -1,6 +1,7 @@
 package form
 
 import (
+	"context"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joomcode/errorx"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
@@ -34,8 +35,8 @@ func (f *UploadCategoriesForm) Name() string {
 	return UploadCategoriesFormName
 }
 
-func (f *UploadCategoriesForm) Handle(message *tgbotapi.Message) error {
-	userState, err := f.states.GetState(message.Chat.ID)
+func (f *UploadCategoriesForm) Handle(ctx context.Context, message *tgbotapi.Message) error {
+	userState, err := f.states.GetState(ctx, message.Chat.ID)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to get user state")
 	}
@@ -52,22 +53,38 @@ func (f *UploadCategoriesForm) Handle(message *tgbotapi.Message) error {
 		return err
 	}
 
-	_, err = f.categoryService.ParseCategoriesTree(string(fileContent))
+	categoriesTree, err := f.categoryService.ParseCategoriesTree(string(fileContent))
 	if err != nil {
-		f.logger.Error("can't parse document")
-		_, err = f.service.SendMessageCustom(message.Chat, "Документ должен быть в yaml формате", func(reply *tgbotapi.MessageConfig) {
+		f.logger.Error("can't parse document", zap.Error(err))
+		_, err = f.service.SendMessageCustom(message.Chat, "Документ должен быть в yaml формате\n"+err.Error(), func(reply *tgbotapi.MessageConfig) {
 			reply.ReplyToMessageID = message.MessageID
 		})
+		return err
+	}
+
+	report, err := f.categoryService.ValidateCategoriesTree(ctx, categoriesTree)
+	if err != nil {
+		return err
+	}
+
+	if !report.Valid() {
+		err = f.service.SendLongMessage(message.Chat, report.String())
 		if err != nil {
 			return err
 		}
+
+		return f.service.SendMessage(message.Chat, `Категории не обновлены, потому что некоторые причины не найдены на портале.
+
+Исправьте документ и загрузите его снова.`)
 	}
 
-	userState.Categories = string(fileContent)
-	userState.MessageHandlerName = ""
-	err = f.states.SetState(userState)
+	_, err = f.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+		userState.Categories = string(fileContent)
+		userState.MessageHandlerName = ""
+		return nil
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
 	return f.service.SendMessage(message.Chat, "Категории обновлены")
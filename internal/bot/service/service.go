@@ -2,6 +2,8 @@ package service
 
 import (
 	"net/http"
+	"strings"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/imroc/req/v3"
@@ -9,6 +11,10 @@ import (
 	"github.com/mih-kopylov/our-spb-bot/internal/bot"
 )
 
+const (
+	maxMessageLength = 4000
+)
+
 type Service struct {
 	api *tgbotapi.BotAPI
 }
@@ -24,6 +30,27 @@ func (s *Service) SendMessage(chat *tgbotapi.Chat, text string) error {
 	return err
 }
 
+// SendLongMessage Sends a text that may exceed the telegram message size limit, splitting it by lines
+func (s *Service) SendLongMessage(chat *tgbotapi.Chat, text string) error {
+	var part strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if part.Len() > 0 && utf8.RuneCountInString(part.String())+utf8.RuneCountInString(line) >= maxMessageLength {
+			err := s.SendMessage(chat, part.String())
+			if err != nil {
+				return err
+			}
+			part.Reset()
+		}
+
+		if part.Len() > 0 {
+			part.WriteString("\n")
+		}
+		part.WriteString(line)
+	}
+
+	return s.SendMessage(chat, part.String())
+}
+
 func (s *Service) SendMessageCustom(chat *tgbotapi.Chat, text string, messageAdjuster func(reply *tgbotapi.MessageConfig)) (*tgbotapi.Message, error) {
 	message := tgbotapi.NewMessage(chat.ID, text)
 	messageAdjuster(&message)
@@ -80,6 +107,35 @@ func (s *Service) SendDocument(chat *tgbotapi.Chat, bytes []byte, name string) e
 	return nil
 }
 
+func (s *Service) SendPhotoCustom(chat *tgbotapi.Chat, fileId string, photoAdjuster func(photo *tgbotapi.PhotoConfig)) (*tgbotapi.Message, error) {
+	photo := tgbotapi.NewPhoto(chat.ID, tgbotapi.FileID(fileId))
+	photoAdjuster(&photo)
+	result, err := s.api.Send(photo)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to send a photo")
+	}
+
+	return &result, nil
+}
+
+// SendPhotos Sends the photos by their telegram file ids, several photos are sent as an album
+func (s *Service) SendPhotos(chat *tgbotapi.Chat, fileIds []string) error {
+	if len(fileIds) == 1 {
+		return s.Send(tgbotapi.NewPhoto(chat.ID, tgbotapi.FileID(fileIds[0])))
+	}
+
+	var media []any
+	for _, fileId := range fileIds {
+		media = append(media, tgbotapi.NewInputMediaPhoto(tgbotapi.FileID(fileId)))
+	}
+	_, err := s.api.SendMediaGroup(tgbotapi.NewMediaGroup(chat.ID, media))
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to send photos")
+	}
+
+	return nil
+}
+
 func (s *Service) DownloadFile(fileId string) ([]byte, error) {
 	fileUrl, err := s.api.GetFileDirectURL(fileId)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	_ "embed"
 	"encoding/base64"
+	"fmt"
 	"strings"
 
 	"github.com/joomcode/errorx"
@@ -27,6 +28,17 @@ type UserCategoryTreeNode struct {
 	Category *UserCategory
 	Parent   *UserCategoryTreeNode
 	Children []*UserCategoryTreeNode
+	// Position of the category id in the source document
+	Position Position
+}
+
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%v:%v", p.Line, p.Column)
 }
 
 func (n *UserCategoryTreeNode) Id() string {
@@ -66,3 +78,16 @@ func (n *UserCategoryTreeNode) FindNodeById(id string) *UserCategoryTreeNode {
 
 	return nil
 }
+
+// Leaves Returns all nodes that have a category, in the document order
+func (n *UserCategoryTreeNode) Leaves() []*UserCategoryTreeNode {
+	if n.Category != nil {
+		return []*UserCategoryTreeNode{n}
+	}
+
+	var result []*UserCategoryTreeNode
+	for _, child := range n.Children {
+		result = append(result, child.Leaves()...)
+	}
+	return result
+}
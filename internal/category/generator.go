@@ -0,0 +1,71 @@
+package category
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"gopkg.in/yaml.v3"
+)
+
+// generateCategoriesText builds a categories document with city / category / reason structure
+// from the portal classifier. Reason names are used as default messages
+func generateCategoriesText(cities []spb.CityResponse) ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, city := range cities {
+		cityNode := &yaml.Node{Kind: yaml.MappingNode}
+		for _, category := range city.Categories {
+			categoryNode := &yaml.Node{Kind: yaml.MappingNode}
+			for _, reason := range category.Reasons {
+				reasonNode := &yaml.Node{Kind: yaml.MappingNode}
+				addMappingItem(reasonNode, "id", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: fmt.Sprint(reason.Id)})
+				addMappingItem(reasonNode, "message", &yaml.Node{Kind: yaml.ScalarNode, Value: strings.TrimSpace(reason.Name)})
+				addMappingItem(categoryNode, uniqueKey(categoryNode, reason.Name, reason.Id), reasonNode)
+			}
+
+			if len(categoryNode.Content) > 0 {
+				addMappingItem(cityNode, uniqueKey(cityNode, category.Name, category.Id), categoryNode)
+			}
+		}
+
+		if len(cityNode.Content) > 0 {
+			addMappingItem(root, uniqueKey(root, city.Name, city.Id), cityNode)
+		}
+	}
+
+	if len(root.Content) == 0 {
+		return nil, errorx.IllegalState.New("portal classifier has no reasons")
+	}
+
+	result := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&result)
+	encoder.SetIndent(2)
+	err := encoder.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to marshall categories")
+	}
+
+	err = encoder.Close()
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to marshall categories")
+	}
+
+	return result.Bytes(), nil
+}
+
+func addMappingItem(mapping *yaml.Node, key string, value *yaml.Node) {
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+}
+
+// uniqueKey appends id to the name when the mapping already has such a key, because the portal has duplicate names
+func uniqueKey(mapping *yaml.Node, name string, id int64) string {
+	key := strings.TrimSpace(name)
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return fmt.Sprintf("%v (%v)", key, id)
+		}
+	}
+	return key
+}
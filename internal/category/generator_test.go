@@ -0,0 +1,56 @@
+package category
+
+import (
+	"testing"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateCategoriesText(t *testing.T) {
+	cities := []spb.CityResponse{{
+		Id:   1,
+		Name: "Город",
+		Categories: []spb.CategoryResponse{{
+			Id:   2,
+			Name: "Благоустройство",
+			Reasons: []spb.ReasonResponse{
+				{Id: 3, Name: "Мусор"},
+				{Id: 4, Name: "Мусор"},
+				{Id: 5, Name: " Надписи: на стене "},
+			},
+		}, {
+			Id:   6,
+			Name: "Пустая категория",
+		}},
+	}}
+
+	actual, err := generateCategoriesText(cities)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, `Город:
+  Благоустройство:
+    Мусор:
+      id: 3
+      message: Мусор
+    Мусор (4):
+      id: 4
+      message: Мусор
+    'Надписи: на стене':
+      id: 5
+      message: 'Надписи: на стене'
+`, string(actual))
+
+	tree, err := createUserCategoryTree(string(actual))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, tree.Leaves(), 3)
+}
+
+func TestGenerateCategoriesTextEmpty(t *testing.T) {
+	_, err := generateCategoriesText(nil)
+	assert.Error(t, err)
+}
@@ -1,23 +1,67 @@
 package category
 
 import (
+	"context"
 	"strconv"
 
 	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
 	"gopkg.in/yaml.v3"
 )
 
 type Service struct {
+	spbClient spb.Client
 }
 
-func NewService() *Service {
-	return &Service{}
+func NewService(spbClient spb.Client) *Service {
+	return &Service{
+		spbClient: spbClient,
+	}
 }
 
 func (s Service) ParseCategoriesTree(value string) (*UserCategoryTreeNode, error) {
 	return createUserCategoryTree(value)
 }
 
+// GenerateCategoriesText Builds a categories document with all the reasons from the portal classifier
+func (s Service) GenerateCategoriesText(ctx context.Context) ([]byte, error) {
+	cities, err := s.spbClient.GetReasons(ctx)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to get reasons")
+	}
+
+	return generateCategoriesText(cities)
+}
+
+// ValidateCategoriesTree Checks that every category of the tree refers to a reason from the portal classifier
+func (s Service) ValidateCategoriesTree(ctx context.Context, tree *UserCategoryTreeNode) (*ValidationReport, error) {
+	return validateCategoriesTree(tree, func(id int64) (*spb.ReasonResponse, error) {
+		return s.spbClient.GetReason(ctx, id)
+	})
+}
+
+func validateCategoriesTree(
+	tree *UserCategoryTreeNode, getReason func(id int64) (*spb.ReasonResponse, error),
+) (*ValidationReport, error) {
+	result := &ValidationReport{}
+	for _, leaf := range tree.Leaves() {
+		reason, err := getReason(leaf.Category.Id)
+		if err != nil {
+			if !errorx.IsOfType(err, spb.ErrReasonNotFound) {
+				return nil, errorx.EnhanceStackTrace(err, "failed to get reason: id=%v", leaf.Category.Id)
+			}
+			reason = nil
+		}
+
+		result.Categories = append(result.Categories, ValidatedCategory{
+			Node:   leaf,
+			Reason: reason,
+		})
+	}
+
+	return result, nil
+}
+
 func createUserCategoryTree(categoriesString string) (*UserCategoryTreeNode, error) {
 	var categoriesDocumentNode yaml.Node
 	err := yaml.Unmarshal([]byte(categoriesString), &categoriesDocumentNode)
@@ -95,6 +139,7 @@ func parseChildTreeNode(yamlNode *yaml.Node, name string, parent *UserCategoryTr
 			Category: &UserCategory{Id: id, Message: message},
 			Parent:   parent,
 			Children: nil,
+			Position: Position{Line: yamlNode.Content[1].Line, Column: yamlNode.Content[1].Column},
 		}, nil
 	}
 
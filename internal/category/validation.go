@@ -0,0 +1,48 @@
+package category
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/samber/lo"
+)
+
+type ValidatedCategory struct {
+	Node *UserCategoryTreeNode
+	// Reason is the official portal reason, nil when the reason is unknown or retired
+	Reason *spb.ReasonResponse
+}
+
+type ValidationReport struct {
+	Categories []ValidatedCategory
+}
+
+func (r *ValidationReport) Invalid() []ValidatedCategory {
+	return lo.Filter(r.Categories, func(item ValidatedCategory, _ int) bool {
+		return item.Reason == nil
+	})
+}
+
+func (r *ValidationReport) Valid() bool {
+	return len(r.Invalid()) == 0
+}
+
+func (r *ValidationReport) String() string {
+	lines := []string{
+		fmt.Sprintf("Проверено категорий: %v", len(r.Categories)),
+		fmt.Sprintf("Неизвестных или удалённых причин: %v", len(r.Invalid())),
+		"",
+	}
+	for _, item := range r.Categories {
+		if item.Reason == nil {
+			lines = append(lines, fmt.Sprintf("❌ %v %v: причина %v не найдена на портале",
+				item.Node.Position, item.Node.GetFullName(), item.Node.Category.Id))
+		} else {
+			lines = append(lines, fmt.Sprintf("✅ %v %v: %v",
+				item.Node.Position, item.Node.GetFullName(), item.Reason.Name))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,57 @@
+package category
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCategoriesTree(t *testing.T) {
+	bytes, err := os.ReadFile("testdata/combined.yaml")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tree, err := createUserCategoryTree(string(bytes))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	report, err := validateCategoriesTree(tree, func(id int64) (*spb.ReasonResponse, error) {
+		if id == 1 {
+			return &spb.ReasonResponse{Id: 1, Name: "Reason 1"}, nil
+		}
+		return nil, spb.ErrReasonNotFound.New("can't find reason: id=%v", id)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.False(t, report.Valid())
+	assert.Len(t, report.Invalid(), 1)
+	assert.Equal(t, `Проверено категорий: 2
+Неизвестных или удалённых причин: 1
+
+✅ 2:7 Category 1: Reason 1
+❌ 6:9 Group 1 / Category 2: причина 2 не найдена на портале`, report.String())
+}
+
+func TestValidateCategoriesTreePortalFailure(t *testing.T) {
+	bytes, err := os.ReadFile("testdata/single.yaml")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tree, err := createUserCategoryTree(string(bytes))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = validateCategoriesTree(tree, func(id int64) (*spb.ReasonResponse, error) {
+		return nil, errors.New("portal is down")
+	})
+	assert.Error(t, err)
+}
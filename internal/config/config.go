@@ -11,15 +11,37 @@ import (
 type Config struct {
 	TelegramApiToken       string        `env:"TELEGRAM_API_TOKEN,required"`
 	TelegramApiEndpoint    string        `env:"TELEGRAM_API_ENDPOINT"`
+	OurSpbApiEndpoint      string        `env:"OURSPB_API_ENDPOINT" envDefault:"https://gorod.gov.spb.ru"`
 	OurSpbClientId         string        `env:"OURSPB_CLIENT_ID,required"`
 	OurSpbSecret           string        `env:"OURSPB_SECRET,required"`
 	OurSpbClientTimeout    time.Duration `env:"OURSPB_CLIENT_TIMEOUT,required"`
-	FirebaseServiceAccount string        `env:"FIREBASE_SERVICE_ACCOUNT,required"`
+	OurSpbClassifierTtl    time.Duration `env:"OURSPB_CLASSIFIER_TTL" envDefault:"24h"`
+	StorageType            StorageType   `env:"STORAGE_TYPE" envDefault:"firebase"`
+	FirebaseServiceAccount string        `env:"FIREBASE_SERVICE_ACCOUNT"`
+	FirebaseProjectId      string        `env:"FIREBASE_PROJECT_ID" envDefault:"ourspbbot"`
+	FirestoreEmulatorHost  string        `env:"FIRESTORE_EMULATOR_HOST"`
+	BoltPath               string        `env:"BOLT_PATH" envDefault:"our-spb-bot.db"`
+	StateEncryptionKeys    []string      `env:"STATE_ENCRYPTION_KEYS"`
 	SenderEnabled          bool          `env:"SENDER_ENABLED"`
 	SenderSleepDuration    time.Duration `env:"SENDER_SLEEP_DURATION,required"`
+	SenderWorkers          int           `env:"SENDER_WORKERS" envDefault:"1"`
 	InactivityDuration     time.Duration `env:"INACTIVIRY_DURATION,required"`
+	QueueLeaseDuration     time.Duration `env:"QUEUE_LEASE_DURATION" envDefault:"10m"`
+	QueueReaperInterval    time.Duration `env:"QUEUE_REAPER_INTERVAL" envDefault:"1m"`
+	WatcherEnabled         bool          `env:"WATCHER_ENABLED"`
+	WatcherInterval        time.Duration `env:"WATCHER_INTERVAL" envDefault:"1h"`
+	ShutdownTimeout        time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	FailureDigestDelay     time.Duration `env:"FAILURE_DIGEST_DELAY" envDefault:"5m"`
+	MetricsAddress         string        `env:"METRICS_ADDRESS"`
 }
 
+type StorageType string
+
+const (
+	StorageTypeFirebase StorageType = "firebase"
+	StorageTypeBolt     StorageType = "bolt"
+)
+
 func NewConfig() (*Config, error) {
 	result := &Config{}
 	err := env.Parse(result)
@@ -27,6 +49,29 @@ func NewConfig() (*Config, error) {
 		return nil, errorx.EnhanceStackTrace(err, "failed to read config")
 	}
 
+	switch result.StorageType {
+	case StorageTypeFirebase:
+		if result.FirebaseServiceAccount == "" && result.FirestoreEmulatorHost == "" {
+			return nil, errorx.IllegalArgument.New(
+				"FIREBASE_SERVICE_ACCOUNT is required for firebase storage unless FIRESTORE_EMULATOR_HOST is set",
+			)
+		}
+	case StorageTypeBolt:
+		if result.BoltPath == "" {
+			return nil, errorx.IllegalArgument.New("BOLT_PATH is required for bolt storage")
+		}
+	default:
+		return nil, errorx.IllegalArgument.New("unsupported storage type: %v", result.StorageType)
+	}
+
+	if result.SenderWorkers < 1 {
+		return nil, errorx.IllegalArgument.New("SENDER_WORKERS must be positive: %v", result.SenderWorkers)
+	}
+
+	if result.FailureDigestDelay <= 0 {
+		return nil, errorx.IllegalArgument.New("FAILURE_DIGEST_DELAY must be positive: %v", result.FailureDigestDelay)
+	}
+
 	if result.TelegramApiEndpoint == "" {
 		result.TelegramApiEndpoint = tgbotapi.APIEndpoint
 	}
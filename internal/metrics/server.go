@@ -0,0 +1,62 @@
+// Package metrics Serves expvar metrics, such as the queue backlog, over HTTP
+package metrics
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"go.uber.org/zap"
+)
+
+// Server Exposes metrics at /debug/vars on METRICS_ADDRESS. It's disabled when the address is empty
+type Server struct {
+	logger  *zap.Logger
+	address string
+	server  *http.Server
+}
+
+func NewServer(logger *zap.Logger, conf *config.Config) *Server {
+	return &Server{
+		logger:  logger,
+		address: conf.MetricsAddress,
+	}
+}
+
+func (s *Server) Start(_ context.Context) error {
+	if s.address == "" {
+		s.logger.Info("metrics server is disabled")
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to listen metrics address: address=%v", s.address)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	s.server = &http.Server{Handler: mux}
+
+	s.logger.Info("starting metrics server", zap.String("address", listener.Addr().String()))
+	go func() {
+		err := s.server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("metrics server failed", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+
+	return s.server.Shutdown(ctx)
+}
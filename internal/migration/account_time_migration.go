@@ -1,6 +1,7 @@
 package migration
 
 import (
+	"context"
 	"time"
 
 	"github.com/joomcode/errorx"
@@ -21,31 +22,45 @@ func NewAccountTimeMigration(logger *zap.Logger, states state.States) Migration
 	}
 }
 
-func (m *AccountTimeMigration) Migrate() error {
+func (m *AccountTimeMigration) Id() string {
+	return "0001-account-time"
+}
+
+func (m *AccountTimeMigration) Migrate(ctx context.Context) error {
 	m.logger.Info("running account time migration")
 
-	allUserStates, err := m.states.GetAllStates()
+	allUserStates, err := m.states.GetAllStates(ctx)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to migrate account time")
 	}
 
 	for _, userState := range allUserStates {
-		migrated := false
-		for i := range userState.Accounts {
-			if userState.Accounts[i].RateLimitNextDayTime.Equal(time.Time{}) {
-				userState.Accounts[i].RateLimitNextDayTime = util.DefaultSendTime
-				migrated = true
-			}
+		if !needsAccountTimeMigration(userState) {
+			continue
 		}
 
-		if migrated {
-			err = m.states.SetState(userState)
-			if err != nil {
-				return errorx.EnhanceStackTrace(err, "failed to migrate account time")
+		_, err = m.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+			for i := range userState.Accounts {
+				if userState.Accounts[i].RateLimitNextDayTime.Equal(time.Time{}) {
+					userState.Accounts[i].RateLimitNextDayTime = util.DefaultSendTime
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to migrate account time")
 		}
 	}
 
 	m.logger.Info("account time migration completed")
 	return nil
 }
+
+func needsAccountTimeMigration(userState *state.UserState) bool {
+	for _, account := range userState.Accounts {
+		if account.RateLimitNextDayTime.Equal(time.Time{}) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package migration
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	bucket      = []byte(collection)
+	locksBucket = []byte(locksCollection)
+)
+
+// BoltJournal keeps applied migrations in an embedded database. The database file can be opened by a single process
+// only, but the lock is still kept, so that an interrupted run is visible the same way as in Firestore
+type BoltJournal struct {
+	db *bbolt.DB
+}
+
+func NewBoltJournal(db *bbolt.DB) (*BoltJournal, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(locksBucket)
+		return err
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to create migrations buckets")
+	}
+
+	return &BoltJournal{
+		db: db,
+	}, nil
+}
+
+func (j *BoltJournal) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	return j.db.Update(func(tx *bbolt.Tx) error {
+		locks := tx.Bucket(locksBucket)
+		data := locks.Get([]byte(lockId))
+		if data != nil {
+			var current lock
+			err := json.Unmarshal(data, &current)
+			if err != nil {
+				return errorx.EnhanceStackTrace(err, "failed to deserialize migrations lock")
+			}
+
+			if current.Owner != owner && current.ExpiresAt.After(time.Now()) {
+				return ErrLocked.New("migrations are locked: owner=%v, expiresAt=%v", current.Owner, current.ExpiresAt)
+			}
+		}
+
+		data, err := json.Marshal(&lock{Owner: owner, ExpiresAt: time.Now().Add(ttl)})
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to serialize migrations lock")
+		}
+
+		return locks.Put([]byte(lockId), data)
+	})
+}
+
+func (j *BoltJournal) Unlock(ctx context.Context, owner string) error {
+	return j.db.Update(func(tx *bbolt.Tx) error {
+		locks := tx.Bucket(locksBucket)
+		data := locks.Get([]byte(lockId))
+		if data == nil {
+			return nil
+		}
+
+		var current lock
+		err := json.Unmarshal(data, &current)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to deserialize migrations lock")
+		}
+
+		if current.Owner != owner {
+			return nil
+		}
+
+		return locks.Delete([]byte(lockId))
+	})
+}
+
+func (j *BoltJournal) Applied(ctx context.Context) (map[string]AppliedMigration, error) {
+	result := map[string]AppliedMigration{}
+	err := j.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(key, value []byte) error {
+			var applied AppliedMigration
+			err := json.Unmarshal(value, &applied)
+			if err != nil {
+				return errorx.EnhanceStackTrace(err, "failed to deserialize applied migration: id=%s", key)
+			}
+
+			result[applied.Id] = applied
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to read applied migrations")
+	}
+
+	return result, nil
+}
+
+func (j *BoltJournal) MarkApplied(ctx context.Context, applied AppliedMigration) error {
+	err := j.db.Update(func(tx *bbolt.Tx) error {
+		data, err := json.Marshal(&applied)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(bucket).Put([]byte(applied.Id), data)
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to store applied migration: id=%v", applied.Id)
+	}
+
+	return nil
+}
+
+func (j *BoltJournal) MarkRolledBack(ctx context.Context, id string) error {
+	err := j.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to delete applied migration: id=%v", id)
+	}
+
+	return nil
+}
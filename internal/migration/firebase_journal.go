@@ -0,0 +1,127 @@
+package migration
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joomcode/errorx"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	collection      = "migrations"
+	locksCollection = "locks"
+	lockId          = "migrations"
+)
+
+type FirebaseJournal struct {
+	fc *firestore.Client
+}
+
+func NewFirebaseJournal(storage *firestore.Client) *FirebaseJournal {
+	return &FirebaseJournal{
+		fc: storage,
+	}
+}
+
+func (j *FirebaseJournal) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	ref := j.fc.Collection(locksCollection).Doc(lockId)
+	err := j.fc.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		if err == nil {
+			var current lock
+			err = snapshot.DataTo(&current)
+			if err != nil {
+				return err
+			}
+
+			if current.Owner != owner && current.ExpiresAt.After(time.Now()) {
+				return ErrLocked.New("migrations are locked: owner=%v, expiresAt=%v", current.Owner, current.ExpiresAt)
+			}
+		}
+
+		return tx.Set(ref, &lock{Owner: owner, ExpiresAt: time.Now().Add(ttl)})
+	})
+	if err != nil {
+		if errorx.IsOfType(err, ErrLocked) {
+			return err
+		}
+
+		return errorx.EnhanceStackTrace(err, "failed to lock migrations")
+	}
+
+	return nil
+}
+
+func (j *FirebaseJournal) Unlock(ctx context.Context, owner string) error {
+	ref := j.fc.Collection(locksCollection).Doc(lockId)
+	err := j.fc.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var current lock
+		err = snapshot.DataTo(&current)
+		if err != nil {
+			return err
+		}
+
+		if current.Owner != owner {
+			return nil
+		}
+
+		return tx.Delete(ref)
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to unlock migrations")
+	}
+
+	return nil
+}
+
+func (j *FirebaseJournal) Applied(ctx context.Context) (map[string]AppliedMigration, error) {
+	snapshots, err := j.fc.Collection(collection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to read applied migrations")
+	}
+
+	result := map[string]AppliedMigration{}
+	for _, snapshot := range snapshots {
+		var applied AppliedMigration
+		err := snapshot.DataTo(&applied)
+		if err != nil {
+			return nil, errorx.EnhanceStackTrace(err, "failed to deserialize applied migration: id=%v", snapshot.Ref.ID)
+		}
+		result[applied.Id] = applied
+	}
+
+	return result, nil
+}
+
+func (j *FirebaseJournal) MarkApplied(ctx context.Context, applied AppliedMigration) error {
+	_, err := j.fc.Collection(collection).Doc(applied.Id).Set(ctx, &applied)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to store applied migration: id=%v", applied.Id)
+	}
+
+	return nil
+}
+
+func (j *FirebaseJournal) MarkRolledBack(ctx context.Context, id string) error {
+	_, err := j.fc.Collection(collection).Doc(id).Delete(ctx)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to delete applied migration: id=%v", id)
+	}
+
+	return nil
+}
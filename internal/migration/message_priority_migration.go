@@ -0,0 +1,64 @@
+package migration
+
+import (
+	"context"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"go.uber.org/zap"
+)
+
+// legacyPriorityIdPrefix was added to ids of priority messages, so that Firestore returned them first
+const legacyPriorityIdPrefix = "00_"
+
+// MessagePriorityMigration sets the priority field of queued messages from the legacy id prefix.
+// The ids are kept, since they are referenced by buttons in chats.
+// Every queued message gets the field, because Firestore doesn't match documents without it by priority
+type MessagePriorityMigration struct {
+	logger       *zap.Logger
+	messageQueue queue.MessageQueue
+}
+
+func NewMessagePriorityMigration(logger *zap.Logger, messageQueue queue.MessageQueue) Migration {
+	return &MessagePriorityMigration{
+		logger:       logger,
+		messageQueue: messageQueue,
+	}
+}
+
+func (m *MessagePriorityMigration) Id() string {
+	return "0003-message-priority"
+}
+
+func (m *MessagePriorityMigration) Migrate(ctx context.Context) error {
+	m.logger.Info("running message priority migration")
+
+	migratedCount := 0
+	// messages being sent are stored again by the sender, and sent messages aren't queued anymore
+	for _, status := range []queue.Status{queue.StatusCreated, queue.StatusFailed, queue.StatusAwaitingAuthorization} {
+		messages, err := m.messageQueue.FindMessages(ctx, status)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to migrate message priority")
+		}
+
+		for _, message := range messages {
+			_, err := m.messageQueue.EditMessage(ctx, message.Id, func(message *queue.Message) error {
+				message.Priority = strings.HasPrefix(message.Id, legacyPriorityIdPrefix)
+				return nil
+			})
+			if errorx.IsOfType(err, queue.ErrMessageNotEditable) {
+				// leased by a sender in the meantime
+				continue
+			}
+			if err != nil {
+				return errorx.EnhanceStackTrace(err, "failed to migrate message priority")
+			}
+
+			migratedCount++
+		}
+	}
+
+	m.logger.Info("message priority migration completed", zap.Int("messages", migratedCount))
+	return nil
+}
@@ -0,0 +1,55 @@
+package migration
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestMessagePriorityMigration(t *testing.T) {
+	ctx := context.Background()
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	messageQueue, err := queue.NewBoltQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: time.Minute}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range []*queue.Message{
+		{Id: "00_24-01-01_a", Status: queue.StatusCreated},
+		{Id: "24-01-01_b", Status: queue.StatusCreated},
+		{Id: "00_24-01-01_c", Status: queue.StatusFailed},
+		{Id: "00_24-01-01_d", Status: queue.StatusSent},
+	} {
+		if !assert.NoError(t, messageQueue.Add(ctx, message)) {
+			return
+		}
+	}
+
+	assert.NoError(t, NewMessagePriorityMigration(log.NewLogger(), messageQueue).Migrate(ctx))
+
+	for id, expected := range map[string]bool{
+		"00_24-01-01_a": true,
+		"24-01-01_b":    false,
+		"00_24-01-01_c": true,
+		"00_24-01-01_d": false,
+	} {
+		message, err := messageQueue.GetMessage(ctx, id)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, message.Priority, id)
+		}
+	}
+}
@@ -1,27 +1,246 @@
 package migration
 
-import "go.uber.org/zap"
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/lithammer/shortuuid/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// lockTtl limits how long a crashed instance keeps other instances from running migrations
+	lockTtl = 10 * time.Minute
+	// lockRetryInterval is how often an instance checks whether the lock is released
+	lockRetryInterval = 2 * time.Second
+)
 
 type Migrations struct {
 	logger     *zap.Logger
+	journal    Journal
 	migrations []Migration
+	owner      string
+	lockTtl    time.Duration
 }
 
-func NewMigrations(logger *zap.Logger, migrations []Migration) *Migrations {
+func NewMigrations(logger *zap.Logger, journal Journal, migrations []Migration) *Migrations {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Id() < sorted[j].Id()
+	})
+
 	return &Migrations{
 		logger:     logger,
-		migrations: migrations,
+		journal:    journal,
+		migrations: sorted,
+		owner:      shortuuid.New(),
+		lockTtl:    lockTtl,
 	}
 }
 
-func (m *Migrations) RunAll() error {
-	for _, migration := range m.migrations {
-		err := migration.Migrate()
+// RunAll Applies migrations that are not applied yet
+func (m *Migrations) RunAll(ctx context.Context) error {
+	return m.withLock(ctx, func(ctx context.Context) error {
+		applied, err := m.journal.Applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, exists := applied[migration.Id()]; exists {
+				continue
+			}
+
+			err := m.apply(ctx, migration)
+			if errorx.IsOfType(err, ErrPostponed) {
+				m.logger.Warn("migration is postponed", zap.String("id", migration.Id()), zap.Error(err))
+				continue
+			}
+			if err != nil {
+				m.logger.Error("failed to run migrations", zap.Error(err))
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Run Applies the migration even if it's applied already
+func (m *Migrations) Run(ctx context.Context, id string) error {
+	migration, err := m.find(id)
+	if err != nil {
+		return err
+	}
+
+	return m.withLock(ctx, func(ctx context.Context) error {
+		return m.apply(ctx, migration)
+	})
+}
+
+// Rollback Reverts the applied migration if it's reversible
+func (m *Migrations) Rollback(ctx context.Context, id string) error {
+	migration, err := m.find(id)
+	if err != nil {
+		return err
+	}
+
+	reversible, ok := migration.(ReversibleMigration)
+	if !ok {
+		return ErrRollbackForbidden.New("migration can't be rolled back: id=%v", id)
+	}
+
+	return m.withLock(ctx, func(ctx context.Context) error {
+		applied, err := m.journal.Applied(ctx)
 		if err != nil {
-			m.logger.Error("failed to run migrations", zap.Error(err))
 			return err
 		}
+
+		if _, exists := applied[id]; !exists {
+			return ErrNotApplied.New("migration is not applied: id=%v", id)
+		}
+
+		m.logger.Info("rolling back migration", zap.String("id", id))
+		err = reversible.Rollback(ctx)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to roll back migration: id=%v", id)
+		}
+
+		err = m.checkLock(ctx)
+		if err != nil {
+			return err
+		}
+
+		return m.journal.MarkRolledBack(ctx, id)
+	})
+}
+
+// Status Lists registered migrations in the order they are applied
+func (m *Migrations) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.journal.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Status
+	for _, migration := range m.migrations {
+		appliedMigration, exists := applied[migration.Id()]
+		_, reversible := migration.(ReversibleMigration)
+		result = append(result, Status{
+			Id:         migration.Id(),
+			Applied:    exists,
+			AppliedAt:  appliedMigration.AppliedAt,
+			Reversible: reversible,
+		})
+	}
+
+	return result, nil
+}
+
+func (m *Migrations) apply(ctx context.Context, migration Migration) error {
+	m.logger.Info("applying migration", zap.String("id", migration.Id()))
+	startedAt := time.Now()
+	err := migration.Migrate(ctx)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to apply migration: id=%v", migration.Id())
+	}
+
+	err = m.checkLock(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.journal.MarkApplied(ctx, AppliedMigration{
+		Id:        migration.Id(),
+		AppliedAt: time.Now(),
+		Duration:  time.Since(startedAt),
+	})
+}
+
+func (m *Migrations) find(id string) (Migration, error) {
+	for _, migration := range m.migrations {
+		if migration.Id() == id {
+			return migration, nil
+		}
+	}
+
+	return nil, ErrUnknownMigration.New("migration not found: id=%v", id)
+}
+
+// withLock Waits for other instances to complete their migrations and runs the action holding the lock.
+// The lock is refreshed while the action runs, and the action is cancelled once the lock is lost
+func (m *Migrations) withLock(ctx context.Context, action func(ctx context.Context) error) error {
+	waitUntil := time.Now().Add(m.lockTtl)
+	for {
+		err := m.journal.Lock(ctx, m.owner, m.lockTtl)
+		if err == nil {
+			break
+		}
+
+		if !errorx.IsOfType(err, ErrLocked) || time.Now().After(waitUntil) {
+			return err
+		}
+
+		m.logger.Info("migrations are locked by another instance, waiting")
+		select {
+		case <-ctx.Done():
+			return errorx.EnhanceStackTrace(ctx.Err(), "stopped waiting for migrations lock")
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	defer func() {
+		// the lock is released even when the migration is cancelled
+		err := m.journal.Unlock(context.WithoutCancel(ctx), m.owner)
+		if err != nil {
+			m.logger.Error("failed to release migrations lock", zap.Error(err))
+		}
+	}()
+
+	actionCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go m.refreshLock(actionCtx, cancel)
+
+	err := action(actionCtx)
+	if cause := context.Cause(actionCtx); errorx.IsOfType(cause, ErrLockLost) {
+		return cause
+	}
+
+	return err
+}
+
+// refreshLock Prolongs the lock until the context is done, so that a long migration keeps other instances waiting
+func (m *Migrations) refreshLock(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(m.lockTtl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := m.journal.Lock(ctx, m.owner, m.lockTtl)
+		if errorx.IsOfType(err, ErrLocked) {
+			cancel(ErrLockLost.Wrap(err, "migrations lock is taken by another instance"))
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			// the lock is still valid for a while, so it's refreshed on the next tick
+			m.logger.Warn("failed to refresh migrations lock", zap.Error(err))
+		}
+	}
+}
+
+// checkLock Makes sure the lock is still held, so that a migration run by another instance meanwhile isn't recorded twice
+func (m *Migrations) checkLock(ctx context.Context) error {
+	err := m.journal.Lock(ctx, m.owner, m.lockTtl)
+	if errorx.IsOfType(err, ErrLocked) {
+		return ErrLockLost.Wrap(err, "migrations lock is taken by another instance")
 	}
 
-	return nil
+	return err
 }
@@ -0,0 +1,173 @@
+package migration
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+type testMigration struct {
+	id   string
+	runs *[]string
+}
+
+func (m *testMigration) Id() string {
+	return m.id
+}
+
+func (m *testMigration) Migrate(ctx context.Context) error {
+	*m.runs = append(*m.runs, m.id)
+	return nil
+}
+
+type testReversibleMigration struct {
+	testMigration
+}
+
+func (m *testReversibleMigration) Rollback(ctx context.Context) error {
+	*m.runs = append(*m.runs, "-"+m.id)
+	return nil
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	journal := newTestJournal(t)
+	var runs []string
+	migrations := NewMigrations(log.NewLogger(), journal, []Migration{
+		&testReversibleMigration{testMigration{id: "0002", runs: &runs}},
+		&testMigration{id: "0001", runs: &runs},
+	})
+
+	assert.NoError(t, migrations.RunAll(ctx))
+	assert.NoError(t, migrations.RunAll(ctx))
+	assert.Equal(t, []string{"0001", "0002"}, runs, "migrations must run once in the order of ids")
+
+	assert.True(t, errorx.IsOfType(migrations.Rollback(ctx, "0001"), ErrRollbackForbidden))
+	assert.True(t, errorx.IsOfType(migrations.Rollback(ctx, "0003"), ErrUnknownMigration))
+	assert.NoError(t, migrations.Rollback(ctx, "0002"))
+	assert.True(t, errorx.IsOfType(migrations.Rollback(ctx, "0002"), ErrNotApplied))
+
+	statuses, err := migrations.Status(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Len(t, statuses, 2)
+	assert.True(t, statuses[0].Applied)
+	assert.False(t, statuses[0].Reversible)
+	assert.False(t, statuses[1].Applied)
+	assert.True(t, statuses[1].Reversible)
+
+	assert.NoError(t, migrations.Run(ctx, "0001"))
+	assert.NoError(t, migrations.RunAll(ctx))
+	assert.Equal(t, []string{"0001", "0002", "-0002", "0001", "0002"}, runs)
+}
+
+func TestJournalLock(t *testing.T) {
+	ctx := context.Background()
+	journal := newTestJournal(t)
+
+	assert.NoError(t, journal.Lock(ctx, "first", time.Minute))
+	assert.NoError(t, journal.Lock(ctx, "first", time.Minute), "the owner can prolong the lock")
+	assert.True(t, errorx.IsOfType(journal.Lock(ctx, "second", time.Minute), ErrLocked))
+	assert.NoError(t, journal.Unlock(ctx, "second"), "only the owner releases the lock")
+	assert.True(t, errorx.IsOfType(journal.Lock(ctx, "second", time.Minute), ErrLocked))
+	assert.NoError(t, journal.Unlock(ctx, "first"))
+	assert.NoError(t, journal.Lock(ctx, "second", -time.Second))
+	assert.NoError(t, journal.Lock(ctx, "first", time.Minute), "an expired lock can be taken")
+}
+
+type funcMigration struct {
+	id      string
+	migrate func(ctx context.Context) error
+}
+
+func (m *funcMigration) Id() string {
+	return m.id
+}
+
+func (m *funcMigration) Migrate(ctx context.Context) error {
+	return m.migrate(ctx)
+}
+
+func TestStateEncryptionMigrationWaitsForKeys(t *testing.T) {
+	ctx := context.Background()
+	cipher, err := secret.ParseKeys(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := NewMigrations(log.NewLogger(), newTestJournal(t), []Migration{
+		NewStateEncryptionMigration(log.NewLogger(), nil, cipher),
+	})
+
+	assert.NoError(t, migrations.RunAll(ctx))
+	assert.True(t, errorx.IsOfType(migrations.Run(ctx, "0002-state-encryption"), ErrPostponed))
+
+	statuses, err := migrations.Status(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.False(t, statuses[0].Applied, "the migration must stay pending until the keys are configured")
+}
+
+func TestMigrationsRefreshLock(t *testing.T) {
+	ctx := context.Background()
+	journal := newTestJournal(t)
+	migrations := NewMigrations(log.NewLogger(), journal, []Migration{
+		&funcMigration{id: "0001", migrate: func(ctx context.Context) error {
+			time.Sleep(100 * time.Millisecond)
+			assert.True(t, errorx.IsOfType(journal.Lock(ctx, "other", time.Minute), ErrLocked),
+				"a migration that outlives the lock ttl must keep other instances waiting")
+			return nil
+		}},
+	})
+	migrations.lockTtl = 60 * time.Millisecond
+
+	assert.NoError(t, migrations.RunAll(ctx))
+}
+
+func TestMigrationsFailWhenLockIsLost(t *testing.T) {
+	ctx := context.Background()
+	journal := newTestJournal(t)
+	var migrations *Migrations
+	migrations = NewMigrations(log.NewLogger(), journal, []Migration{
+		&funcMigration{id: "0001", migrate: func(ctx context.Context) error {
+			// the lock expires and another instance takes it
+			assert.NoError(t, journal.Unlock(ctx, migrations.owner))
+			assert.NoError(t, journal.Lock(ctx, "other", time.Minute))
+			return nil
+		}},
+	})
+
+	assert.True(t, errorx.IsOfType(migrations.RunAll(ctx), ErrLockLost))
+	statuses, err := migrations.Status(ctx)
+	if assert.NoError(t, err) && assert.Len(t, statuses, 1) {
+		assert.False(t, statuses[0].Applied)
+	}
+}
+
+func newTestJournal(t *testing.T) *BoltJournal {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	journal, err := NewBoltJournal(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return journal
+}
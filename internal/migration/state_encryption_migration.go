@@ -0,0 +1,63 @@
+package migration
+
+import (
+	"context"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"go.uber.org/zap"
+)
+
+// StateEncryptionMigration encrypts account secrets stored before encryption was introduced
+// and re-encrypts secrets encrypted with a rotated key. It stays pending until encryption keys are configured.
+// After a key rotation it has to be run again explicitly
+type StateEncryptionMigration struct {
+	logger *zap.Logger
+	states state.States
+	cipher *secret.Cipher
+}
+
+func NewStateEncryptionMigration(logger *zap.Logger, states state.States, cipher *secret.Cipher) Migration {
+	return &StateEncryptionMigration{
+		logger: logger,
+		states: states,
+		cipher: cipher,
+	}
+}
+
+func (m *StateEncryptionMigration) Id() string {
+	return "0002-state-encryption"
+}
+
+func (m *StateEncryptionMigration) Migrate(ctx context.Context) error {
+	if !m.cipher.Enabled() {
+		return ErrPostponed.New("state encryption keys are not configured")
+	}
+
+	m.logger.Info("running state encryption migration")
+
+	allUserStates, err := m.states.GetAllStates(ctx)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to migrate state encryption")
+	}
+
+	migratedCount := 0
+	for _, userState := range allUserStates {
+		if !userState.NeedsReencryption() {
+			continue
+		}
+
+		// the state is encrypted with the primary key when stored
+		_, err = m.states.Update(ctx, userState.UserId, func(userState *state.UserState) error {
+			return nil
+		})
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to migrate state encryption")
+		}
+		migratedCount++
+	}
+
+	m.logger.Info("state encryption migration completed", zap.Int("migratedCount", migratedCount))
+	return nil
+}
@@ -1,5 +1,62 @@
 package migration
 
+import (
+	"context"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+var (
+	Errors               = errorx.NewNamespace("Migration")
+	ErrLocked            = Errors.NewType("Locked")
+	ErrLockLost          = Errors.NewType("LockLost")
+	ErrUnknownMigration  = Errors.NewType("UnknownMigration")
+	ErrNotApplied        = Errors.NewType("NotApplied")
+	ErrRollbackForbidden = Errors.NewType("RollbackForbidden")
+	// ErrPostponed is returned by a migration that can't be applied yet, so it stays pending until the next run
+	ErrPostponed = Errors.NewType("Postponed")
+)
+
 type Migration interface {
-	Migrate() error
+	// Id Identifies the migration in the journal. Migrations are applied in the order of their ids
+	Id() string
+	Migrate(ctx context.Context) error
+}
+
+// ReversibleMigration is a migration that can be rolled back
+type ReversibleMigration interface {
+	Migration
+	Rollback(ctx context.Context) error
+}
+
+// Journal keeps track of applied migrations and prevents several instances from running them at the same time
+type Journal interface {
+	// Lock Takes the lock for the owner until ttl passes. Fails with ErrLocked when another owner holds the lock
+	Lock(ctx context.Context, owner string, ttl time.Duration) error
+	// Unlock Releases the lock if it's still held by the owner
+	Unlock(ctx context.Context, owner string) error
+	// Applied Reads all applied migrations by their ids
+	Applied(ctx context.Context) (map[string]AppliedMigration, error)
+	MarkApplied(ctx context.Context, applied AppliedMigration) error
+	MarkRolledBack(ctx context.Context, id string) error
+}
+
+type AppliedMigration struct {
+	Id        string        `firestore:"id"`
+	AppliedAt time.Time     `firestore:"appliedAt"`
+	Duration  time.Duration `firestore:"duration"`
+}
+
+// Status describes a registered migration and whether it's applied
+type Status struct {
+	Id         string
+	Applied    bool
+	AppliedAt  time.Time
+	Reversible bool
+}
+
+type lock struct {
+	Owner     string    `firestore:"owner"`
+	ExpiresAt time.Time `firestore:"expiresAt"`
 }
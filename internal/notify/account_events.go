@@ -0,0 +1,185 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
+	"go.uber.org/zap"
+)
+
+// availabilityCheckInterval limits how late a user learns that an account is available again
+const availabilityCheckInterval = time.Minute
+
+// AccountEvents notifies users about the accounts that stopped sending messages and about the accounts
+// that can send them again. The accounts awaited to become available are kept in memory, so they are not
+// announced after a restart
+type AccountEvents struct {
+	logger                   *zap.Logger
+	states                   state.States
+	service                  *service.Service
+	settingsAccountsCallback *callback.SettingsAccountsCallback
+	mutex                    sync.Mutex
+	awaited                  map[accountKey]time.Time
+	worker                   *util.Worker
+}
+
+type accountKey struct {
+	userId int64
+	login  string
+}
+
+func NewAccountEvents(
+	logger *zap.Logger, states state.States, service *service.Service,
+	settingsAccountsCallback *callback.SettingsAccountsCallback,
+) *AccountEvents {
+	return &AccountEvents{
+		logger:                   logger,
+		states:                   states,
+		service:                  service,
+		settingsAccountsCallback: settingsAccountsCallback,
+		awaited:                  map[accountKey]time.Time{},
+	}
+}
+
+func (e *AccountEvents) Start(_ context.Context) error {
+	e.worker = util.StartWorker(func(ctx context.Context) time.Duration {
+		e.notifyAvailable(ctx, time.Now())
+		return availabilityCheckInterval
+	})
+	return nil
+}
+
+func (e *AccountEvents) Stop(ctx context.Context) error {
+	return e.worker.Stop(ctx)
+}
+
+// AccountDisabled Offers to log in again with the account that failed to authorize
+func (e *AccountEvents) AccountDisabled(userId int64, login string) {
+	e.forget(accountKey{userId: userId, login: login})
+	e.send(userId, fmt.Sprintf(`Аккаунт %v выключен: не удалось авторизоваться на портале.
+Возможно, пароль был изменён.
+
+Обращения не будут отправляться с этого аккаунта, пока вы не войдёте снова.`, login),
+		e.settingsAccountsCallback.CreateReloginMarkup(login),
+	)
+}
+
+// AccountRateLimited Tells that the portal doesn't accept messages from the account until the given time
+func (e *AccountEvents) AccountRateLimited(userId int64, login string, until time.Time) {
+	if !e.await(accountKey{userId: userId, login: login}, until) {
+		return
+	}
+
+	e.send(userId, fmt.Sprintf(`Портал ограничил отправку обращений с аккаунта %v.
+Отправка продолжится после %v.`, login, callback.FormatSendAt(until)),
+		e.settingsAccountsCallback.CreateAccountMarkup(login),
+	)
+}
+
+// AccountQuotaExhausted Tells that the account has sent all the messages the portal accepts in a day
+func (e *AccountEvents) AccountQuotaExhausted(userId int64, login string, until time.Time) {
+	if !e.await(accountKey{userId: userId, login: login}, until) {
+		return
+	}
+
+	e.send(userId, fmt.Sprintf(`Аккаунт %v отправил %v обращений за сегодня.
+Отправка продолжится после %v.`, login, state.AccountDailyQuota, callback.FormatSendAt(until)),
+		e.settingsAccountsCallback.CreateAccountMarkup(login),
+	)
+}
+
+// await Remembers when the account becomes available. Returns false when the account is already awaited
+// until that time or later, so that the user has been told about it already
+func (e *AccountEvents) await(key accountKey, until time.Time) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if awaitedUntil, exists := e.awaited[key]; exists && !until.After(awaitedUntil) {
+		return false
+	}
+
+	e.awaited[key] = until
+	return true
+}
+
+func (e *AccountEvents) forget(key accountKey) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	delete(e.awaited, key)
+}
+
+// takeDue Removes the accounts awaited to become available by now
+func (e *AccountEvents) takeDue(now time.Time) []accountKey {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var result []accountKey
+	for key, until := range e.awaited {
+		if !until.After(now) {
+			result = append(result, key)
+			delete(e.awaited, key)
+		}
+	}
+	return result
+}
+
+// notifyAvailable Tells about the accounts that can send messages again.
+// An account that has been disabled or deleted meanwhile is not announced
+func (e *AccountEvents) notifyAvailable(ctx context.Context, now time.Time) {
+	for _, key := range e.takeDue(now) {
+		account, err := e.findAccount(ctx, key)
+		if err != nil {
+			e.logger.Warn(
+				"failed to check account availability",
+				zap.Int64("userId", key.userId),
+				zap.String("login", key.login),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		if account == nil || account.State != state.AccountStateEnabled {
+			continue
+		}
+
+		if availableFrom := account.AvailableFrom(now); availableFrom.After(now) {
+			e.await(key, availableFrom)
+			continue
+		}
+
+		e.send(key.userId, fmt.Sprintf("Аккаунт %v снова может отправлять обращения.", key.login),
+			callback.CreateOpenQueueMarkup(),
+		)
+	}
+}
+
+func (e *AccountEvents) findAccount(ctx context.Context, key accountKey) (*state.Account, error) {
+	userState, err := e.states.GetState(ctx, key.userId)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to get user state")
+	}
+
+	return userState.FindAccount(key.login), nil
+}
+
+func (e *AccountEvents) send(userId int64, text string, markup tgbotapi.InlineKeyboardMarkup) {
+	_, err := e.service.SendMessageCustom(&tgbotapi.Chat{ID: userId}, text, func(reply *tgbotapi.MessageConfig) {
+		reply.ReplyMarkup = markup
+	})
+	if err != nil {
+		e.logger.Warn(
+			"failed to send account notification",
+			zap.Int64("userId", userId),
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountEventsTakeDueAccounts(t *testing.T) {
+	events := &AccountEvents{awaited: map[accountKey]time.Time{}}
+	now := time.Now()
+	first := accountKey{userId: 1, login: "first"}
+	second := accountKey{userId: 1, login: "second"}
+	events.await(first, now.Add(time.Hour))
+	events.await(second, now.Add(2*time.Hour))
+	events.await(first, now.Add(3*time.Hour))
+
+	assert.Empty(t, events.takeDue(now.Add(time.Hour)))
+	assert.Equal(t, []accountKey{second}, events.takeDue(now.Add(2*time.Hour)))
+
+	events.forget(first)
+	assert.Empty(t, events.takeDue(now.Add(3*time.Hour)))
+	assert.Empty(t, events.awaited)
+}
+
+func TestAccountEventsAwaitOnce(t *testing.T) {
+	events := &AccountEvents{awaited: map[accountKey]time.Time{}}
+	now := time.Now()
+	key := accountKey{userId: 1, login: "login"}
+
+	assert.True(t, events.await(key, now.Add(time.Hour)))
+	assert.False(t, events.await(key, now.Add(time.Hour)))
+	assert.False(t, events.await(key, now.Add(time.Minute)))
+	assert.True(t, events.await(key, now.Add(2*time.Hour)))
+	assert.Equal(t, now.Add(2*time.Hour), events.awaited[key])
+}
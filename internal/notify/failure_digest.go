@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/callback"
+	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+// FailureDigest collects the messages that failed to be sent and notifies each user once per FAILURE_DIGEST_DELAY,
+// so that a series of failures results in a single notification
+type FailureDigest struct {
+	logger                *zap.Logger
+	service               *service.Service
+	failedMessageCallback *callback.FailedMessageCallback
+	delay                 time.Duration
+	mutex                 sync.Mutex
+	pending               map[int64]*pendingDigest
+	worker                *util.Worker
+}
+
+type pendingDigest struct {
+	// since is the time of the first failure in the digest
+	since    time.Time
+	messages []*queue.Message
+}
+
+func NewFailureDigest(
+	logger *zap.Logger, conf *config.Config, service *service.Service, failedMessageCallback *callback.FailedMessageCallback,
+) *FailureDigest {
+	return &FailureDigest{
+		logger:                logger,
+		service:               service,
+		failedMessageCallback: failedMessageCallback,
+		delay:                 conf.FailureDigestDelay,
+		pending:               map[int64]*pendingDigest{},
+	}
+}
+
+func (d *FailureDigest) Start(_ context.Context) error {
+	d.worker = util.StartWorker(func(ctx context.Context) time.Duration {
+		return d.sendDigests(ctx, time.Now())
+	})
+	return nil
+}
+
+// Stop Sends the collected digests right away, so that they are not lost on shutdown
+func (d *FailureDigest) Stop(ctx context.Context) error {
+	err := d.worker.Stop(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.sendDigests(ctx, time.Now().Add(d.delay))
+	return nil
+}
+
+// MessageFailed Adds the message to the digest of its user. A message that failed again replaces the previous failure
+func (d *FailureDigest) MessageFailed(message *queue.Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	digest, exists := d.pending[message.UserId]
+	if !exists {
+		digest = &pendingDigest{since: time.Now()}
+		d.pending[message.UserId] = digest
+	}
+
+	digest.messages = lo.Reject(digest.messages, func(item *queue.Message, _ int) bool {
+		return item.Id == message.Id
+	})
+	digest.messages = append(digest.messages, message)
+}
+
+// sendDigests Sends the digests that are due and returns how long to wait for the next one
+func (d *FailureDigest) sendDigests(ctx context.Context, now time.Time) time.Duration {
+	due, wait := d.takeDue(now)
+	for userId, messages := range due {
+		err := d.send(ctx, userId, messages)
+		if err != nil {
+			d.logger.Warn(
+				"failed to send failure digest",
+				zap.Int64("userId", userId),
+				zap.Int("messages", len(messages)),
+				zap.Error(err),
+			)
+		}
+	}
+
+	return wait
+}
+
+// takeDue Removes the digests collected for the delay by now
+func (d *FailureDigest) takeDue(now time.Time) (map[int64][]*queue.Message, time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	result := map[int64][]*queue.Message{}
+	wait := d.delay
+	for userId, digest := range d.pending {
+		dueIn := digest.since.Add(d.delay).Sub(now)
+		if dueIn <= 0 {
+			result[userId] = digest.messages
+			delete(d.pending, userId)
+		} else {
+			wait = min(wait, dueIn)
+		}
+	}
+
+	return result, wait
+}
+
+func (d *FailureDigest) send(ctx context.Context, userId int64, messages []*queue.Message) error {
+	text, markup, err := d.failedMessageCallback.CreateDigest(ctx, userId, messages)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to create failure digest")
+	}
+
+	_, err = d.service.SendMessageCustom(&tgbotapi.Chat{ID: userId}, text, func(reply *tgbotapi.MessageConfig) {
+		reply.ReplyMarkup = markup
+	})
+	return err
+}
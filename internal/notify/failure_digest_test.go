@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureDigestBatchesFailuresByUser(t *testing.T) {
+	digest := &FailureDigest{delay: time.Minute, pending: map[int64]*pendingDigest{}}
+	digest.MessageFailed(&queue.Message{Id: "a", UserId: 1})
+	digest.MessageFailed(&queue.Message{Id: "b", UserId: 1})
+	digest.MessageFailed(&queue.Message{Id: "a", UserId: 1, Tries: queue.MaxTries})
+	digest.MessageFailed(&queue.Message{Id: "c", UserId: 2})
+
+	now := digest.pending[1].since
+	digest.pending[2].since = now.Add(30 * time.Second)
+
+	due, wait := digest.takeDue(now)
+	assert.Empty(t, due)
+	assert.Equal(t, time.Minute, wait)
+
+	due, wait = digest.takeDue(now.Add(time.Minute))
+	if assert.Len(t, due, 1) && assert.Len(t, due[1], 2) {
+		assert.Equal(t, "b", due[1][0].Id)
+		assert.Equal(t, "a", due[1][1].Id)
+		assert.Equal(t, queue.MaxTries, due[1][1].Tries)
+	}
+	assert.Equal(t, 30*time.Second, wait)
+
+	due, wait = digest.takeDue(now.Add(2 * time.Minute))
+	assert.Len(t, due[2], 1)
+	assert.Equal(t, time.Minute, wait)
+	assert.Empty(t, digest.pending)
+}
@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/samber/lo"
+)
+
+var (
+	ErrPinnedAccountRateLimited = Errors.NewType("PinnedAccountRateLimited")
+)
+
+// AccountStrategy chooses an account to send a message with
+type AccountStrategy interface {
+	// Choose Picks one of the available accounts to send a message of the given category
+	Choose(userState *state.UserState, accounts []*state.Account, categoryId int64) (*state.Account, error)
+}
+
+func NewAccountStrategy(strategy state.AccountStrategy) AccountStrategy {
+	switch strategy {
+	case state.AccountStrategyLeastUsedToday:
+		return &leastUsedTodayStrategy{}
+	case state.AccountStrategyPinned:
+		return &pinnedStrategy{fallback: &roundRobinStrategy{}}
+	default:
+		return &roundRobinStrategy{}
+	}
+}
+
+// AvailableAccounts Returns accounts that are enabled, not rate limited and have not exhausted the daily quota.
+// Some of them may need to be reauthorized before use
+func AvailableAccounts(userState *state.UserState, now time.Time) []*state.Account {
+	var result []*state.Account
+	for i, account := range userState.Accounts {
+		if account.State != state.AccountStateEnabled {
+			continue
+		}
+
+		if account.AvailableFrom(now).After(now) {
+			continue
+		}
+
+		result = append(result, &userState.Accounts[i])
+	}
+	return result
+}
+
+// roundRobinStrategy takes the account that has not sent anything for the longest time
+type roundRobinStrategy struct {
+}
+
+func (s *roundRobinStrategy) Choose(_ *state.UserState, accounts []*state.Account, _ int64) (*state.Account, error) {
+	if len(accounts) == 0 {
+		return nil, ErrAllAccountsRateLimited.New("all accounts are rate limited")
+	}
+
+	return lo.MinBy(accounts, func(a *state.Account, b *state.Account) bool {
+		return a.LastSentAt.Before(b.LastSentAt)
+	}), nil
+}
+
+// leastUsedTodayStrategy takes the account that has sent the least messages today
+type leastUsedTodayStrategy struct {
+}
+
+func (s *leastUsedTodayStrategy) Choose(_ *state.UserState, accounts []*state.Account, _ int64) (*state.Account, error) {
+	if len(accounts) == 0 {
+		return nil, ErrAllAccountsRateLimited.New("all accounts are rate limited")
+	}
+
+	now := time.Now()
+	return lo.MinBy(accounts, func(a *state.Account, b *state.Account) bool {
+		if a.UsedToday(now) != b.UsedToday(now) {
+			return a.UsedToday(now) < b.UsedToday(now)
+		}
+		return a.LastSentAt.Before(b.LastSentAt)
+	}), nil
+}
+
+// pinnedStrategy sends a category with the account it is pinned to.
+// Categories that are not pinned or pinned to a disabled account are sent with the fallback strategy
+type pinnedStrategy struct {
+	fallback AccountStrategy
+}
+
+func (s *pinnedStrategy) Choose(
+	userState *state.UserState, accounts []*state.Account, categoryId int64,
+) (*state.Account, error) {
+	for i, account := range userState.Accounts {
+		if account.State != state.AccountStateEnabled || !account.IsPinned(categoryId) {
+			continue
+		}
+
+		pinnedAccount := &userState.Accounts[i]
+		if lo.Contains(accounts, pinnedAccount) {
+			return pinnedAccount, nil
+		}
+
+		if pinnedAccount.AvailableFrom(time.Now()).After(time.Now()) {
+			return nil, ErrPinnedAccountRateLimited.New("pinned account is rate limited: login=%v", account.Login)
+		}
+	}
+
+	return s.fallback.Choose(userState, accounts, categoryId)
+}
@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountStrategyChoose(t *testing.T) {
+	now := time.Now()
+	dayStart := (&state.Account{}).DayStart(now)
+	tests := []struct {
+		name       string
+		strategy   state.AccountStrategy
+		accounts   []state.Account
+		categoryId int64
+		expected   string
+		err        *errorx.Type
+	}{
+		{
+			name:     "round robin takes the longest idle account",
+			strategy: state.AccountStrategyRoundRobin,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled, LastSentAt: now.Add(-time.Minute)},
+				{Login: "b", State: state.AccountStateEnabled, LastSentAt: now.Add(-time.Hour)},
+			},
+			expected: "b",
+		},
+		{
+			name:     "round robin skips rate limited accounts",
+			strategy: state.AccountStrategyRoundRobin,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled, LastSentAt: now.Add(-time.Minute)},
+				{Login: "b", State: state.AccountStateEnabled, RateLimitedUntil: now.Add(time.Hour)},
+			},
+			expected: "a",
+		},
+		{
+			name:     "round robin skips accounts with exhausted quota",
+			strategy: state.AccountStrategyRoundRobin,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled, SentToday: state.AccountDailyQuota, SentTodayDayStart: dayStart},
+				{Login: "b", State: state.AccountStateEnabled, LastSentAt: now.Add(-time.Minute)},
+			},
+			expected: "b",
+		},
+		{
+			name:     "least used today",
+			strategy: state.AccountStrategyLeastUsedToday,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled, SentToday: 3, SentTodayDayStart: dayStart},
+				{Login: "b", State: state.AccountStateEnabled, SentToday: 1, SentTodayDayStart: dayStart},
+				{Login: "c", State: state.AccountStateEnabled, SentToday: 2, SentTodayDayStart: dayStart},
+			},
+			expected: "b",
+		},
+		{
+			name:     "least used today ignores previous days",
+			strategy: state.AccountStrategyLeastUsedToday,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled, SentToday: 1, SentTodayDayStart: dayStart},
+				{Login: "b", State: state.AccountStateEnabled, SentToday: 9, SentTodayDayStart: dayStart.AddDate(0, 0, -1)},
+			},
+			expected: "b",
+		},
+		{
+			name:     "pinned category",
+			strategy: state.AccountStrategyPinned,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled, LastSentAt: now.Add(-time.Hour)},
+				{Login: "b", State: state.AccountStateEnabled, PinnedCategories: []int64{42}},
+			},
+			categoryId: 42,
+			expected:   "b",
+		},
+		{
+			name:     "not pinned category falls back to round robin",
+			strategy: state.AccountStrategyPinned,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled, LastSentAt: now.Add(-time.Hour)},
+				{Login: "b", State: state.AccountStateEnabled, PinnedCategories: []int64{42}},
+			},
+			categoryId: 1,
+			expected:   "b",
+		},
+		{
+			name:     "pinned account is rate limited",
+			strategy: state.AccountStrategyPinned,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled},
+				{Login: "b", State: state.AccountStateEnabled, PinnedCategories: []int64{42}, RateLimitedUntil: now.Add(time.Hour)},
+			},
+			categoryId: 42,
+			err:        ErrPinnedAccountRateLimited,
+		},
+		{
+			name:     "pinned account is disabled",
+			strategy: state.AccountStrategyPinned,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateEnabled},
+				{Login: "b", State: state.AccountStateDisabled, PinnedCategories: []int64{42}},
+			},
+			categoryId: 42,
+			expected:   "a",
+		},
+		{
+			name:     "no available accounts",
+			strategy: state.AccountStrategyRoundRobin,
+			accounts: []state.Account{
+				{Login: "a", State: state.AccountStateDisabled},
+			},
+			err: ErrAllAccountsRateLimited,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userState := &state.UserState{Accounts: tt.accounts}
+			actual, err := NewAccountStrategy(tt.strategy).
+				Choose(userState, AvailableAccounts(userState, now), tt.categoryId)
+			if tt.err != nil {
+				assert.True(t, errorx.IsOfType(err, tt.err))
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.expected, actual.Login)
+			}
+		})
+	}
+}
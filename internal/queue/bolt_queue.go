@@ -0,0 +1,467 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/samber/lo"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var bucket = []byte(collection)
+
+// BoltQueue Keeps messages in an embedded single-file database. Each message is stored as JSON under its id.
+// Read-write transactions are serialized by the database, so leases can't be taken twice
+type BoltQueue struct {
+	logger        *zap.Logger
+	db            *bbolt.DB
+	leaseDuration time.Duration
+}
+
+func NewBoltQueue(logger *zap.Logger, conf *config.Config, db *bbolt.DB) (*BoltQueue, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to create messages bucket")
+	}
+
+	return &BoltQueue{
+		logger:        logger,
+		db:            db,
+		leaseDuration: conf.QueueLeaseDuration,
+	}, nil
+}
+
+func (q *BoltQueue) Add(ctx context.Context, message *Message) error {
+	debugMessage(q.logger, message, "adding message to queue")
+
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(bucket).Get([]byte(message.Id)) != nil {
+			return errorx.DataUnavailable.New("message already exists: id=%v", message.Id)
+		}
+
+		return putMessage(tx, message)
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to put message to queue")
+	}
+
+	return nil
+}
+
+func (q *BoltQueue) Lease(ctx context.Context, id string) (*Message, error) {
+	var result *Message
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		message, err := getMessage(tx, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if message == nil || !message.isReady(now) {
+			return nil
+		}
+
+		message.lease(now, q.leaseDuration)
+		result = message
+		return putMessage(tx, message)
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to lease a message: id=%v", id)
+	}
+
+	if result != nil {
+		debugMessage(q.logger, result, "message leased")
+	}
+	return result, nil
+}
+
+func (q *BoltQueue) Ack(ctx context.Context, message *Message) error {
+	err := q.withLease(ctx, message, func(tx *bbolt.Tx, stored *Message) error {
+		sent := *message
+		sent.Status = StatusSent
+		sent.LeaseId = ""
+		sent.LeaseExpiresAt = time.Time{}
+		return putMessage(tx, &sent)
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to acknowledge a message")
+	}
+
+	message.Status = StatusSent
+	message.LeaseId = ""
+	message.LeaseExpiresAt = time.Time{}
+	debugMessage(q.logger, message, "message acknowledged")
+	return nil
+}
+
+func (q *BoltQueue) Nack(ctx context.Context, message *Message) error {
+	err := q.withLease(ctx, message, func(tx *bbolt.Tx, stored *Message) error {
+		returned := *message
+		returned.LeaseId = ""
+		returned.LeaseExpiresAt = time.Time{}
+		return putMessage(tx, &returned)
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to return a message to queue")
+	}
+
+	message.LeaseId = ""
+	message.LeaseExpiresAt = time.Time{}
+	debugMessage(q.logger, message, "message returned to queue")
+	return nil
+}
+
+func (q *BoltQueue) Extend(ctx context.Context, message *Message, duration time.Duration) error {
+	leaseExpiresAt := time.Now().Add(duration)
+	err := q.withLease(ctx, message, func(tx *bbolt.Tx, stored *Message) error {
+		stored.LeaseExpiresAt = leaseExpiresAt
+		return putMessage(tx, stored)
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to extend message lease")
+	}
+
+	message.LeaseExpiresAt = leaseExpiresAt
+	return nil
+}
+
+func (q *BoltQueue) ReapExpiredLeases(ctx context.Context) (int, error) {
+	var reaped []string
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		return forEachMessage(tx, func(message *Message) error {
+			if message.Status != StatusInProgress || message.LeaseExpiresAt.After(now) {
+				return nil
+			}
+
+			message.Status = StatusCreated
+			message.LeaseId = ""
+			message.LeaseExpiresAt = time.Time{}
+			reaped = append(reaped, message.Id)
+			return putMessage(tx, message)
+		})
+	})
+	if err != nil {
+		return 0, errorx.EnhanceStackTrace(err, "failed to reap expired leases")
+	}
+
+	for _, id := range reaped {
+		q.logger.Info("expired message lease reaped", zap.String("id", id))
+	}
+
+	return len(reaped), nil
+}
+
+func (q *BoltQueue) UserMessagesCount(ctx context.Context, userId int64) (map[Status]int, error) {
+	result := map[Status]int{}
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		return forEachMessage(tx, func(message *Message) error {
+			if message.UserId == userId {
+				result[message.Status]++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to filter messages")
+	}
+
+	return result, nil
+}
+
+func (q *BoltQueue) ResetAwaitingAuthorizationMessages(ctx context.Context, userId int64) error {
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		return forEachMessage(tx, func(message *Message) error {
+			if message.UserId != userId || message.Status != StatusAwaitingAuthorization {
+				return nil
+			}
+
+			message.Status = StatusCreated
+			return putMessage(tx, message)
+		})
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to reset messages awaiting authorization")
+	}
+
+	return nil
+}
+
+func (q *BoltQueue) UpdateEachMessage(ctx context.Context, userId int64, status Status, updater func(*Message)) (int, error) {
+	if !isEditableStatus(status) {
+		return 0, ErrMessageNotEditable.New("messages with status %v can't be changed", status)
+	}
+
+	updated := 0
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		updated = 0
+		return forEachMessage(tx, func(message *Message) error {
+			if message.UserId != userId || message.Status != status {
+				return nil
+			}
+
+			updater(message)
+			updated++
+			return putMessage(tx, message)
+		})
+	})
+	if err != nil {
+		return 0, errorx.EnhanceStackTrace(err, "failed to update messages")
+	}
+
+	return updated, nil
+}
+
+func (q *BoltQueue) GetMessage(ctx context.Context, id string) (*Message, error) {
+	var result *Message
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		result, err = getMessage(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to read a message")
+	}
+
+	if result == nil {
+		return nil, errorx.DataUnavailable.New("message not found: id=%v", id)
+	}
+
+	return result, nil
+}
+
+func (q *BoltQueue) FindUserMessages(ctx context.Context, userId int64, messageStatus Status) ([]*Message, error) {
+	return q.findMessages(func(message *Message) bool {
+		return message.UserId == userId && message.Status == messageStatus
+	})
+}
+
+func (q *BoltQueue) FindMessages(ctx context.Context, messageStatus Status) ([]*Message, error) {
+	return q.findMessages(func(message *Message) bool {
+		return message.Status == messageStatus
+	})
+}
+
+func (q *BoltQueue) FindReadyMessages(ctx context.Context, now time.Time, limit int) ([]*Message, error) {
+	messages, err := q.findMessages(func(message *Message) bool {
+		return message.isReady(now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].RetryAfter.Before(messages[j].RetryAfter)
+	})
+	return lo.Slice(messages, 0, limit), nil
+}
+
+func (q *BoltQueue) FindProblemsToCheck(
+	ctx context.Context, checkedBefore time.Time, limit int,
+) ([]*Message, error) {
+	messages, err := q.findMessages(func(message *Message) bool {
+		return message.isProblemToCheck(checkedBefore)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].ProblemCheckedAt.Before(messages[j].ProblemCheckedAt)
+	})
+	return lo.Slice(messages, 0, limit), nil
+}
+
+func (q *BoltQueue) ListUserMessages(ctx context.Context, userId int64, query MessageListQuery) (*MessagePage, error) {
+	now := time.Now()
+	messages, err := q.findMessages(func(message *Message) bool {
+		return message.UserId == userId && lo.Contains(PendingStatuses, message.Status) &&
+			message.IsScheduled(now) == query.Scheduled
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return query.isListedBefore(messages[i], messages[j])
+	})
+	// the index of the first message that doesn't go before the given one
+	position := func(message *Message) int {
+		return sort.Search(len(messages), func(i int) bool {
+			return !query.isListedBefore(messages[i], message)
+		})
+	}
+
+	start := 0
+	end := len(messages)
+	switch {
+	case query.From != nil:
+		start = position(query.From)
+	case query.After != nil:
+		start = sort.Search(len(messages), func(i int) bool {
+			return query.isListedBefore(query.After, messages[i])
+		})
+	case query.Before != nil:
+		end = position(query.Before)
+		start = max(end-query.Limit, 0)
+	}
+	end = min(start+query.Limit, end)
+
+	return &MessagePage{
+		Messages:    messages[start:end],
+		HasMore:     end < len(messages),
+		HasPrevious: start > 0,
+	}, nil
+}
+
+func (q *BoltQueue) UpdateMessage(ctx context.Context, message *Message) error {
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		return putMessage(tx, message)
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to store message: id=%v", message.Id)
+	}
+
+	return nil
+}
+
+func (q *BoltQueue) DeleteMessage(ctx context.Context, message *Message) error {
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(message.Id))
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to delete a message")
+	}
+
+	return nil
+}
+
+func (q *BoltQueue) EditMessage(ctx context.Context, id string, edit func(message *Message) error) (*Message, error) {
+	var result *Message
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		message, err := getMessage(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if message == nil {
+			return errorx.DataUnavailable.New("message not found: id=%v", id)
+		}
+
+		if !message.IsEditable() {
+			return ErrMessageNotEditable.New("message is being sent or is sent already: id=%v", id)
+		}
+
+		err = edit(message)
+		if err != nil {
+			return err
+		}
+
+		result = message
+		return putMessage(tx, message)
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to edit message: id=%v", id)
+	}
+
+	debugMessage(q.logger, result, "message edited")
+	return result, nil
+}
+
+func (q *BoltQueue) findMessages(filter func(message *Message) bool) ([]*Message, error) {
+	var result []*Message
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		return forEachMessage(tx, func(message *Message) error {
+			if filter(message) {
+				result = append(result, message)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to filter messages")
+	}
+
+	return result, nil
+}
+
+// withLease runs the action in a transaction only when the stored message is still leased with the same lease id
+func (q *BoltQueue) withLease(ctx context.Context, message *Message, action func(tx *bbolt.Tx, stored *Message) error) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := getMessage(tx, message.Id)
+		if err != nil {
+			return err
+		}
+
+		if stored == nil {
+			return ErrLeaseLost.New("message not found: id=%v", message.Id)
+		}
+
+		if stored.Status != StatusInProgress || stored.LeaseId != message.LeaseId {
+			return ErrLeaseLost.New("message is not leased anymore: id=%v", message.Id)
+		}
+
+		return action(tx, stored)
+	})
+}
+
+// forEachMessage Iterates over the messages in the order of their ids.
+// The messages are read beforehand, so that the action can modify the bucket
+func forEachMessage(tx *bbolt.Tx, action func(message *Message) error) error {
+	var messages []*Message
+	err := tx.Bucket(bucket).ForEach(func(key, value []byte) error {
+		var message Message
+		err := json.Unmarshal(value, &message)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%s", key)
+		}
+
+		messages = append(messages, &message)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		err := action(message)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getMessage Returns nil when there is no such message
+func getMessage(tx *bbolt.Tx, id string) (*Message, error) {
+	data := tx.Bucket(bucket).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	var message Message
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", id)
+	}
+
+	return &message, nil
+}
+
+func putMessage(tx *bbolt.Tx, message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to serialize message: id=%v", message.Id)
+	}
+
+	return tx.Bucket(bucket).Put([]byte(message.Id), data)
+}
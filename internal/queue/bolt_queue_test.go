@@ -0,0 +1,26 @@
+package queue
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"go.etcd.io/bbolt"
+)
+
+func TestBoltQueue(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	queue, err := NewBoltQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: time.Minute}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runQueueConformance(t, queue)
+}
@@ -0,0 +1,379 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+)
+
+// runQueueConformance Checks the behaviour every MessageQueue implementation has to provide.
+// User ids and message ids are unique for each run, so that a shared storage can be used
+func runQueueConformance(t *testing.T, queue MessageQueue) {
+	ctx := context.Background()
+	userId := time.Now().UnixNano()
+	newMessage := func(id string, retryAfter time.Time) *Message {
+		return &Message{
+			Id:         fmt.Sprintf("%v-%v", userId, id),
+			UserId:     userId,
+			CategoryId: 1,
+			Text:       "text",
+			CreatedAt:  time.Now(),
+			RetryAfter: retryAfter,
+			Status:     StatusCreated,
+		}
+	}
+
+	t.Run("LeaseSkipsMessagesToRetryLater", func(t *testing.T) {
+		message := newMessage("later", time.Now().Add(time.Hour))
+		if !assert.NoError(t, queue.Add(ctx, message)) {
+			return
+		}
+
+		leased, err := queue.Lease(ctx, message.Id)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Nil(t, leased)
+		stored, err := queue.GetMessage(ctx, message.Id)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, StatusCreated, stored.Status)
+	})
+
+	t.Run("FindReadyMessages", func(t *testing.T) {
+		// the dates are far in the past, so that these messages go before any other ones
+		past := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		messages := []*Message{
+			newMessage("ready-b", past.Add(time.Hour)),
+			newMessage("ready-a", past),
+			newMessage("ready-later", time.Now().Add(time.Hour)),
+		}
+		for _, message := range messages {
+			if !assert.NoError(t, queue.Add(ctx, message)) {
+				return
+			}
+		}
+
+		ready, err := queue.FindReadyMessages(ctx, time.Now(), 2)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, []string{messages[1].Id, messages[0].Id}, lo.Map(ready, func(message *Message, _ int) string {
+			return message.Id
+		}))
+		for _, message := range messages {
+			assert.NoError(t, queue.DeleteMessage(ctx, message))
+		}
+	})
+
+	t.Run("FindProblemsToCheck", func(t *testing.T) {
+		past := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		var messages []*Message
+		for i, problemStatus := range []string{"accepted", "", "closed", "answered"} {
+			message := newMessage(fmt.Sprintf("problem-%v", i), time.Time{})
+			message.Status = StatusSent
+			message.ProblemId = int64(i + 1)
+			message.ProblemStatus = problemStatus
+			message.ProblemCheckedAt = past.Add(-time.Duration(i) * time.Hour)
+			messages = append(messages, message)
+		}
+		// checked after the given time
+		messages[3].ProblemCheckedAt = past.Add(time.Hour)
+		for _, message := range messages {
+			if !assert.NoError(t, queue.Add(ctx, message)) {
+				return
+			}
+		}
+
+		problems, err := queue.FindProblemsToCheck(ctx, past.Add(time.Minute), 10)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, []string{messages[1].Id, messages[0].Id}, lo.Map(problems, func(message *Message, _ int) string {
+			return message.Id
+		}))
+		for _, message := range messages {
+			assert.NoError(t, queue.DeleteMessage(ctx, message))
+		}
+	})
+
+	t.Run("LeaseIsLostAfterAck", func(t *testing.T) {
+		message := newMessage("ack", time.Time{})
+		if !assert.NoError(t, queue.Add(ctx, message)) {
+			return
+		}
+
+		leased, err := queue.Lease(ctx, message.Id)
+		if !assert.NoError(t, err) || !assert.NotNil(t, leased) {
+			return
+		}
+
+		assert.Equal(t, message.Id, leased.Id)
+		assert.NoError(t, queue.Extend(ctx, leased, time.Hour))
+
+		stale := *leased
+		assert.NoError(t, queue.Ack(ctx, leased))
+		assert.True(t, errorx.IsOfType(queue.Nack(ctx, &stale), ErrLeaseLost))
+		assert.True(t, errorx.IsOfType(queue.Extend(ctx, &stale, time.Hour), ErrLeaseLost))
+
+		stored, err := queue.GetMessage(ctx, message.Id)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, StatusSent, stored.Status)
+		assert.Empty(t, stored.LeaseId)
+	})
+
+	t.Run("NackReturnsMessage", func(t *testing.T) {
+		message := newMessage("nack", time.Time{})
+		if !assert.NoError(t, queue.Add(ctx, message)) {
+			return
+		}
+
+		leased, err := queue.Lease(ctx, message.Id)
+		if !assert.NoError(t, err) || !assert.NotNil(t, leased) {
+			return
+		}
+
+		leased.Status = StatusCreated
+		leased.Tries = 1
+		if !assert.NoError(t, queue.Nack(ctx, leased)) {
+			return
+		}
+
+		leased, err = queue.Lease(ctx, message.Id)
+		if !assert.NoError(t, err) || !assert.NotNil(t, leased) {
+			return
+		}
+
+		assert.Equal(t, message.Id, leased.Id)
+		assert.Equal(t, 1, leased.Tries)
+		assert.NoError(t, queue.Ack(ctx, leased))
+	})
+
+	t.Run("ReapExpiredLeases", func(t *testing.T) {
+		message := newMessage("reap", time.Time{})
+		if !assert.NoError(t, queue.Add(ctx, message)) {
+			return
+		}
+
+		leased, err := queue.Lease(ctx, message.Id)
+		if !assert.NoError(t, err) || !assert.NotNil(t, leased) {
+			return
+		}
+
+		assert.NoError(t, queue.Extend(ctx, leased, -time.Second))
+		count, err := queue.ReapExpiredLeases(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.GreaterOrEqual(t, count, 1)
+		stored, err := queue.GetMessage(ctx, message.Id)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, StatusCreated, stored.Status)
+		assert.Empty(t, stored.LeaseId)
+		assert.True(t, errorx.IsOfType(queue.Ack(ctx, leased), ErrLeaseLost))
+	})
+
+	t.Run("LeaseById", func(t *testing.T) {
+		message := newMessage("lease", time.Time{})
+		if !assert.NoError(t, queue.Add(ctx, message)) {
+			return
+		}
+
+		leased, err := queue.Lease(ctx, message.Id)
+		if !assert.NoError(t, err) || !assert.NotNil(t, leased) {
+			return
+		}
+
+		assert.Equal(t, StatusInProgress, leased.Status)
+		assert.NotEmpty(t, leased.LeaseId)
+
+		for _, id := range []string{message.Id, fmt.Sprintf("%v-%v", userId, "later"), fmt.Sprintf("%v-%v", userId, "missing")} {
+			other, err := queue.Lease(ctx, id)
+			assert.NoError(t, err)
+			assert.Nil(t, other, id)
+		}
+
+		assert.NoError(t, queue.Ack(ctx, leased))
+	})
+
+	t.Run("EditMessage", func(t *testing.T) {
+		edited, err := queue.EditMessage(ctx, fmt.Sprintf("%v-%v", userId, "later"), func(message *Message) error {
+			message.Priority = true
+			return nil
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.True(t, edited.Priority)
+		stored, err := queue.GetMessage(ctx, edited.Id)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.True(t, stored.Priority)
+
+		_, err = queue.EditMessage(ctx, fmt.Sprintf("%v-%v", userId, "ack"), func(message *Message) error {
+			message.Priority = true
+			return nil
+		})
+		assert.True(t, errorx.IsOfType(err, ErrMessageNotEditable))
+	})
+
+	t.Run("UpdateEachMessage", func(t *testing.T) {
+		updated, err := queue.UpdateEachMessage(ctx, userId, StatusCreated, func(message *Message) {
+			message.Status = StatusAwaitingAuthorization
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 2, updated)
+		counts, err := queue.UserMessagesCount(ctx, userId)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// sent messages are not changed
+		assert.Equal(t, map[Status]int{StatusAwaitingAuthorization: 2, StatusSent: 3}, counts)
+
+		_, err = queue.UpdateEachMessage(ctx, userId, StatusSent, func(message *Message) {
+			message.Status = StatusCreated
+		})
+		assert.True(t, errorx.IsOfType(err, ErrMessageNotEditable))
+
+		err = queue.ResetAwaitingAuthorizationMessages(ctx, userId)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		created, err := queue.FindUserMessages(ctx, userId, StatusCreated)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Len(t, created, 2)
+	})
+
+	t.Run("UpdateAndDeleteMessage", func(t *testing.T) {
+		message, err := queue.GetMessage(ctx, fmt.Sprintf("%v-%v", userId, "later"))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		message.Text = "updated"
+		if !assert.NoError(t, queue.UpdateMessage(ctx, message)) {
+			return
+		}
+
+		stored, err := queue.GetMessage(ctx, message.Id)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, "updated", stored.Text)
+
+		if !assert.NoError(t, queue.DeleteMessage(ctx, message)) {
+			return
+		}
+
+		_, err = queue.GetMessage(ctx, message.Id)
+		assert.Error(t, err)
+	})
+
+	t.Run("ListUserMessages", func(t *testing.T) {
+		// another user, so that the messages of the other subtests are not listed
+		listUserId := userId + 1
+		ids := func(page *MessagePage) []string {
+			return lo.Map(page.Messages, func(message *Message, _ int) string {
+				return strings.TrimPrefix(message.Id, fmt.Sprintf("%v-", userId))
+			})
+		}
+		createdAt := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+		messages := map[string]*Message{}
+		// ids don't follow the creation order, priority messages go first
+		for i, id := range []string{"d", "c", "b", "a", "sent", "s1", "s2"} {
+			message := newMessage(id, time.Time{})
+			message.UserId = listUserId
+			message.CreatedAt = createdAt.Add(time.Duration(i) * time.Minute)
+			switch id {
+			case "b":
+				message.Priority = true
+			case "sent":
+				message.Status = StatusSent
+			case "s1":
+				message.Schedule(time.Now().Add(2 * time.Hour).Truncate(time.Second))
+			case "s2":
+				message.Schedule(time.Now().Add(time.Hour).Truncate(time.Second))
+			}
+			if !assert.NoError(t, queue.Add(ctx, message)) {
+				return
+			}
+			messages[id] = message
+		}
+
+		page, err := queue.ListUserMessages(ctx, listUserId, MessageListQuery{Limit: 2})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, []string{"b", "d"}, ids(page))
+		assert.True(t, page.HasMore)
+		assert.False(t, page.HasPrevious)
+
+		page, err = queue.ListUserMessages(ctx, listUserId, MessageListQuery{After: messages["d"], Limit: 2})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, []string{"c", "a"}, ids(page))
+		assert.False(t, page.HasMore)
+		assert.True(t, page.HasPrevious)
+
+		page, err = queue.ListUserMessages(ctx, listUserId, MessageListQuery{Before: messages["c"], Limit: 2})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, []string{"b", "d"}, ids(page))
+		assert.False(t, page.HasPrevious)
+
+		// a deleted message still points to the place in the list
+		if !assert.NoError(t, queue.DeleteMessage(ctx, messages["d"])) {
+			return
+		}
+		page, err = queue.ListUserMessages(ctx, listUserId, MessageListQuery{From: messages["d"], Limit: 2})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, []string{"c", "a"}, ids(page))
+		assert.False(t, page.HasMore)
+
+		page, err = queue.ListUserMessages(ctx, listUserId, MessageListQuery{Scheduled: true, Limit: 2})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, []string{"s2", "s1"}, ids(page))
+		assert.False(t, page.HasMore)
+	})
+}
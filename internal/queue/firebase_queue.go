@@ -6,10 +6,12 @@ import (
 
 	"cloud.google.com/go/firestore"
 	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/samber/lo"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -17,21 +19,23 @@ const (
 )
 
 type FirebaseQueue struct {
-	logger *zap.Logger
-	fc     *firestore.Client
+	logger        *zap.Logger
+	fc            *firestore.Client
+	leaseDuration time.Duration
 }
 
-func NewFirebaseQueue(logger *zap.Logger, storage *firestore.Client) *FirebaseQueue {
+func NewFirebaseQueue(logger *zap.Logger, conf *config.Config, storage *firestore.Client) *FirebaseQueue {
 	return &FirebaseQueue{
-		logger: logger,
-		fc:     storage,
+		logger:        logger,
+		fc:            storage,
+		leaseDuration: conf.QueueLeaseDuration,
 	}
 }
 
-func (q *FirebaseQueue) Add(message *Message) error {
-	q.debugMessage(message, "adding message to queue")
+func (q *FirebaseQueue) Add(ctx context.Context, message *Message) error {
+	debugMessage(q.logger, message, "adding message to queue")
 
-	_, err := q.fc.Collection(collection).Doc(message.Id).Create(context.Background(), message)
+	_, err := q.fc.Collection(collection).Doc(message.Id).Create(ctx, message)
 	if err != nil {
 		return errorx.EnhanceStackTrace(err, "failed to put message to queue")
 	}
@@ -39,98 +43,206 @@ func (q *FirebaseQueue) Add(message *Message) error {
 	return nil
 }
 
-func (q *FirebaseQueue) Poll() (*Message, error) {
-	query := q.fc.Collection(collection).
-		Where("status", "==", StatusCreated).
-		Where("retryAfter", "<=", time.Now()).
-		Limit(1)
-	snapshots, err := query.Documents(context.Background()).GetAll()
-	if err != nil {
-		return nil, errorx.EnhanceStackTrace(err, "failed to poll a message")
-	}
+func (q *FirebaseQueue) Lease(ctx context.Context, id string) (*Message, error) {
+	var result *Message
+	ref := q.fc.Collection(collection).Doc(id)
+	err := q.fc.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		result = nil
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			// deleted by the user
+			return nil
+		}
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to read a message: id=%v", id)
+		}
 
-	var result Message
-	for _, snapshot := range snapshots {
-		err := snapshot.DataTo(&result)
+		var message Message
+		err = snapshot.DataTo(&message)
 		if err != nil {
-			return nil, errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+			return errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", id)
 		}
 
-		if result.RetryAfter.After(time.Now()) {
-			// will be sent later
-			continue
+		now := time.Now()
+		if !message.isReady(now) {
+			return nil
 		}
 
-		_, err = q.fc.Collection(collection).Doc(snapshot.Ref.ID).Delete(context.Background())
+		message.lease(now, q.leaseDuration)
+		err = tx.Set(ref, &message)
 		if err != nil {
-			return nil, errorx.EnhanceStackTrace(err, "failed to delete pulled message")
+			return errorx.EnhanceStackTrace(err, "failed to lease a message: id=%v", id)
 		}
 
-		q.debugMessage(&result, "message polled")
+		result = &message
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result != nil {
+		debugMessage(q.logger, result, "message leased")
+	}
+	return result, nil
+}
 
-		return &result, nil
+func (q *FirebaseQueue) Ack(ctx context.Context, message *Message) error {
+	err := q.withLease(ctx, message, func(tx *firestore.Transaction, ref *firestore.DocumentRef) error {
+		sent := *message
+		sent.Status = StatusSent
+		sent.LeaseId = ""
+		sent.LeaseExpiresAt = time.Time{}
+		return tx.Set(ref, &sent)
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to acknowledge a message")
 	}
 
-	q.logger.Debug("no appropriate messages found")
-	return nil, nil
+	message.Status = StatusSent
+	message.LeaseId = ""
+	message.LeaseExpiresAt = time.Time{}
+	debugMessage(q.logger, message, "message acknowledged")
+	return nil
 }
 
-func (q *FirebaseQueue) UpdateEachMessage(userId int64, updater func(*Message)) error {
-	query := q.fc.Collection(collection).Where("userId", "==", userId)
-	documents := query.Documents(context.Background())
-	snapshots, err := documents.GetAll()
+func (q *FirebaseQueue) Nack(ctx context.Context, message *Message) error {
+	err := q.withLease(ctx, message, func(tx *firestore.Transaction, ref *firestore.DocumentRef) error {
+		returned := *message
+		returned.LeaseId = ""
+		returned.LeaseExpiresAt = time.Time{}
+		return tx.Set(ref, &returned)
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to filter messages")
+		return errorx.EnhanceStackTrace(err, "failed to return a message to queue")
 	}
 
-	var message Message
+	message.LeaseId = ""
+	message.LeaseExpiresAt = time.Time{}
+	debugMessage(q.logger, message, "message returned to queue")
+	return nil
+}
+
+func (q *FirebaseQueue) Extend(ctx context.Context, message *Message, duration time.Duration) error {
+	leaseExpiresAt := time.Now().Add(duration)
+	err := q.withLease(ctx, message, func(tx *firestore.Transaction, ref *firestore.DocumentRef) error {
+		return tx.Update(ref, []firestore.Update{{Path: "leaseExpiresAt", Value: leaseExpiresAt}})
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to extend message lease")
+	}
+
+	message.LeaseExpiresAt = leaseExpiresAt
+	return nil
+}
+
+func (q *FirebaseQueue) ReapExpiredLeases(ctx context.Context) (int, error) {
+	query := q.fc.Collection(collection).
+		Where("status", "==", StatusInProgress).
+		Where("leaseExpiresAt", "<=", time.Now())
+	snapshots, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return 0, errorx.EnhanceStackTrace(err, "failed to find expired leases")
+	}
+
+	count := 0
 	for _, snapshot := range snapshots {
-		err = snapshot.DataTo(&message)
+		var message Message
+		err := snapshot.DataTo(&message)
 		if err != nil {
-			return errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+			return count, errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
 		}
 
-		updater(&message)
-		_, err := q.fc.Collection(collection).Doc(snapshot.Ref.ID).Set(context.Background(), message)
+		if message.LeaseExpiresAt.After(time.Now()) {
+			// the lease was extended in the meantime
+			continue
+		}
+
+		message.Status = StatusCreated
+		err = q.Nack(ctx, &message)
 		if err != nil {
-			return errorx.EnhanceStackTrace(err, "failed to store message: id=%v", snapshot.Ref.ID)
+			if errorx.IsOfType(err, ErrLeaseLost) {
+				// the message was completed or reaped by another instance
+				continue
+			}
+			return count, err
 		}
-	}
 
-	return nil
+		q.logger.Info("expired message lease reaped", zap.String("id", message.Id))
+		count++
+	}
 
+	return count, nil
 }
 
-func (q *FirebaseQueue) ResetAwaitingAuthorizationMessages(userId int64) error {
+func (q *FirebaseQueue) UpdateEachMessage(ctx context.Context, userId int64, messageStatus Status, updater func(*Message)) (int, error) {
+	if !isEditableStatus(messageStatus) {
+		return 0, ErrMessageNotEditable.New("messages with status %v can't be changed", messageStatus)
+	}
+
 	query := q.fc.Collection(collection).
 		Where("userId", "==", userId).
-		Where("status", "==", StatusAwaitingAuthorization)
-	documents := query.Documents(context.Background())
+		Where("status", "==", messageStatus)
+	documents := query.Documents(ctx)
 	snapshots, err := documents.GetAll()
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to filter messages")
+		return 0, errorx.EnhanceStackTrace(err, "failed to filter messages")
 	}
 
-	var message Message
+	updated := 0
 	for _, snapshot := range snapshots {
-		err = snapshot.DataTo(&message)
+		changed := false
+		err = q.fc.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			changed = false
+			stored, err := tx.Get(snapshot.Ref)
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			if err != nil {
+				return errorx.EnhanceStackTrace(err, "failed to read a message: id=%v", snapshot.Ref.ID)
+			}
+
+			var message Message
+			err = stored.DataTo(&message)
+			if err != nil {
+				return errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+			}
+
+			// the message might have been leased or changed since it was found
+			if message.Status != messageStatus {
+				return nil
+			}
+
+			updater(&message)
+			changed = true
+			return tx.Set(snapshot.Ref, &message)
+		})
 		if err != nil {
-			return errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+			return updated, errorx.EnhanceStackTrace(err, "failed to update message: id=%v", snapshot.Ref.ID)
 		}
 
-		message.Status = StatusCreated
-		_, err := q.fc.Collection(collection).Doc(snapshot.Ref.ID).Set(context.Background(), message)
-		if err != nil {
-			return errorx.EnhanceStackTrace(err, "failed to store message: id=%v", snapshot.Ref.ID)
+		if changed {
+			updated++
 		}
 	}
 
+	return updated, nil
+}
+
+func (q *FirebaseQueue) ResetAwaitingAuthorizationMessages(ctx context.Context, userId int64) error {
+	_, err := q.UpdateEachMessage(ctx, userId, StatusAwaitingAuthorization, func(message *Message) {
+		message.Status = StatusCreated
+	})
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to reset messages awaiting authorization")
+	}
+
 	return nil
 }
 
-func (q *FirebaseQueue) UserMessagesCount(userId int64) (map[Status]int, error) {
+func (q *FirebaseQueue) UserMessagesCount(ctx context.Context, userId int64) (map[Status]int, error) {
 	query := q.fc.Collection(collection).Where("userId", "==", userId)
-	documents := query.Documents(context.Background())
+	documents := query.Documents(ctx)
 	snapshots, err := documents.GetAll()
 	if err != nil {
 		return nil, errorx.EnhanceStackTrace(err, "failed to filter messages")
@@ -149,8 +261,8 @@ func (q *FirebaseQueue) UserMessagesCount(userId int64) (map[Status]int, error)
 	return result, nil
 }
 
-func (q *FirebaseQueue) GetMessage(id string) (*Message, error) {
-	snapshot, err := q.fc.Collection(collection).Doc(id).Get(context.Background())
+func (q *FirebaseQueue) GetMessage(ctx context.Context, id string) (*Message, error) {
+	snapshot, err := q.fc.Collection(collection).Doc(id).Get(ctx)
 	if status.Code(err) == codes.NotFound {
 		return nil, errorx.EnhanceStackTrace(err, "message not found")
 	}
@@ -164,22 +276,280 @@ func (q *FirebaseQueue) GetMessage(id string) (*Message, error) {
 	return &message, nil
 }
 
-func (q *FirebaseQueue) DeleteMessage(message *Message) error {
-	_, err := q.fc.Collection(collection).Doc(message.Id).Delete(context.Background())
+func (q *FirebaseQueue) FindUserMessages(ctx context.Context, userId int64, messageStatus Status) ([]*Message, error) {
+	query := q.fc.Collection(collection).
+		Where("userId", "==", userId).
+		Where("status", "==", messageStatus)
+	snapshots, err := query.Documents(ctx).GetAll()
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to delete a message")
+		return nil, errorx.EnhanceStackTrace(err, "failed to filter messages")
+	}
+
+	var result []*Message
+	for _, snapshot := range snapshots {
+		var message Message
+		err := snapshot.DataTo(&message)
+		if err != nil {
+			return nil, errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+		}
+		result = append(result, &message)
+	}
+
+	return result, nil
+}
+
+func (q *FirebaseQueue) FindMessages(ctx context.Context, messageStatus Status) ([]*Message, error) {
+	query := q.fc.Collection(collection).Where("status", "==", messageStatus)
+	snapshots, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to filter messages")
+	}
+
+	var result []*Message
+	for _, snapshot := range snapshots {
+		var message Message
+		err := snapshot.DataTo(&message)
+		if err != nil {
+			return nil, errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+		}
+		result = append(result, &message)
+	}
+
+	return result, nil
+}
+
+// FindReadyMessages Requires a composite index on status and retryAfter
+func (q *FirebaseQueue) FindReadyMessages(ctx context.Context, now time.Time, limit int) ([]*Message, error) {
+	query := q.fc.Collection(collection).
+		Where("status", "==", StatusCreated).
+		Where("retryAfter", "<=", now).
+		OrderBy("retryAfter", firestore.Asc).
+		Limit(limit)
+	snapshots, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to find ready messages")
+	}
+
+	var result []*Message
+	for _, snapshot := range snapshots {
+		var message Message
+		err := snapshot.DataTo(&message)
+		if err != nil {
+			return nil, errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+		}
+		result = append(result, &message)
+	}
+
+	return result, nil
+}
+
+// FindProblemsToCheck Requires a composite index on status, problemCheckedAt, problemId and problemStatus
+func (q *FirebaseQueue) FindProblemsToCheck(
+	ctx context.Context, checkedBefore time.Time, limit int,
+) ([]*Message, error) {
+	query := q.fc.Collection(collection).
+		Where("status", "==", StatusSent).
+		Where("problemId", ">", 0).
+		Where("problemStatus", "!=", string(spb.ProblemStatusClosed)).
+		Where("problemCheckedAt", "<", checkedBefore).
+		OrderBy("problemCheckedAt", firestore.Asc).
+		Limit(limit)
+	snapshots, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to find problems to check")
+	}
+
+	var result []*Message
+	for _, snapshot := range snapshots {
+		var message Message
+		err := snapshot.DataTo(&message)
+		if err != nil {
+			return nil, errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+		}
+		result = append(result, &message)
+	}
+
+	return result, nil
+}
+
+// ListUserMessages Requires composite indexes on userId, status, priority descending and createdAt
+// and on userId, status and scheduledAt. Scheduled messages can't be excluded from the other ones by a query,
+// so they are skipped while reading the messages in batches
+func (q *FirebaseQueue) ListUserMessages(
+	ctx context.Context, userId int64, listQuery MessageListQuery,
+) (*MessagePage, error) {
+	now := time.Now()
+	query := q.fc.Collection(collection).Where("userId", "==", userId)
+	var cursor func(message *Message) []any
+	if listQuery.Scheduled {
+		query = query.
+			Where("status", "==", StatusCreated).
+			Where("scheduledAt", ">", now).
+			OrderBy("scheduledAt", firestore.Asc).
+			OrderBy(firestore.DocumentID, firestore.Asc)
+		cursor = func(message *Message) []any {
+			return []any{message.ScheduledAt, message.Id}
+		}
+	} else {
+		query = query.
+			Where("status", "in", PendingStatuses).
+			OrderBy("priority", firestore.Desc).
+			OrderBy("createdAt", firestore.Asc).
+			OrderBy(firestore.DocumentID, firestore.Asc)
+		cursor = func(message *Message) []any {
+			return []any{message.Priority, message.CreatedAt, message.Id}
+		}
+	}
+
+	backward := listQuery.Before != nil
+	// one message more than the limit is read to find out whether there are more messages
+	batchSize := listQuery.Limit + 1
+	var messages []*Message
+	var last *Message
+	for {
+		batch := query
+		switch {
+		case backward && last == nil:
+			batch = batch.EndBefore(cursor(listQuery.Before)...).LimitToLast(batchSize)
+		case backward:
+			batch = batch.EndBefore(cursor(last)...).LimitToLast(batchSize)
+		case last != nil:
+			batch = batch.StartAfter(cursor(last)...).Limit(batchSize)
+		case listQuery.From != nil:
+			batch = batch.StartAt(cursor(listQuery.From)...).Limit(batchSize)
+		case listQuery.After != nil:
+			batch = batch.StartAfter(cursor(listQuery.After)...).Limit(batchSize)
+		default:
+			batch = batch.Limit(batchSize)
+		}
+
+		snapshots, err := batch.Documents(ctx).GetAll()
+		if err != nil {
+			return nil, errorx.EnhanceStackTrace(err, "failed to list messages")
+		}
+
+		if backward {
+			// the messages closest to the cursor go first
+			snapshots = lo.Reverse(snapshots)
+		}
+		for _, snapshot := range snapshots {
+			var message Message
+			err := snapshot.DataTo(&message)
+			if err != nil {
+				return nil, errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", snapshot.Ref.ID)
+			}
+
+			last = &message
+			if message.IsScheduled(now) == listQuery.Scheduled {
+				messages = append(messages, &message)
+			}
+		}
+
+		if len(messages) > listQuery.Limit || len(snapshots) < batchSize {
+			break
+		}
+	}
+
+	hasMessagesBeyond := len(messages) > listQuery.Limit
+	messages = messages[:min(len(messages), listQuery.Limit)]
+	if backward {
+		return &MessagePage{
+			Messages:    lo.Reverse(messages),
+			HasMore:     true,
+			HasPrevious: hasMessagesBeyond,
+		}, nil
+	}
+
+	return &MessagePage{
+		Messages:    messages,
+		HasMore:     hasMessagesBeyond,
+		HasPrevious: listQuery.From != nil || listQuery.After != nil,
+	}, nil
+}
+
+func (q *FirebaseQueue) UpdateMessage(ctx context.Context, message *Message) error {
+	_, err := q.fc.Collection(collection).Doc(message.Id).Set(ctx, message)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to store message: id=%v", message.Id)
 	}
 
 	return nil
 }
 
-func (q *FirebaseQueue) debugMessage(message *Message, text string) {
-	if ce := q.logger.Check(zap.DebugLevel, text); ce != nil {
-		messageYaml, err := yaml.Marshal(message)
+func (q *FirebaseQueue) EditMessage(
+	ctx context.Context, id string, edit func(message *Message) error,
+) (*Message, error) {
+	var result *Message
+	ref := q.fc.Collection(collection).Doc(id)
+	err := q.fc.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		result = nil
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return errorx.DataUnavailable.New("message not found: id=%v", id)
+		}
 		if err != nil {
-			ce.Write(zap.Int64("userId", message.UserId), zap.Error(err))
-		} else {
-			ce.Write(zap.String("message", string(messageYaml)))
+			return errorx.EnhanceStackTrace(err, "failed to read a message: id=%v", id)
 		}
+
+		var message Message
+		err = snapshot.DataTo(&message)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", id)
+		}
+
+		if !message.IsEditable() {
+			return ErrMessageNotEditable.New("message is being sent or is sent already: id=%v", id)
+		}
+
+		err = edit(&message)
+		if err != nil {
+			return err
+		}
+
+		result = &message
+		return tx.Set(ref, &message)
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to edit message: id=%v", id)
 	}
+
+	debugMessage(q.logger, result, "message edited")
+	return result, nil
+}
+
+func (q *FirebaseQueue) DeleteMessage(ctx context.Context, message *Message) error {
+	_, err := q.fc.Collection(collection).Doc(message.Id).Delete(ctx)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to delete a message")
+	}
+
+	return nil
+}
+
+// withLease runs the action in a transaction only when the stored message is still leased with the same lease id
+func (q *FirebaseQueue) withLease(
+	ctx context.Context, message *Message, action func(tx *firestore.Transaction, ref *firestore.DocumentRef) error,
+) error {
+	ref := q.fc.Collection(collection).Doc(message.Id)
+	return q.fc.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrLeaseLost.New("message not found: id=%v", message.Id)
+		}
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to read a message: id=%v", message.Id)
+		}
+
+		var stored Message
+		err = snapshot.DataTo(&stored)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to deserialize message: id=%v", message.Id)
+		}
+
+		if stored.Status != StatusInProgress || stored.LeaseId != message.LeaseId {
+			return ErrLeaseLost.New("message is not leased anymore: id=%v", message.Id)
+		}
+
+		return action(tx, ref)
+	})
 }
@@ -0,0 +1,15 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/storage/storagetest"
+)
+
+func TestFirebaseQueue(t *testing.T) {
+	client := storagetest.NewFirestoreClient(t)
+	runQueueConformance(t, NewFirebaseQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: time.Minute}, client))
+}
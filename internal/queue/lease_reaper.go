@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
+	"go.uber.org/zap"
+)
+
+// LeaseReaper periodically returns messages with expired leases back to the queue,
+// so that messages leased by a crashed sender are sent by another one
+type LeaseReaper struct {
+	logger   *zap.Logger
+	queue    MessageQueue
+	enabled  bool
+	interval time.Duration
+	worker   *util.Worker
+}
+
+func NewLeaseReaper(logger *zap.Logger, conf *config.Config, queue MessageQueue) *LeaseReaper {
+	return &LeaseReaper{
+		logger:   logger,
+		queue:    queue,
+		enabled:  conf.SenderEnabled,
+		interval: conf.QueueReaperInterval,
+	}
+}
+
+func (r *LeaseReaper) Start(_ context.Context) error {
+	if r.enabled {
+		r.logger.Info("starting lease reaper")
+		r.worker = util.StartWorker(func(ctx context.Context) time.Duration {
+			r.reap(ctx)
+			return r.interval
+		})
+	} else {
+		r.logger.Warn("lease reaper is disabled")
+	}
+	return nil
+}
+
+func (r *LeaseReaper) Stop(ctx context.Context) error {
+	if r.worker == nil {
+		return nil
+	}
+
+	return r.worker.Stop(ctx)
+}
+
+func (r *LeaseReaper) reap(ctx context.Context) {
+	count, err := r.queue.ReapExpiredLeases(ctx)
+	if err != nil {
+		r.logger.Error("failed to reap expired leases", zap.Error(err))
+		return
+	}
+
+	if count > 0 {
+		r.logger.Info("expired leases reaped", zap.Int("count", count))
+	}
+}
@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
+	"go.uber.org/zap"
+)
+
+// problemsPageSize is the number of problems read from the queue at once
+const problemsPageSize = 100
+
+// ProblemNotifier is told about the changes of the problems created from the sent messages
+type ProblemNotifier interface {
+	SendMessage(chat *tgbotapi.Chat, text string) error
+}
+
+// ProblemWatcher periodically checks the problems of sent messages on the portal
+// and notifies users when the problem status changes or an answer appears
+type ProblemWatcher struct {
+	logger    *zap.Logger
+	queue     MessageQueue
+	spbClient spb.Client
+	notifier  ProblemNotifier
+	enabled   bool
+	interval  time.Duration
+	pageSize  int
+	worker    *util.Worker
+}
+
+func NewProblemWatcher(
+	logger *zap.Logger, conf *config.Config, queue MessageQueue, spbClient spb.Client, notifier ProblemNotifier,
+) *ProblemWatcher {
+	return &ProblemWatcher{
+		logger:    logger,
+		queue:     queue,
+		spbClient: spbClient,
+		notifier:  notifier,
+		enabled:   conf.WatcherEnabled,
+		interval:  conf.WatcherInterval,
+		pageSize:  problemsPageSize,
+	}
+}
+
+func (w *ProblemWatcher) Start(_ context.Context) error {
+	if w.enabled {
+		w.logger.Info("starting problem watcher")
+		w.worker = util.StartWorker(func(ctx context.Context) time.Duration {
+			w.checkProblems(ctx)
+			return w.interval
+		})
+	} else {
+		w.logger.Warn("problem watcher is disabled")
+	}
+	return nil
+}
+
+func (w *ProblemWatcher) Stop(ctx context.Context) error {
+	if w.worker == nil {
+		return nil
+	}
+
+	return w.worker.Stop(ctx)
+}
+
+// checkProblems Checks the problems that are not closed page by page. A checked problem isn't read again
+// within the round, since its check time moves past the start of the round
+func (w *ProblemWatcher) checkProblems(ctx context.Context) {
+	startedAt := time.Now()
+	for ctx.Err() == nil {
+		messages, err := w.queue.FindProblemsToCheck(ctx, startedAt, w.pageSize)
+		if err != nil {
+			w.logger.Error("failed to find problems to check", zap.Error(err))
+			return
+		}
+
+		checkedCount := 0
+		for _, message := range messages {
+			err := w.checkProblem(ctx, message)
+			if err != nil {
+				w.logger.Warn(
+					"failed to check problem",
+					zap.String("id", message.Id),
+					zap.Int64("problemId", message.ProblemId),
+					zap.Error(err),
+				)
+				continue
+			}
+			checkedCount++
+		}
+
+		// the problems that failed to be checked are read again, so the round stops once none of them is checked
+		if len(messages) < w.pageSize || checkedCount == 0 {
+			return
+		}
+	}
+}
+
+func (w *ProblemWatcher) checkProblem(ctx context.Context, message *Message) error {
+	problem, err := w.spbClient.GetProblem(ctx, message.ProblemId)
+	if err != nil {
+		return err
+	}
+
+	notification := describeProblemChange(message, problem)
+	if notification != "" {
+		err = w.notifier.SendMessage(&tgbotapi.Chat{ID: message.UserId}, notification)
+		if err != nil {
+			return err
+		}
+	}
+
+	message.ProblemStatus = string(problem.Status)
+	message.ProblemAnswers = len(problem.Answers)
+	message.ProblemCheckedAt = time.Now()
+	return w.queue.UpdateMessage(ctx, message)
+}
+
+// describeProblemChange returns notification text when the problem differs from the last known one, or empty string.
+// The first check only records the problem, the user already knows it's just been sent
+func describeProblemChange(message *Message, problem *spb.ProblemResponse) string {
+	if message.ProblemCheckedAt.IsZero() {
+		return ""
+	}
+
+	statusChanged := message.ProblemStatus != string(problem.Status)
+	newAnswers := problem.Answers[min(message.ProblemAnswers, len(problem.Answers)):]
+	if !statusChanged && len(newAnswers) == 0 {
+		return ""
+	}
+
+	result := strings.Builder{}
+	result.WriteString(fmt.Sprintf(`Статус обращения: %v
+Сообщение: %v
+Ссылка: %v`,
+		problemStatusName(problem.Status),
+		message.Id,
+		message.ProblemUrl(),
+	))
+	for _, answer := range newAnswers {
+		result.WriteString(fmt.Sprintf("\n\nОтвет:\n%v", answer.Body))
+	}
+
+	return result.String()
+}
+
+func problemStatusName(status spb.ProblemStatus) string {
+	switch status {
+	case spb.ProblemStatusAccepted:
+		return "Принято"
+	case spb.ProblemStatusInProgress:
+		return "В работе"
+	case spb.ProblemStatusAnswered:
+		return "Получен ответ"
+	case spb.ProblemStatusClosed:
+		return "Закрыто"
+	default:
+		return string(status)
+	}
+}
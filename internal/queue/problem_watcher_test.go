@@ -0,0 +1,188 @@
+package queue
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestDescribeProblemChange(t *testing.T) {
+	checkedAt := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name     string
+		message  *Message
+		problem  *spb.ProblemResponse
+		expected string
+	}{
+		{
+			name:    "first check",
+			message: &Message{Id: "1", ProblemId: 10},
+			problem: &spb.ProblemResponse{
+				Id:      10,
+				Status:  spb.ProblemStatusAccepted,
+				Answers: []spb.ProblemAnswerResponse{{Id: 1, Body: "answer 1"}},
+			},
+			expected: "",
+		},
+		{
+			name:    "not changed",
+			message: &Message{Id: "1", ProblemId: 10, ProblemCheckedAt: checkedAt, ProblemStatus: "in_progress", ProblemAnswers: 1},
+			problem: &spb.ProblemResponse{
+				Id:      10,
+				Status:  spb.ProblemStatusInProgress,
+				Answers: []spb.ProblemAnswerResponse{{Id: 1, Body: "answer 1"}},
+			},
+			expected: "",
+		},
+		{
+			name:    "status changed",
+			message: &Message{Id: "1", ProblemId: 10, ProblemCheckedAt: checkedAt, ProblemStatus: "accepted"},
+			problem: &spb.ProblemResponse{Id: 10, Status: spb.ProblemStatusInProgress},
+			expected: `Статус обращения: В работе
+Сообщение: 1
+Ссылка: https://gorod.gov.spb.ru/problems/10/`,
+		},
+		{
+			name:    "new answer",
+			message: &Message{Id: "1", ProblemId: 10, ProblemCheckedAt: checkedAt, ProblemStatus: "answered", ProblemAnswers: 1},
+			problem: &spb.ProblemResponse{
+				Id:     10,
+				Status: spb.ProblemStatusAnswered,
+				Answers: []spb.ProblemAnswerResponse{
+					{Id: 1, Body: "answer 1"},
+					{Id: 2, Body: "answer 2"},
+				},
+			},
+			expected: `Статус обращения: Получен ответ
+Сообщение: 1
+Ссылка: https://gorod.gov.spb.ru/problems/10/
+
+Ответ:
+answer 2`,
+		},
+		{
+			name:    "unknown status",
+			message: &Message{Id: "1", ProblemId: 10, ProblemCheckedAt: checkedAt, ProblemStatus: "accepted"},
+			problem: &spb.ProblemResponse{Id: 10, Status: "moderation"},
+			expected: `Статус обращения: moderation
+Сообщение: 1
+Ссылка: https://gorod.gov.spb.ru/problems/10/`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := describeProblemChange(test.message, test.problem)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+type problemClient struct {
+	spb.Client
+	problems  map[int64]*spb.ProblemResponse
+	requested []int64
+}
+
+func (c *problemClient) GetProblem(_ context.Context, id int64) (*spb.ProblemResponse, error) {
+	c.requested = append(c.requested, id)
+	problem, exists := c.problems[id]
+	if !exists {
+		return nil, errorx.DataUnavailable.New("problem not found: id=%v", id)
+	}
+
+	return problem, nil
+}
+
+type problemNotifier struct {
+	notifications map[int64][]string
+}
+
+func (n *problemNotifier) SendMessage(chat *tgbotapi.Chat, text string) error {
+	n.notifications[chat.ID] = append(n.notifications[chat.ID], text)
+	return nil
+}
+
+func newTestProblemWatcher(t *testing.T, problems map[int64]*spb.ProblemResponse) *ProblemWatcher {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	boltQueue, err := NewBoltQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: time.Minute}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewProblemWatcher(
+		log.NewLogger(), &config.Config{}, boltQueue, &problemClient{problems: problems},
+		&problemNotifier{notifications: map[int64][]string{}},
+	)
+}
+
+func TestProblemWatcherFirstCheck(t *testing.T) {
+	watcher := newTestProblemWatcher(t, map[int64]*spb.ProblemResponse{
+		10: {Id: 10, Status: spb.ProblemStatusAccepted},
+	})
+
+	ctx := context.Background()
+	message := &Message{Id: "a", UserId: 1, CreatedAt: time.Now(), Status: StatusSent, ProblemId: 10}
+	if !assert.NoError(t, watcher.queue.Add(ctx, message)) {
+		return
+	}
+
+	watcher.checkProblems(ctx)
+
+	stored, err := watcher.queue.GetMessage(ctx, message.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(spb.ProblemStatusAccepted), stored.ProblemStatus)
+		assert.False(t, stored.ProblemCheckedAt.IsZero())
+	}
+	assert.Empty(t, watcher.notifier.(*problemNotifier).notifications, "the user knows about a just sent message")
+}
+
+func TestProblemWatcherChecksOpenProblems(t *testing.T) {
+	watcher := newTestProblemWatcher(t, map[int64]*spb.ProblemResponse{
+		10: {Id: 10, Status: spb.ProblemStatusInProgress},
+		11: {Id: 11, Status: spb.ProblemStatusClosed},
+		12: {Id: 12, Status: spb.ProblemStatusAccepted},
+		14: {Id: 14, Status: spb.ProblemStatusAccepted},
+	})
+	watcher.pageSize = 2
+
+	ctx := context.Background()
+	now := time.Now()
+	messages := []*Message{
+		{Id: "changed", UserId: 1, ProblemId: 10, ProblemStatus: "accepted", ProblemCheckedAt: now.Add(-time.Hour)},
+		{Id: "closed", UserId: 2, ProblemId: 11, ProblemStatus: "closed", ProblemCheckedAt: now.Add(-3 * time.Hour)},
+		{Id: "new", UserId: 3, ProblemId: 12},
+		// the portal doesn't return the problem, so it's checked again in the next page
+		{Id: "missing", UserId: 4, ProblemId: 13, ProblemStatus: "accepted", ProblemCheckedAt: now.Add(-2 * time.Hour)},
+		{Id: "same", UserId: 5, ProblemId: 14, ProblemStatus: "accepted", ProblemCheckedAt: now.Add(-30 * time.Minute)},
+	}
+	for _, message := range messages {
+		message.CreatedAt = now
+		message.Status = StatusSent
+		if !assert.NoError(t, watcher.queue.Add(ctx, message)) {
+			return
+		}
+	}
+
+	watcher.checkProblems(ctx)
+
+	assert.Equal(t, []int64{12, 13, 13, 10, 13, 14, 13}, watcher.spbClient.(*problemClient).requested)
+	notifications := watcher.notifier.(*problemNotifier).notifications
+	assert.Len(t, notifications, 1)
+	assert.Len(t, notifications[1], 1)
+}
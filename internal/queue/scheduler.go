@@ -0,0 +1,179 @@
+package queue
+
+import (
+	"expvar"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// backlogLimit is the maximum number of ready messages read at once
+const backlogLimit = 1000
+
+var (
+	// backlogMetric is the number of ready messages of each user
+	backlogMetric = expvar.NewMap("queue_backlog")
+	// inFlightMetric is the number of messages being sent at the moment
+	inFlightMetric = expvar.NewInt("queue_in_flight")
+)
+
+// scheduler Decides which message is sent next when several senders work concurrently.
+// Users are served in turns, so that a user with a long queue doesn't delay messages of other users.
+// A portal account sends one message at a time. The scheduler tracks the accounts busy in this instance only,
+// the sender leases them in the user state to exclude the other instances
+type scheduler struct {
+	mutex sync.Mutex
+	// backlog is the last read list of ready messages, it's reread once in refreshInterval
+	backlog         []*Message
+	refreshedAt     time.Time
+	refreshInterval time.Duration
+	// truncated is set when the backlog was limited by backlogLimit, so more messages may be ready to send
+	truncated    bool
+	lastUserId   int64
+	busyAccounts map[string]bool
+	// waitingUsers have all their accounts busy, they are skipped until one of the accounts is released
+	waitingUsers map[int64]bool
+}
+
+func newScheduler(refreshInterval time.Duration) *scheduler {
+	return &scheduler{
+		refreshInterval: refreshInterval,
+		busyAccounts:    map[string]bool{},
+		waitingUsers:    map[int64]bool{},
+	}
+}
+
+// needsRefresh Checks whether the backlog is outdated. A backlog that was read in full is not reread before
+// refreshInterval passes even when there is nothing to send from it, so an idle sender doesn't query the storage
+// on every poll
+func (s *scheduler) needsRefresh(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.refreshedAt.Add(s.refreshInterval).Before(now) {
+		return true
+	}
+
+	return s.truncated && len(scheduleMessages(s.backlog, s.lastUserId, s.waitingUsers, now)) == 0
+}
+
+func (s *scheduler) setBacklog(backlog []*Message, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.backlog = backlog
+	s.refreshedAt = now
+	s.truncated = len(backlog) >= backlogLimit
+	// the users are checked again, in case an account was released before the user started waiting
+	clear(s.waitingUsers)
+
+	backlogMetric.Init()
+	for _, message := range backlog {
+		backlogMetric.Add(strconv.FormatInt(message.UserId, 10), 1)
+	}
+}
+
+// candidates Returns the next message of each user in the order they should be tried
+func (s *scheduler) candidates(now time.Time) []*Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return scheduleMessages(s.backlog, s.lastUserId, s.waitingUsers, now)
+}
+
+// taken Removes the candidate from the backlog. The user is served when the sender managed to lease the message
+func (s *scheduler) taken(candidate *Message, served bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.backlog = lo.Without(s.backlog, candidate)
+	if served {
+		s.lastUserId = candidate.UserId
+	}
+}
+
+// reserveAccount Returns false when the account is sending another message
+func (s *scheduler) reserveAccount(login string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.busyAccounts[login] {
+		return false
+	}
+
+	s.busyAccounts[login] = true
+	inFlightMetric.Add(1)
+	return true
+}
+
+func (s *scheduler) releaseAccount(userId int64, login string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.busyAccounts, login)
+	delete(s.waitingUsers, userId)
+	inFlightMetric.Add(-1)
+}
+
+func (s *scheduler) isAccountBusy(login string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.busyAccounts[login]
+}
+
+// waitForAccount Skips the user until one of the user's accounts is released
+func (s *scheduler) waitForAccount(userId int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.waitingUsers[userId] = true
+}
+
+// scheduleMessages Takes the first ready message of each user, priority messages go first.
+// Users are ordered by id starting from the one after the last served user
+func scheduleMessages(backlog []*Message, lastUserId int64, waitingUsers map[int64]bool, now time.Time) []*Message {
+	heads := map[int64]*Message{}
+	for _, message := range backlog {
+		if !message.isReady(now) || waitingUsers[message.UserId] {
+			continue
+		}
+
+		head, exists := heads[message.UserId]
+		if !exists || isSentBefore(message, head) {
+			heads[message.UserId] = message
+		}
+	}
+
+	result := lo.Values(heads)
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Priority != result[j].Priority {
+			return result[i].Priority
+		}
+
+		iAfterLast := result[i].UserId > lastUserId
+		jAfterLast := result[j].UserId > lastUserId
+		if iAfterLast != jAfterLast {
+			return iAfterLast
+		}
+
+		return result[i].UserId < result[j].UserId
+	})
+	return result
+}
+
+// isSentBefore Orders messages of a single user: priority messages go first, then the ones waiting the longest
+func isSentBefore(a *Message, b *Message) bool {
+	if a.Priority != b.Priority {
+		return a.Priority
+	}
+
+	if !a.RetryAfter.Equal(b.RetryAfter) {
+		return a.RetryAfter.Before(b.RetryAfter)
+	}
+
+	return a.Id < b.Id
+}
@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleMessages(t *testing.T) {
+	now := time.Now()
+	message := func(id string, userId int64, retryAfter time.Time) *Message {
+		return &Message{Id: id, UserId: userId, RetryAfter: retryAfter, Status: StatusCreated}
+	}
+	ids := func(messages []*Message) []string {
+		return lo.Map(messages, func(item *Message, _ int) string {
+			return item.Id
+		})
+	}
+
+	backlog := []*Message{
+		message("1-b", 1, now.Add(-time.Minute)),
+		message("1-a", 1, now.Add(-time.Hour)),
+		message("1-c", 1, now.Add(-time.Hour)),
+		message("2-a", 2, now.Add(-time.Minute)),
+		message("3-later", 3, now.Add(time.Hour)),
+		message("4-a", 4, now.Add(-time.Minute)),
+	}
+
+	t.Run("OneMessagePerUserInTurns", func(t *testing.T) {
+		assert.Equal(t, []string{"1-a", "2-a", "4-a"}, ids(scheduleMessages(backlog, 0, nil, now)))
+		assert.Equal(t, []string{"2-a", "4-a", "1-a"}, ids(scheduleMessages(backlog, 1, nil, now)))
+		assert.Equal(t, []string{"1-a", "2-a", "4-a"}, ids(scheduleMessages(backlog, 4, nil, now)))
+	})
+
+	t.Run("PriorityMessagesGoFirst", func(t *testing.T) {
+		priorityMessage := message("2-b", 2, now)
+		priorityMessage.Priority = true
+		withPriority := append([]*Message{priorityMessage}, backlog...)
+		assert.Equal(t, []string{"2-b", "4-a", "1-a"}, ids(scheduleMessages(withPriority, 2, nil, now)))
+	})
+
+	t.Run("WaitingUsersAreSkipped", func(t *testing.T) {
+		waitingUsers := map[int64]bool{1: true}
+		assert.Equal(t, []string{"2-a", "4-a"}, ids(scheduleMessages(backlog, 0, waitingUsers, now)))
+	})
+}
+
+func TestSchedulerReservesAccounts(t *testing.T) {
+	s := newScheduler(time.Minute)
+	assert.True(t, s.reserveAccount("login"))
+	assert.False(t, s.reserveAccount("login"))
+	assert.True(t, s.reserveAccount("other"))
+
+	s.waitForAccount(1)
+	assert.Empty(t, s.candidates(time.Now()))
+	s.setBacklog([]*Message{{Id: "1-a", UserId: 1, Status: StatusCreated}}, time.Now())
+	s.waitForAccount(1)
+	assert.Empty(t, s.candidates(time.Now()))
+
+	s.releaseAccount(1, "login")
+	assert.Len(t, s.candidates(time.Now()), 1)
+	assert.True(t, s.reserveAccount("login"))
+}
+
+func TestSchedulerRefreshesIdleBacklogOncePerInterval(t *testing.T) {
+	now := time.Now()
+	s := newScheduler(time.Minute)
+	assert.True(t, s.needsRefresh(now))
+
+	s.setBacklog(nil, now)
+	assert.False(t, s.needsRefresh(now.Add(time.Second)))
+	assert.True(t, s.needsRefresh(now.Add(2*time.Minute)))
+
+	truncated := lo.Times(backlogLimit, func(i int) *Message {
+		return &Message{Id: strconv.Itoa(i), UserId: 1, Status: StatusCreated}
+	})
+	s.setBacklog(truncated, now)
+	assert.False(t, s.needsRefresh(now.Add(time.Second)))
+	s.waitForAccount(1)
+	assert.True(t, s.needsRefresh(now.Add(time.Second)), "more messages may be ready beyond the limit")
+}
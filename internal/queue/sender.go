@@ -1,12 +1,15 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joomcode/errorx"
+	"github.com/lithammer/shortuuid/v4"
 	"github.com/mih-kopylov/our-spb-bot/internal/bot/service"
 	"github.com/mih-kopylov/our-spb-bot/internal/config"
 	"github.com/mih-kopylov/our-spb-bot/internal/spb"
@@ -23,21 +26,59 @@ type MessageSender struct {
 	spbClient          spb.Client
 	api                *tgbotapi.BotAPI
 	service            *service.Service
+	failureNotifier    FailureNotifier
+	accountNotifier    AccountNotifier
 	enabled            bool
 	sleepDuration      time.Duration
 	inactivityDuration time.Duration
+	leaseDuration      time.Duration
+	ackRetryDelay      time.Duration
+	workersCount       int
+	workers            []*util.Worker
+	scheduler          *scheduler
+	// refreshMutex makes only one worker read the backlog at a time
+	refreshMutex sync.Mutex
 }
 
+// FailureNotifier is told about the messages that are not going to be sent anymore
+type FailureNotifier interface {
+	MessageFailed(message *Message)
+}
+
+// AccountNotifier is told about the accounts that can't send messages anymore or for a while
+type AccountNotifier interface {
+	AccountDisabled(userId int64, login string)
+	AccountRateLimited(userId int64, login string, until time.Time)
+	AccountQuotaExhausted(userId int64, login string, until time.Time)
+}
+
+const (
+	// storeTimeout limits storing the outcome of a message when sending is cancelled on shutdown
+	storeTimeout = 10 * time.Second
+	// ackRetryDelay is the first delay between acknowledgement attempts, it doubles up to ackRetryMaxDelay
+	ackRetryDelay    = time.Second
+	ackRetryMaxDelay = 30 * time.Second
+	// portalUnavailableDelay is the time to wait for the portal to recover after it failed to process a message
+	portalUnavailableDelay = 10 * time.Minute
+	// storageFailureDelay is the first delay of a message that failed to be sent because of the storage,
+	// it doubles with every next attempt failed the same way up to storageFailureMaxDelay
+	storageFailureDelay    = time.Minute
+	storageFailureMaxDelay = time.Hour
+)
+
 var (
 	Errors                    = errorx.NewNamespace("Sender")
 	ErrNoAccounts             = Errors.NewType("NoAccounts")
 	ErrAllAccountsDisabled    = Errors.NewType("AllAccountsDisabled")
 	ErrAllAccountsRateLimited = Errors.NewType("AllAccountsRateLimited")
+	ErrAllAccountsBusy        = Errors.NewType("AllAccountsBusy")
+	ErrLeaseLost              = Errors.NewType("LeaseLost")
 )
 
 func NewMessageSender(
 	logger *zap.Logger, conf *config.Config, states state.States, queue MessageQueue, spbClient spb.Client,
-	api *tgbotapi.BotAPI, service *service.Service,
+	api *tgbotapi.BotAPI, service *service.Service, failureNotifier FailureNotifier,
+	accountNotifier AccountNotifier,
 ) *MessageSender {
 	return &MessageSender{
 		logger:             logger,
@@ -46,54 +87,83 @@ func NewMessageSender(
 		spbClient:          spbClient,
 		api:                api,
 		service:            service,
+		failureNotifier:    failureNotifier,
+		accountNotifier:    accountNotifier,
 		enabled:            conf.SenderEnabled,
 		sleepDuration:      conf.SenderSleepDuration,
 		inactivityDuration: conf.InactivityDuration,
+		leaseDuration:      conf.QueueLeaseDuration,
+		ackRetryDelay:      ackRetryDelay,
+		workersCount:       conf.SenderWorkers,
+		scheduler:          newScheduler(conf.SenderSleepDuration),
 	}
 }
 
-func (s *MessageSender) Start() error {
+func (s *MessageSender) Start(_ context.Context) error {
 	if s.enabled {
-		s.logger.Info("starting sender")
-		go func() {
-			for {
-				s.sendNextMessage()
-			}
-		}()
+		s.logger.Info("starting sender", zap.Int("workers", s.workersCount))
+		for range s.workersCount {
+			s.workers = append(s.workers, util.StartWorker(s.sendNextMessage))
+		}
 	} else {
 		s.logger.Warn("sender is disabled")
 	}
 	return nil
 }
 
-func (s *MessageSender) sendNextMessage() {
+// Stop Waits for the messages being sent. When it takes too long, sending is cancelled and the messages are returned
+func (s *MessageSender) Stop(ctx context.Context) error {
+	if len(s.workers) == 0 {
+		return nil
+	}
+
+	s.logger.Info("stopping sender")
+	errs := make([]error, len(s.workers))
+	wg := sync.WaitGroup{}
+	for i, worker := range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = worker.Stop(ctx)
+		}()
+	}
+	wg.Wait()
+
+	errs = lo.Compact(errs)
+	if len(errs) > 0 {
+		return errorx.DecorateMany("failed to stop sender workers", errs...)
+	}
+
+	return nil
+}
+
+// sendNextMessage Sends a single message and returns how long to sleep before the next one
+func (s *MessageSender) sendNextMessage(ctx context.Context) time.Duration {
 	s.logger.Debug("polling messages")
-	message, err := s.queue.Poll()
+	message, err := s.nextMessage(ctx)
 	if err != nil {
 		s.logger.Error(
 			"failed to poll next message",
 			zap.Duration("sleep", s.sleepDuration),
 			zap.Error(err),
 		)
-		time.Sleep(s.sleepDuration)
-		return
+		return s.sleepDuration
 	}
 	if message == nil {
 		s.logger.Debug("no messages found, sleeping for " + s.sleepDuration.String())
-		time.Sleep(s.sleepDuration)
-		return
+		return s.sleepDuration
 	}
 
 	s.logger.Debug("message found", zap.String("id", message.Id))
 
-	userState, err := s.states.GetState(message.UserId)
+	userState, err := s.states.GetState(ctx, message.UserId)
 	if err != nil {
 		s.logger.Error(
 			"failed to get user state",
 			zap.Error(err),
 		)
-		s.returnMessage(message, StatusFailed, "failed to get user state")
-		return
+		s.delayAfterStorageFailure(ctx, message, NewAttempt("", err, DecisionDelay, "failed to get user state"))
+		return 0
 	}
 
 	if userState.LastAccessAt.Add(s.inactivityDuration).After(time.Now()) {
@@ -103,19 +173,28 @@ func (s *MessageSender) sendNextMessage() {
 			zap.Duration("period", s.inactivityDuration),
 		)
 		message.RetryAfter = time.Now().Add(s.inactivityDuration)
-		s.returnMessage(message, StatusCreated, "wait for user inactivity period")
-		return
+		s.returnMessage(ctx, message, StatusCreated, "wait for user inactivity period")
+		return 0
 	}
 
-	account, appropriateAccountsCount, err := s.chooseAccount(userState, message)
+	account, appropriateAccountsCount, err := s.chooseAccount(ctx, userState, message)
 	if err != nil {
+		if errorx.IsOfType(err, ErrAllAccountsBusy) {
+			s.logger.Debug(
+				"all accounts are busy",
+				zap.String("id", message.Id),
+			)
+			s.scheduler.waitForAccount(message.UserId)
+			s.putBack(ctx, message)
+			return 0
+		}
 		if errorx.IsOfType(err, ErrNoAccounts) || errorx.IsOfType(err, ErrAllAccountsDisabled) {
 			s.logger.Error(
 				"failed to choose an account",
 				zap.Error(err),
 			)
-			s.returnMessage(message, StatusFailed, "no authorized accounts found")
-			return
+			s.returnMessageWithAttempt(ctx, message, NewAttempt("", err, DecisionFail, "no authorized accounts found"))
+			return 0
 		}
 		if errorx.IsOfType(err, ErrAllAccountsRateLimited) {
 			s.logger.Info(
@@ -128,30 +207,65 @@ func (s *MessageSender) sendNextMessage() {
 					return item.State == state.AccountStateEnabled
 				},
 			)
+			now := time.Now()
 			message.RetryAfter = lo.MinBy(
-				enabledAccounts, func(a state.Account, b state.Account) bool {
-					return a.RateLimitedUntil.Before(b.RateLimitedUntil)
+				lo.Map(enabledAccounts, func(item state.Account, _ int) time.Time {
+					return item.AvailableFrom(now)
+				}), func(a time.Time, b time.Time) bool {
+					return a.Before(b)
 				},
-			).RateLimitedUntil
-			s.returnMessage(message, StatusCreated, "user is rate limited")
-			return
+			)
+			s.returnMessageWithAttempt(ctx, message, NewAttempt("", err, DecisionDelay, "user is rate limited"))
+			return 0
 		}
+		if errorx.IsOfType(err, ErrPinnedAccountRateLimited) {
+			s.logger.Info(
+				"pinned account is rate limited",
+				zap.String("id", message.Id),
+			)
+
+			pinnedAccounts := lo.Filter(
+				userState.Accounts, func(item state.Account, _ int) bool {
+					return item.State == state.AccountStateEnabled && item.IsPinned(message.CategoryId)
+				},
+			)
+			now := time.Now()
+			message.RetryAfter = lo.MinBy(
+				lo.Map(pinnedAccounts, func(item state.Account, _ int) time.Time {
+					return item.AvailableFrom(now)
+				}), func(a time.Time, b time.Time) bool {
+					return a.Before(b)
+				},
+			)
+			s.returnMessageWithAttempt(ctx, message, NewAttempt("", err, DecisionDelay, "pinned account is rate limited"))
+			return 0
+		}
+		s.logger.Error(
+			"failed to choose an account",
+			zap.Error(err),
+		)
+		s.delayAfterStorageFailure(ctx, message, NewAttempt("", err, DecisionDelay, "failed to choose an account"))
+		return 0
 	}
 
+	defer s.releaseAccount(ctx, message.UserId, account)
+
 	s.logger.Debug(
 		"creating a request",
 		zap.String("id", message.Id),
 	)
 	request, err := s.spbClient.CreateSendProblemRequest(
-		message.CategoryId, message.Text, message.Latitude, message.Longitude,
+		ctx, message.CategoryId, message.Text, message.Latitude, message.Longitude, message.BuildingId,
 	)
 	if err != nil {
 		s.logger.Error(
 			"failed to create a request",
 			zap.Error(err),
 		)
-		s.returnMessage(message, StatusFailed, "failed to create a request: "+err.Error())
-		return
+		s.returnMessageWithAttempt(
+			ctx, message, NewAttempt(account.Login, err, DecisionFail, "failed to create a request: "+err.Error()),
+		)
+		return 0
 	}
 
 	s.logger.Debug(
@@ -164,23 +278,94 @@ func (s *MessageSender) sendNextMessage() {
 			"failed to get message files",
 			zap.Error(err),
 		)
-		s.returnMessage(message, StatusFailed, "failed to get messages files "+err.Error())
-		return
+		s.returnMessageWithAttempt(
+			ctx, message, NewAttempt(account.Login, err, DecisionFail, "failed to get messages files "+err.Error()),
+		)
+		return 0
+	}
+
+	err = s.queue.Extend(ctx, message, s.leaseDuration)
+	if err != nil {
+		// the message might have been reaped and taken by another sender, it must not be sent twice
+		s.logger.Error(
+			"failed to extend message lease",
+			zap.String("id", message.Id),
+			zap.Error(err),
+		)
+		return 0
+	}
+
+	err = s.extendAccount(ctx, message.UserId, account)
+	if err != nil {
+		// another sender might be using the account already
+		s.logger.Error(
+			"failed to extend account lease",
+			zap.String("id", message.Id),
+			zap.String("login", account.Login),
+			zap.Error(err),
+		)
+		s.putBack(ctx, message)
+		return 0
 	}
 
 	s.logger.Debug(
 		"sending message",
 		zap.String("id", message.Id),
 	)
-	sentMessageResponse, err := s.spbClient.Send(account.Token, request, files)
+	sentMessageResponse, err := s.spbClient.Send(ctx, account.Token, request, files)
+	if err != nil && ctx.Err() != nil {
+		// not an account or message problem, so the attempt isn't counted
+		s.logger.Warn(
+			"sending is cancelled on shutdown",
+			zap.String("id", message.Id),
+		)
+		s.returnMessage(ctx, message, StatusCreated, "sending is cancelled on shutdown")
+		return 0
+	}
 	if err != nil {
 		s.logger.Warn(
 			"failed to send message",
 			zap.String("id", message.Id),
 			zap.Error(err),
 		)
-		s.handleMessageSendingError(err, userState, account, appropriateAccountsCount, message)
-		return
+		s.handleMessageSendingError(ctx, err, userState, account, appropriateAccountsCount, message)
+		return 0
+	}
+
+	// the message is sent already, so the result has to be stored even on shutdown
+	ctx, cancel := detach(ctx)
+	defer cancel()
+
+	message.ProblemId = int64(sentMessageResponse.Id)
+	message.SentBy = account.Login
+	message.SentAt = time.Now()
+	err = s.ackMessage(ctx, message)
+	if err != nil {
+		s.logger.Error(
+			"failed to acknowledge sent message",
+			zap.String("id", message.Id),
+			zap.Error(err),
+		)
+	}
+
+	quotaExhausted := false
+	_, err = s.states.Update(ctx, userState.UserId, func(storedState *state.UserState) error {
+		storedState.SentMessagesCount++
+		storedAccount := storedState.FindAccount(account.Login)
+		if storedAccount != nil {
+			storedAccount.RecordSent(message.SentAt)
+			quotaExhausted = storedAccount.QuotaExhausted(message.SentAt)
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error(
+			"failed to update user state",
+			zap.Error(err),
+		)
+	}
+	if quotaExhausted {
+		s.accountNotifier.AccountQuotaExhausted(message.UserId, account.Login, account.NextQuotaReset(message.SentAt))
 	}
 
 	err = s.service.SendMessage(
@@ -188,10 +373,10 @@ func (s *MessageSender) sendNextMessage() {
 			`Обращение отправлено.
 Пользователь: %v
 Id: %v
-Ссылка: https://gorod.gov.spb.ru/problems/%v/`,
-			account.Login,
+Ссылка: %v`,
+			message.SentBy,
 			message.Id,
-			sentMessageResponse.Id,
+			message.ProblemUrl(),
 		),
 	)
 	if err != nil {
@@ -200,80 +385,94 @@ Id: %v
 			zap.String("id", message.Id),
 			zap.Error(err),
 		)
-		return
-	}
-
-	userState.SentMessagesCount++
-	err = s.states.SetState(userState)
-	if err != nil {
-		s.logger.Error(
-			"failed to set user state",
-			zap.Error(err),
-		)
+		return 0
 	}
 
 	s.logger.Debug(
 		"message sent",
 		zap.String("id", message.Id),
 	)
+	return 0
 }
 
 func (s *MessageSender) handleMessageSendingError(
-	err error, userState *state.UserState, account *state.Account, appropriateAccountsCount int, message *Message,
+	ctx context.Context, err error, userState *state.UserState, account *state.Account, appropriateAccountsCount int, message *Message,
 ) {
 	if errorx.IsOfType(err, spb.ErrUnauthorized) {
-		account.Token = ""
-		err = s.states.SetState(userState)
-		if err != nil {
+		expiredToken := account.Token
+		stateErr := s.updateAccount(ctx, userState, account, func(account *state.Account) {
+			// the token might have been already refreshed concurrently
+			if account.Token == expiredToken {
+				account.Token = ""
+			}
+		})
+		if stateErr != nil {
 			s.logger.Error(
-				"failed to set user state",
-				zap.Error(err),
+				"failed to update user state",
+				zap.Error(stateErr),
+			)
+			s.delayAfterStorageFailure(
+				ctx, message, NewAttempt(account.Login, stateErr, DecisionDelay, "failed to set user state"),
 			)
-			s.returnMessageIncreaseTries(message, StatusFailed, "failed to set user state: "+err.Error())
 		} else {
 			message.RetryAfter = time.Now()
-			s.returnMessageIncreaseTries(message, StatusCreated, "token expired")
+			s.returnMessageIncreaseTries(ctx, message, NewAttempt(account.Login, err, DecisionRetry, "token expired"))
 		}
 	} else if errorx.IsOfType(err, spb.ErrExpectingNotBuildingCoords) {
 		message.RetryAfter = time.Now()
 		message.Longitude = s.shiftLongitudeMeters(message.Latitude, message.Longitude, 50)
-		s.returnMessageIncreaseTries(message, StatusCreated, "service expects coordinates outside a building")
+		s.returnMessageIncreaseTries(
+			ctx, message,
+			NewAttempt(account.Login, err, DecisionShiftCoordinates, "service expects coordinates outside a building"),
+		)
 	} else if errorx.IsOfType(err, spb.ErrMatchesCoordsAndCategory) {
 		message.RetryAfter = time.Now().Add(time.Hour)
-		s.returnMessageIncreaseTries(message, StatusCreated, "service suspects the message is a duplicate")
+		s.returnMessageIncreaseTries(
+			ctx, message, NewAttempt(account.Login, err, DecisionDelay, "service suspects the message is a duplicate"),
+		)
+	} else if errorx.IsOfType(err, spb.ErrPortalUnavailable) {
+		message.RetryAfter = time.Now().Add(portalUnavailableDelay)
+		s.returnMessageWithAttempt(ctx, message, NewAttempt(account.Login, err, DecisionDelay, "portal is unavailable"))
 	} else if errorx.IsOfType(err, spb.ErrBadRequest) {
-		s.returnMessageIncreaseTries(message, StatusFailed, err.Error())
+		s.returnMessageIncreaseTries(ctx, message, NewAttempt(account.Login, err, DecisionFail, err.Error()))
 	} else if errorx.IsOfType(err, spb.ErrTooManyRequests) {
-		year, month, day := time.Now().In(util.SpbLocation).AddDate(0, 0, 1).Date()
-		hour, minute, _ := account.RateLimitNextDayTime.In(util.SpbLocation).Clock()
-		nextTryTime := time.Date(year, month, day, hour, minute, 0, 0, util.SpbLocation)
+		nextTryTime := account.NextQuotaReset(time.Now())
 
-		account.RateLimitedUntil = nextTryTime
-		err = s.states.SetState(userState)
-		if err != nil {
+		stateErr := s.updateAccount(ctx, userState, account, func(account *state.Account) {
+			account.RateLimitedUntil = nextTryTime
+		})
+		if stateErr != nil {
 			s.logger.Error(
-				"failed to set user state",
-				zap.Error(err),
+				"failed to update user state",
+				zap.Error(stateErr),
+			)
+			s.delayAfterStorageFailure(
+				ctx, message, NewAttempt(account.Login, stateErr, DecisionDelay, "failed to set user state"),
 			)
-			s.returnMessageIncreaseTries(message, StatusFailed, "failed to set user state: "+err.Error())
 		} else {
+			s.accountNotifier.AccountRateLimited(message.UserId, account.Login, nextTryTime)
+			decision := DecisionRetry
 			if appropriateAccountsCount == 1 {
 				//delay message only in case there are no other accounts that may be used to sent it
 				message.RetryAfter = nextTryTime
+				decision = DecisionDelay
 			}
-			s.returnMessage(message, StatusCreated, "too many requests")
+			s.returnMessageWithAttempt(ctx, message, NewAttempt(account.Login, err, decision, "too many requests"))
 		}
 	} else {
-		s.returnMessageIncreaseTries(message, StatusFailed, "failed to send a message: "+err.Error())
+		s.returnMessageIncreaseTries(
+			ctx, message, NewAttempt(account.Login, err, DecisionFail, "failed to send a message: "+err.Error()),
+		)
 	}
 }
 
-func (s *MessageSender) tryReauthorize(userState *state.UserState, message *Message, account *state.Account) error {
+func (s *MessageSender) tryReauthorize(ctx context.Context, userState *state.UserState, message *Message, account *state.Account) error {
 	if account.Login == "" {
-		account.State = state.AccountStateDisabled
-		err := s.states.SetState(userState)
+		err := s.updateAccount(ctx, userState, account, func(account *state.Account) {
+			account.State = state.AccountStateDisabled
+		})
 		if err != nil {
-			return errorx.EnhanceStackTrace(err, "failed to set user state")
+			return errorx.EnhanceStackTrace(err, "failed to update user state")
 		}
 
 		return errorx.IllegalState.New("user not authorized")
@@ -284,16 +483,23 @@ func (s *MessageSender) tryReauthorize(userState *state.UserState, message *Mess
 		zap.String("id", message.Id),
 		zap.String("login", account.Login),
 	)
-	tokenResponse, err := s.spbClient.Login(account.Login, account.Password)
+	tokenResponse, err := s.spbClient.Login(ctx, account.Login, account.Password)
+	if err != nil && !errorx.IsOfType(err, spb.ErrUnauthorized) {
+		// the credentials might be valid, the portal is just not available right now
+		return errorx.EnhanceStackTrace(err, "failed to reauthorize")
+	}
 	if err != nil {
-		account.Login = ""
-		account.Password = ""
-		account.State = state.AccountStateDisabled
-		err2 := s.states.SetState(userState)
+		// the login is kept, so that the user can log in again with the same account
+		err2 := s.updateAccount(ctx, userState, account, func(account *state.Account) {
+			account.Password = ""
+			account.State = state.AccountStateDisabled
+		})
 		if err2 != nil {
-			return errorx.EnhanceStackTrace(err2, "failed to set user state")
+			return errorx.EnhanceStackTrace(err2, "failed to update user state")
 		}
 
+		s.accountNotifier.AccountDisabled(userState.UserId, account.Login)
+
 		return errorx.EnhanceStackTrace(err, "failed to reauthorize")
 	}
 
@@ -301,30 +507,79 @@ func (s *MessageSender) tryReauthorize(userState *state.UserState, message *Mess
 		"new token obtained",
 		zap.String("id", message.Id),
 	)
-	account.Token = tokenResponse.AccessToken
-	err = s.states.SetState(userState)
+	err = s.updateAccount(ctx, userState, account, func(account *state.Account) {
+		account.Token = tokenResponse.AccessToken
+	})
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state")
+		return errorx.EnhanceStackTrace(err, "failed to update user state")
 	}
 
 	return nil
 }
 
-func (s *MessageSender) returnMessageIncreaseTries(message *Message, status Status, description string) {
+// updateAccount Applies the change to the stored account and to the account the sender works with
+func (s *MessageSender) updateAccount(
+	ctx context.Context, userState *state.UserState, account *state.Account, update func(account *state.Account),
+) error {
+	login := account.Login
+	_, err := s.states.Update(ctx, userState.UserId, func(storedState *state.UserState) error {
+		storedAccount := storedState.FindAccount(login)
+		if storedAccount == nil {
+			return state.ErrAccountNotFound.New("account not found: login=%v", login)
+		}
+
+		update(storedAccount)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	update(account)
+	return nil
+}
+
+func (s *MessageSender) returnMessageIncreaseTries(ctx context.Context, message *Message, attempt Attempt) {
 	message.Tries++
 	if message.Tries >= MaxTries {
-		status = StatusFailed
+		attempt.Decision = DecisionFail
 	}
-	s.returnMessage(message, status, description)
+	s.returnMessageWithAttempt(ctx, message, attempt)
 }
 
-func (s *MessageSender) returnMessage(message *Message, status Status, description string) {
+// delayAfterStorageFailure Returns the message to be sent again once the storage recovers, without counting
+// the attempt as a failed try. The delay doubles with every consecutive attempt failed the same way
+func (s *MessageSender) delayAfterStorageFailure(ctx context.Context, message *Message, attempt Attempt) {
+	delay := storageFailureDelay
+	for i := len(message.Attempts) - 1; i >= 0 && message.Attempts[i].Description == attempt.Description; i-- {
+		delay = min(delay*2, storageFailureMaxDelay)
+	}
+
+	message.RetryAfter = attempt.At.Add(delay)
+	s.returnMessageWithAttempt(ctx, message, attempt)
+}
+
+func (s *MessageSender) returnMessageWithAttempt(ctx context.Context, message *Message, attempt Attempt) {
+	message.AddAttempt(attempt)
+	err := s.returnMessage(ctx, message, attempt.Decision.Status(), attempt.Description)
+	if err == nil && attempt.Decision == DecisionFail {
+		s.failureNotifier.MessageFailed(message)
+	}
+}
+
+func (s *MessageSender) returnMessage(ctx context.Context, message *Message, status Status, description string) error {
 	message.LastTriedAt = time.Now()
 	message.Status = status
 	message.FailDescription = description
-	err := s.queue.Add(message)
+	ctx, cancel := detach(ctx)
+	defer cancel()
+	err := s.queue.Nack(ctx, message)
 	if err != nil {
-		s.logger.Error("failed to return a failed message back to queue")
+		s.logger.Error(
+			"failed to return a failed message back to queue",
+			zap.String("id", message.Id),
+			zap.Error(err),
+		)
 	} else {
 		s.logger.Info(
 			"message returned to the queue",
@@ -333,6 +588,61 @@ func (s *MessageSender) returnMessage(message *Message, status Status, descripti
 			zap.String("failDescription", message.FailDescription),
 		)
 	}
+	return err
+}
+
+// nextMessage Leases the next message to send according to the schedule. Returns nil when there is nothing to send
+func (s *MessageSender) nextMessage(ctx context.Context) (*Message, error) {
+	err := s.refreshBacklog(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range s.scheduler.candidates(time.Now()) {
+		message, err := s.queue.Lease(ctx, candidate.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		s.scheduler.taken(candidate, message != nil)
+		if message != nil {
+			return message, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *MessageSender) refreshBacklog(ctx context.Context) error {
+	s.refreshMutex.Lock()
+	defer s.refreshMutex.Unlock()
+
+	now := time.Now()
+	if !s.scheduler.needsRefresh(now) {
+		return nil
+	}
+
+	backlog, err := s.queue.FindReadyMessages(ctx, now, backlogLimit)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to read ready messages")
+	}
+
+	s.scheduler.setBacklog(backlog, now)
+	return nil
+}
+
+// putBack Returns the message to the queue as is, the attempt isn't counted
+func (s *MessageSender) putBack(ctx context.Context, message *Message) {
+	ctx, cancel := detach(ctx)
+	defer cancel()
+	err := s.queue.Nack(ctx, message)
+	if err != nil {
+		s.logger.Error(
+			"failed to return a message back to queue",
+			zap.String("id", message.Id),
+			zap.Error(err),
+		)
+	}
 }
 
 func (s *MessageSender) getFiles(message *Message) (map[string][]byte, error) {
@@ -356,7 +666,7 @@ func (s *MessageSender) shiftLongitudeMeters(latitude float64, longitude float64
 	return longitude - (metersFloat*oneMeter)/math.Cos(latitude*(math.Pi/180))
 }
 
-func (s *MessageSender) chooseAccount(userState *state.UserState, message *Message) (*state.Account, int, error) {
+func (s *MessageSender) chooseAccount(ctx context.Context, userState *state.UserState, message *Message) (*state.Account, int, error) {
 	if len(userState.Accounts) == 0 {
 		return nil, 0, ErrNoAccounts.New("no accounts found")
 	}
@@ -372,34 +682,187 @@ func (s *MessageSender) chooseAccount(userState *state.UserState, message *Messa
 	}
 
 	var appropriateAccounts []*state.Account
+	busyAccountsCount := 0
 
-	for i, account := range userState.Accounts {
-		if account.State == state.AccountStateDisabled {
+	for _, account := range AvailableAccounts(userState, time.Now()) {
+		if s.scheduler.isAccountBusy(account.Login) {
+			busyAccountsCount++
 			continue
 		}
 
-		if account.RateLimitedUntil.After(time.Now()) {
+		appropriateAccounts = append(appropriateAccounts, account)
+	}
+
+	strategy := userState.GetAccountStrategy()
+	if strategy == state.AccountStrategyPinned && s.isPinnedAccountBusy(userState, message.CategoryId) {
+		return nil, 0, ErrAllAccountsBusy.New("pinned account is sending another message")
+	}
+
+	for {
+		account, err := NewAccountStrategy(strategy).Choose(userState, appropriateAccounts, message.CategoryId)
+		if err != nil {
+			if busyAccountsCount > 0 && errorx.IsOfType(err, ErrAllAccountsRateLimited) {
+				return nil, 0, ErrAllAccountsBusy.New("all available accounts are sending other messages")
+			}
+			return nil, 0, err
+		}
+
+		pinned := strategy == state.AccountStrategyPinned && account.IsPinned(message.CategoryId)
+		appropriateAccounts = lo.Without(appropriateAccounts, account)
+
+		// the account is reserved before the token is refreshed, so that no other sender logs in with it meanwhile
+		err = s.reserveAccount(ctx, userState, account)
+		if err != nil {
+			if !errorx.IsOfType(err, ErrAllAccountsBusy) || pinned {
+				return nil, 0, err
+			}
+
+			busyAccountsCount++
 			continue
 		}
 
 		if account.Token == "" {
-			err := s.tryReauthorize(userState, message, &userState.Accounts[i])
+			err := s.tryReauthorize(ctx, userState, message, account)
 			if err != nil {
 				s.logger.Warn(
 					"failed to authorize with account",
 					zap.String("id", message.Id),
 					zap.String("login", account.Login),
 				)
+				s.releaseAccount(ctx, userState.UserId, account)
 				continue
 			}
 		}
 
-		appropriateAccounts = append(appropriateAccounts, &userState.Accounts[i])
+		if pinned {
+			// no other account may be used for a pinned category
+			return account, 1, nil
+		}
+
+		// busy accounts may send the message later too
+		return account, len(appropriateAccounts) + 1 + busyAccountsCount, nil
+	}
+}
+
+// reserveAccount Makes the account send only this message. The account is leased in the user state,
+// so that other bot instances don't send with it meanwhile
+func (s *MessageSender) reserveAccount(ctx context.Context, userState *state.UserState, account *state.Account) error {
+	if !s.scheduler.reserveAccount(account.Login) {
+		return ErrAllAccountsBusy.New("account is sending another message: login=%v", account.Login)
+	}
+
+	leaseId := shortuuid.New()
+	err := s.leaseAccount(ctx, userState.UserId, account.Login, func(storedAccount *state.Account, now time.Time) error {
+		if storedAccount.IsSending(now) {
+			return ErrAllAccountsBusy.New("account is sending another message: login=%v", account.Login)
+		}
+
+		storedAccount.SendingLeaseId = leaseId
+		storedAccount.SendingLeaseExpiresAt = now.Add(s.leaseDuration)
+		return nil
+	})
+	if err != nil {
+		s.scheduler.releaseAccount(userState.UserId, account.Login)
+		return err
+	}
+
+	account.SendingLeaseId = leaseId
+	return nil
+}
+
+// extendAccount Prolongs the account lease of a message that is still being sent
+func (s *MessageSender) extendAccount(ctx context.Context, userId int64, account *state.Account) error {
+	return s.leaseAccount(ctx, userId, account.Login, func(storedAccount *state.Account, now time.Time) error {
+		if storedAccount.SendingLeaseId != account.SendingLeaseId {
+			return ErrLeaseLost.New("account is not leased anymore: login=%v", account.Login)
+		}
+
+		storedAccount.SendingLeaseExpiresAt = now.Add(s.leaseDuration)
+		return nil
+	})
+}
+
+func (s *MessageSender) releaseAccount(ctx context.Context, userId int64, account *state.Account) {
+	defer s.scheduler.releaseAccount(userId, account.Login)
+
+	ctx, cancel := detach(ctx)
+	defer cancel()
+	err := s.leaseAccount(ctx, userId, account.Login, func(storedAccount *state.Account, _ time.Time) error {
+		if storedAccount.SendingLeaseId == account.SendingLeaseId {
+			storedAccount.SendingLeaseId = ""
+			storedAccount.SendingLeaseExpiresAt = time.Time{}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error(
+			"failed to release account",
+			zap.Int64("userId", userId),
+			zap.String("login", account.Login),
+			zap.Error(err),
+		)
+	}
+}
+
+func (s *MessageSender) leaseAccount(
+	ctx context.Context, userId int64, login string, update func(storedAccount *state.Account, now time.Time) error,
+) error {
+	_, err := s.states.Update(ctx, userId, func(storedState *state.UserState) error {
+		storedAccount := storedState.FindAccount(login)
+		if storedAccount == nil {
+			return state.ErrAccountNotFound.New("account not found: login=%v", login)
+		}
+
+		return update(storedAccount, time.Now())
+	})
+	return err
+}
+
+func (s *MessageSender) isPinnedAccountBusy(userState *state.UserState, categoryId int64) bool {
+	return lo.ContainsBy(userState.Accounts, func(account state.Account) bool {
+		return account.State == state.AccountStateEnabled && account.IsPinned(categoryId) &&
+			s.scheduler.isAccountBusy(account.Login)
+	})
+}
+
+// ackMessage Acknowledges a message sent to the portal. The lease is extended first and the acknowledgement
+// is retried until the lease expires, because a message with an expired lease is reaped and sent again
+func (s *MessageSender) ackMessage(ctx context.Context, message *Message) error {
+	err := s.queue.Extend(ctx, message, s.leaseDuration)
+	if err != nil {
+		s.logger.Warn(
+			"failed to extend lease of a sent message",
+			zap.String("id", message.Id),
+			zap.Error(err),
+		)
 	}
 
-	if len(appropriateAccounts) == 0 {
-		return nil, 0, ErrAllAccountsRateLimited.New("all accounts are rate limited")
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), message.LeaseExpiresAt)
+	defer cancel()
+
+	delay := s.ackRetryDelay
+	for {
+		err = s.queue.Ack(ctx, message)
+		if err == nil || errorx.IsOfType(err, ErrLeaseLost) {
+			return err
+		}
+
+		s.logger.Warn(
+			"failed to acknowledge sent message, retrying",
+			zap.String("id", message.Id),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, ackRetryMaxDelay)
 	}
+}
 
-	return appropriateAccounts[0], len(appropriateAccounts), nil
+// detach Returns a context that is not cancelled on shutdown, so that the outcome of a message is never lost
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), storeTimeout)
 }
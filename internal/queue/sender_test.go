@@ -1 +1,247 @@
 package queue
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestNewAttempt(t *testing.T) {
+	err := spb.ErrTooManyRequests.New("too many requests").WithProperty(spb.PropertyStatusCode, http.StatusBadRequest)
+	actual := NewAttempt("login", err, DecisionDelay, "too many requests")
+	assert.Equal(t, "login", actual.Login)
+	assert.Equal(t, "OurSpbHttp.TooManyRequests", actual.ErrorType)
+	assert.Equal(t, http.StatusBadRequest, actual.HttpStatus)
+	assert.Equal(t, DecisionDelay, actual.Decision)
+	assert.Equal(t, StatusCreated, actual.Decision.Status())
+}
+
+func TestNewAttemptWithoutError(t *testing.T) {
+	actual := NewAttempt("", nil, DecisionFail, "no authorized accounts found")
+	assert.Equal(t, "", actual.ErrorType)
+	assert.Equal(t, 0, actual.HttpStatus)
+	assert.Equal(t, StatusFailed, actual.Decision.Status())
+}
+
+func TestAddAttemptKeepsLatestAttempts(t *testing.T) {
+	message := &Message{}
+	for i := 0; i < MaxAttempts+2; i++ {
+		message.AddAttempt(NewAttempt(fmt.Sprint(i), nil, DecisionDelay, "user is rate limited"))
+	}
+
+	if assert.Len(t, message.Attempts, MaxAttempts) {
+		assert.Equal(t, "2", message.Attempts[0].Login)
+		assert.Equal(t, fmt.Sprint(MaxAttempts+1), message.Attempts[MaxAttempts-1].Login)
+	}
+}
+
+// failingAckQueue fails a number of acknowledgements, letting the reaper run meanwhile
+type failingAckQueue struct {
+	MessageQueue
+	failures int
+	acks     int
+}
+
+func (q *failingAckQueue) Ack(ctx context.Context, message *Message) error {
+	q.acks++
+	if q.acks > q.failures {
+		return q.MessageQueue.Ack(ctx, message)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	_, err := q.MessageQueue.ReapExpiredLeases(ctx)
+	if err != nil {
+		return err
+	}
+	return errorx.ExternalError.New("storage is unavailable")
+}
+
+func TestAckMessageRetriesUntilAcknowledged(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the lease taken by the queue expires while the first acknowledgement fails
+	boltQueue, err := NewBoltQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: 10 * time.Millisecond}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	message := &Message{Id: "a", UserId: 1, CreatedAt: time.Now(), Status: StatusCreated}
+	if !assert.NoError(t, boltQueue.Add(ctx, message)) {
+		return
+	}
+
+	message, err = boltQueue.Lease(ctx, message.Id)
+	if !assert.NoError(t, err) || !assert.NotNil(t, message) {
+		return
+	}
+
+	queue := &failingAckQueue{MessageQueue: boltQueue, failures: 2}
+	sender := &MessageSender{
+		logger:        log.NewLogger(),
+		queue:         queue,
+		leaseDuration: time.Minute,
+		ackRetryDelay: time.Millisecond,
+	}
+	assert.NoError(t, sender.ackMessage(ctx, message))
+	assert.Equal(t, 3, queue.acks)
+
+	stored, err := boltQueue.GetMessage(ctx, message.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSent, stored.Status)
+	}
+
+	reaped, err := boltQueue.ReapExpiredLeases(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, reaped)
+
+	leased, err := boltQueue.Lease(ctx, message.Id)
+	assert.NoError(t, err)
+	assert.Nil(t, leased, "the sent message must not be sent again")
+}
+
+type loginClient struct {
+	spb.Client
+	logins int
+}
+
+func (c *loginClient) Login(_ context.Context, _ string, _ string) (*spb.TokenResponse, error) {
+	c.logins++
+	return &spb.TokenResponse{AccessToken: "token"}, nil
+}
+
+func TestReserveAccountAcrossSenders(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cipher, err := secret.ParseKeys(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := state.NewBoltStates(log.NewLogger(), db, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	userState, err := states.Update(ctx, 1, func(userState *state.UserState) error {
+		userState.Accounts = []state.Account{{Login: "login", Password: "password", State: state.AccountStateEnabled}}
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the senders of two bot instances share the storage only
+	client := &loginClient{}
+	newSender := func() *MessageSender {
+		return &MessageSender{
+			logger:        log.NewLogger(),
+			states:        states,
+			spbClient:     client,
+			leaseDuration: time.Minute,
+			scheduler:     newScheduler(time.Minute),
+		}
+	}
+	first := newSender()
+	second := newSender()
+	message := &Message{Id: "a", UserId: 1}
+
+	// the second sender read the state before the first one refreshed the token
+	otherState, err := states.GetState(ctx, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	account, _, err := first.chooseAccount(ctx, userState, message)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, _, err = second.chooseAccount(ctx, otherState, message)
+	assert.True(t, errorx.IsOfType(err, ErrAllAccountsBusy))
+	assert.Equal(t, 1, client.logins, "a busy account must not be logged in with")
+
+	first.releaseAccount(ctx, 1, account)
+	otherState, err = states.GetState(ctx, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, err = second.chooseAccount(ctx, otherState, message)
+	assert.NoError(t, err)
+}
+
+type failingStates struct {
+	state.States
+}
+
+func (s *failingStates) GetState(_ context.Context, _ int64) (*state.UserState, error) {
+	return nil, errorx.ExternalError.New("storage is unavailable")
+}
+
+func TestSenderDelaysMessageWhenStorageFails(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	boltQueue, err := NewBoltQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: time.Minute}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	message := &Message{Id: "a", UserId: 1, CreatedAt: time.Now(), Status: StatusCreated}
+	if !assert.NoError(t, boltQueue.Add(ctx, message)) {
+		return
+	}
+
+	sender := &MessageSender{
+		logger:        log.NewLogger(),
+		states:        &failingStates{},
+		queue:         boltQueue,
+		leaseDuration: time.Minute,
+		scheduler:     newScheduler(0),
+	}
+	for _, expectedDelay := range []time.Duration{storageFailureDelay, 2 * storageFailureDelay} {
+		sender.sendNextMessage(ctx)
+
+		stored, err := boltQueue.GetMessage(ctx, message.Id)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		attempt := stored.Attempts[len(stored.Attempts)-1]
+		assert.Equal(t, StatusCreated, stored.Status)
+		assert.Equal(t, DecisionDelay, attempt.Decision)
+		assert.Zero(t, stored.Tries)
+		assert.WithinDuration(t, attempt.At.Add(expectedDelay), stored.RetryAfter, time.Second)
+
+		// the storage is expected to recover by the next attempt
+		stored.RetryAfter = time.Now()
+		if !assert.NoError(t, boltQueue.UpdateMessage(ctx, stored)) {
+			return
+		}
+	}
+}
@@ -1,37 +1,279 @@
 package queue
 
 import (
+	"context"
+	"fmt"
 	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/mih-kopylov/our-spb-bot/internal/spb"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 )
 
 type MessageQueue interface {
-	Add(message *Message) error
-	Poll() (*Message, error)
-	UserMessagesCount(userId int64) (map[Status]int, error)
-	ResetAwaitingAuthorizationMessages(userId int64) error
-	UpdateEachMessage(userId int64, updater func(*Message)) error
-	GetMessage(id string) (*Message, error)
-	DeleteMessage(message *Message) error
+	Add(ctx context.Context, message *Message) error
+	// Lease Claims the message with the given id if it's ready to be sent. The message is leased until LeaseExpiresAt
+	// and has to be either acknowledged with Ack or returned with Nack.
+	// Returns nil when the message is not ready to be sent anymore, e.g. it's leased by another sender
+	Lease(ctx context.Context, id string) (*Message, error)
+	// Ack Completes processing of a leased message and keeps it in the archive of sent messages
+	Ack(ctx context.Context, message *Message) error
+	// Nack Returns a leased message back to the queue with its current status and fields
+	Nack(ctx context.Context, message *Message) error
+	// Extend Prolongs the lease of a message that is still being processed
+	Extend(ctx context.Context, message *Message, duration time.Duration) error
+	// ReapExpiredLeases Returns messages with expired leases back to the queue
+	ReapExpiredLeases(ctx context.Context) (int, error)
+	UserMessagesCount(ctx context.Context, userId int64) (map[Status]int, error)
+	ResetAwaitingAuthorizationMessages(ctx context.Context, userId int64) error
+	// UpdateEachMessage Changes each user's message with the given status, every message in its own transaction.
+	// A message whose status has changed meanwhile is skipped. Messages that are being sent or are sent already
+	// can't be changed. Returns the number of changed messages
+	UpdateEachMessage(ctx context.Context, userId int64, status Status, updater func(*Message)) (int, error)
+	GetMessage(ctx context.Context, id string) (*Message, error)
+	// FindUserMessages Reads all user's messages with the given status
+	FindUserMessages(ctx context.Context, userId int64, status Status) ([]*Message, error)
+	// FindMessages Reads messages of all users with the given status
+	FindMessages(ctx context.Context, status Status) ([]*Message, error)
+	// FindReadyMessages Reads at most limit messages of all users that are ready to be sent at the given time.
+	// The messages waiting the longest go first
+	FindReadyMessages(ctx context.Context, now time.Time, limit int) ([]*Message, error)
+	// FindProblemsToCheck Reads at most limit sent messages of all users whose problems are not closed
+	// and were last checked before the given time. The problems checked the longest ago go first
+	FindProblemsToCheck(ctx context.Context, checkedBefore time.Time, limit int) ([]*Message, error)
+	// ListUserMessages Reads a page of user's messages that are not sent yet. Scheduled messages are listed
+	// separately from the other ones, see MessageListQuery for the order
+	ListUserMessages(ctx context.Context, userId int64, query MessageListQuery) (*MessagePage, error)
+	// UpdateMessage Stores the message as is. Must not be used for leased messages
+	UpdateMessage(ctx context.Context, message *Message) error
+	// EditMessage Changes a message that waits in the queue in a transaction, so that it's not leased meanwhile.
+	// The edit is applied again when the message is modified concurrently, so it must not have side effects.
+	// Fails with ErrMessageNotEditable when the message is being sent or is sent already
+	EditMessage(ctx context.Context, id string, edit func(message *Message) error) (*Message, error)
+	DeleteMessage(ctx context.Context, message *Message) error
 }
 
 type Message struct {
-	Id              string    `firestore:"id"`
-	UserId          int64     `firestore:"userId"`
-	CategoryId      int64     `firestore:"categoryId"`
-	Files           []string  `firestore:"files"`
-	Text            string    `firestore:"text"`
-	Longitude       float64   `firestore:"longitude"`
-	Latitude        float64   `firestore:"latitude"`
-	CreatedAt       time.Time `firestore:"createdAt"`
+	Id         string   `firestore:"id"`
+	UserId     int64    `firestore:"userId"`
+	CategoryId int64    `firestore:"categoryId"`
+	Files      []string `firestore:"files"`
+	Text       string   `firestore:"text"`
+	Longitude  float64  `firestore:"longitude"`
+	Latitude   float64  `firestore:"latitude"`
+	// BuildingId is chosen by the user. When empty, the nearest building is resolved at send time
+	BuildingId int64 `firestore:"buildingId"`
+	// Priority messages are sent before the others
+	Priority  bool      `firestore:"priority"`
+	CreatedAt time.Time `firestore:"createdAt"`
+	// ScheduledAt is the time the user asked to send the message at, zero to send as soon as possible
+	ScheduledAt     time.Time `firestore:"scheduledAt"`
 	LastTriedAt     time.Time `firestore:"lastTriedAt"`
 	Tries           int       `firestore:"tries"`
 	RetryAfter      time.Time `firestore:"retryAfter"`
 	FailDescription string    `firestore:"failDescription"`
 	Status          Status    `firestore:"status"`
+	LeaseId         string    `firestore:"leaseId"`
+	LeaseExpiresAt  time.Time `firestore:"leaseExpiresAt"`
+	ProblemId       int64     `firestore:"problemId"`
+	SentBy          string    `firestore:"sentBy"`
+	SentAt          time.Time `firestore:"sentAt"`
+	// ProblemStatus is the last known status of the problem on the portal
+	ProblemStatus    string    `firestore:"problemStatus"`
+	ProblemAnswers   int       `firestore:"problemAnswers"`
+	ProblemCheckedAt time.Time `firestore:"problemCheckedAt"`
+	// Attempts is a history of the latest MaxAttempts sending attempts
+	Attempts []Attempt `firestore:"attempts"`
+}
+
+// MessageListQuery selects a page of user's messages that are not sent yet.
+// Scheduled messages are ordered by the time they are scheduled at, the other ones go with priority messages first
+// and then in the order they were created in. The page is chosen with a message instead of an offset, so that
+// messages added or deleted while the user browses the list don't shift the pages.
+// At most one of From, After and Before is set, the first page is listed when none of them is
+type MessageListQuery struct {
+	// Scheduled lists the scheduled messages instead of the other ones
+	Scheduled bool
+	// From lists the page starting with the message, or with the following one when the message is deleted
+	From *Message
+	// After lists the page following the message
+	After *Message
+	// Before lists the page preceding the message
+	Before *Message
+	Limit  int
+}
+
+// isListedBefore Tells whether the first message goes before the second one in the list
+func (q MessageListQuery) isListedBefore(a *Message, b *Message) bool {
+	if q.Scheduled {
+		if !a.ScheduledAt.Equal(b.ScheduledAt) {
+			return a.ScheduledAt.Before(b.ScheduledAt)
+		}
+		return a.Id < b.Id
+	}
+
+	if a.Priority != b.Priority {
+		return a.Priority
+	}
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.Id < b.Id
+}
+
+// MessagePage is a part of user's messages
+type MessagePage struct {
+	Messages []*Message
+	// HasMore tells whether there are messages after the page
+	HasMore bool
+	// HasPrevious tells whether there may be messages before the page
+	HasPrevious bool
+}
+
+var (
+	ErrMessageNotEditable = Errors.NewType("MessageNotEditable")
+)
+
+// IsScheduled Checks whether the message waits for the time the user asked to send it at
+func (m *Message) IsScheduled(now time.Time) bool {
+	return m.Status == StatusCreated && m.ScheduledAt.After(now)
+}
+
+// Schedule Makes the message to be sent at the given time, zero time sends it as soon as possible
+func (m *Message) Schedule(sendAt time.Time) {
+	m.ScheduledAt = sendAt
+	m.RetryAfter = sendAt
+}
+
+// IsEditable Checks whether the message is neither being sent nor sent already
+func (m *Message) IsEditable() bool {
+	return isEditableStatus(m.Status)
+}
+
+func isEditableStatus(status Status) bool {
+	return status != StatusInProgress && status != StatusSent
+}
+
+// isReady Checks whether the message may be leased now
+func (m *Message) isReady(now time.Time) bool {
+	return m.Status == StatusCreated && !m.RetryAfter.After(now)
+}
+
+// isProblemToCheck Checks whether the problem of the sent message may still change and wasn't checked since the time
+func (m *Message) isProblemToCheck(checkedBefore time.Time) bool {
+	return m.Status == StatusSent && m.ProblemId != 0 && m.ProblemStatus != string(spb.ProblemStatusClosed) &&
+		m.ProblemCheckedAt.Before(checkedBefore)
+}
+
+// lease Marks the message as taken by a sender until the lease expires
+func (m *Message) lease(now time.Time, duration time.Duration) {
+	m.Status = StatusInProgress
+	m.LeaseId = shortuuid.New()
+	m.LeaseExpiresAt = now.Add(duration)
+}
+
+// ProblemUrl Link to the problem on the portal, available for sent messages only
+func (m *Message) ProblemUrl() string {
+	return fmt.Sprintf("https://gorod.gov.spb.ru/problems/%v/", m.ProblemId)
+}
+
+// Attempt describes a single try to send a message and the decision the sender made after it
+type Attempt struct {
+	At          time.Time `firestore:"at"`
+	Login       string    `firestore:"login"`
+	ErrorType   string    `firestore:"errorType"`
+	HttpStatus  int       `firestore:"httpStatus"`
+	Decision    Decision  `firestore:"decision"`
+	Description string    `firestore:"description"`
+}
+
+// AddAttempt Appends the attempt to the history, forgetting the oldest ones beyond MaxAttempts
+func (m *Message) AddAttempt(attempt Attempt) {
+	m.Attempts = append(m.Attempts, attempt)
+	if len(m.Attempts) > MaxAttempts {
+		m.Attempts = m.Attempts[len(m.Attempts)-MaxAttempts:]
+	}
+}
+
+func NewAttempt(login string, err error, decision Decision, description string) Attempt {
+	result := Attempt{
+		At:          time.Now(),
+		Login:       login,
+		Decision:    decision,
+		Description: description,
+	}
+
+	if errorxErr := errorx.Cast(err); errorxErr != nil {
+		result.ErrorType = errorxErr.Type().FullName()
+	}
+
+	if statusCode, ok := errorx.ExtractProperty(err, spb.PropertyStatusCode); ok {
+		result.HttpStatus, _ = statusCode.(int)
+	}
+
+	return result
+}
+
+func (a Attempt) String() string {
+	result := a.At.In(util.SpbLocation).Format("02.01 15:04") + " " + a.Decision.Name()
+	if a.Login != "" {
+		result += " " + a.Login
+	}
+	if a.ErrorType != "" {
+		result += " " + a.ErrorType
+	}
+	if a.HttpStatus != 0 {
+		result += fmt.Sprintf(" %v", a.HttpStatus)
+	}
+	if a.Description != "" {
+		result += ": " + a.Description
+	}
+	return result
+}
+
+type Decision string
+
+const (
+	// DecisionRetry the message is going to be sent again as soon as possible
+	DecisionRetry Decision = "retry"
+	// DecisionDelay the message is going to be sent again after RetryAfter
+	DecisionDelay Decision = "delay"
+	// DecisionShiftCoordinates the message is going to be sent again with shifted coordinates
+	DecisionShiftCoordinates Decision = "shift_coordinates"
+	// DecisionFail the message is not going to be sent anymore
+	DecisionFail Decision = "fail"
+)
+
+func (d Decision) Status() Status {
+	if d == DecisionFail {
+		return StatusFailed
+	}
+
+	return StatusCreated
+}
+
+func (d Decision) Name() string {
+	switch d {
+	case DecisionRetry:
+		return "повтор"
+	case DecisionDelay:
+		return "отложено"
+	case DecisionShiftCoordinates:
+		return "смещение координат"
+	case DecisionFail:
+		return "ошибка"
+	default:
+		return string(d)
+	}
 }
 
 const (
 	MaxTries = 5
+	// MaxAttempts limits the stored attempts, delayed messages are tried again and again without counting the tries
+	MaxAttempts = 20
 )
 
 type Status string
@@ -39,8 +281,32 @@ type Status string
 const (
 	// StatusCreated for messages that are awaiting to be sent
 	StatusCreated Status = "created"
+	// StatusInProgress for messages that are leased by a sender and are being sent at the moment
+	StatusInProgress Status = "in_progress"
 	// StatusFailed for messages that failed to be sent and need to be investigated
 	StatusFailed Status = "failed"
 	// StatusAwaitingAuthorization for messages that are awaiting user's authorization
 	StatusAwaitingAuthorization Status = "awaiting_authorization"
+	// StatusSent for messages that were successfully sent to the portal and are kept as an archive
+	StatusSent Status = "sent"
 )
+
+var Statuses = []Status{
+	StatusCreated, StatusInProgress, StatusFailed, StatusAwaitingAuthorization, StatusSent,
+}
+
+// PendingStatuses are the statuses of messages that are not sent yet
+var PendingStatuses = []Status{
+	StatusCreated, StatusInProgress, StatusFailed, StatusAwaitingAuthorization,
+}
+
+func debugMessage(logger *zap.Logger, message *Message, text string) {
+	if ce := logger.Check(zap.DebugLevel, text); ce != nil {
+		messageYaml, err := yaml.Marshal(message)
+		if err != nil {
+			ce.Write(zap.Int64("userId", message.UserId), zap.Error(err))
+		} else {
+			ce.Write(zap.String("message", string(messageYaml)))
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"go.uber.org/zap"
+)
+
+// Values are encrypted with a random data key, which is encrypted with a key encryption key from config:
+// enc:v1:<key id>:<encrypted data key>:<encrypted value>
+const (
+	prefix    = "enc:v1:"
+	separator = ":"
+	keySize   = 32
+)
+
+var (
+	Errors        = errorx.NewNamespace("Secret")
+	ErrInvalidKey = Errors.NewType("InvalidKey")
+	ErrUnknownKey = Errors.NewType("UnknownKey")
+	ErrMalformed  = Errors.NewType("Malformed")
+)
+
+// Cipher encrypts values with the configured keys. Without keys values are stored as is
+type Cipher struct {
+	primaryKeyId string
+	keys         map[string]cipher.AEAD
+}
+
+func NewCipher(logger *zap.Logger, conf *config.Config) (*Cipher, error) {
+	result, err := ParseKeys(conf.StateEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if !result.Enabled() {
+		logger.Warn("STATE_ENCRYPTION_KEYS is not set, account passwords and tokens are stored unencrypted")
+	}
+
+	return result, nil
+}
+
+// ParseKeys Creates a cipher from a list of keys in "id:base64" format. The first key encrypts new values,
+// the others are used to decrypt values encrypted before key rotation. Blank keys are ignored
+func ParseKeys(keys []string) (*Cipher, error) {
+	result := &Cipher{
+		keys: map[string]cipher.AEAD{},
+	}
+	for _, key := range keys {
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+
+		id, value, found := strings.Cut(strings.TrimSpace(key), separator)
+		if !found || id == "" {
+			return nil, ErrInvalidKey.New("encryption key is expected in id:base64 format")
+		}
+
+		if _, exists := result.keys[id]; exists {
+			return nil, ErrInvalidKey.New("duplicate encryption key id: %v", id)
+		}
+
+		keyBytes, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, ErrInvalidKey.Wrap(err, "failed to decode encryption key: id=%v", id)
+		}
+
+		if len(keyBytes) != keySize {
+			return nil, ErrInvalidKey.New("encryption key is expected to be %v bytes: id=%v", keySize, id)
+		}
+
+		aead, err := newAead(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		result.keys[id] = aead
+		if result.primaryKeyId == "" {
+			result.primaryKeyId = id
+		}
+	}
+
+	return result, nil
+}
+
+// Enabled Whether there is a key to encrypt values with
+func (c *Cipher) Enabled() bool {
+	return c.primaryKeyId != ""
+}
+
+// Encrypt Encrypts the value with the primary key. Empty values are kept empty, and all values are kept as is
+// when encryption is not enabled
+func (c *Cipher) Encrypt(value string) (string, error) {
+	if value == "" || !c.Enabled() {
+		return value, nil
+	}
+
+	dataKey := make([]byte, keySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", errorx.EnhanceStackTrace(err, "failed to generate data key")
+	}
+
+	dataAead, err := newAead(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	encryptedDataKey, err := seal(c.keys[c.primaryKeyId], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	encryptedValue, err := seal(dataAead, []byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + c.primaryKeyId + separator +
+		base64.StdEncoding.EncodeToString(encryptedDataKey) + separator +
+		base64.StdEncoding.EncodeToString(encryptedValue), nil
+}
+
+// Decrypt Decrypts the value with the key it was encrypted with. Values that are not encrypted are returned as is
+func (c *Cipher) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, prefix), separator)
+	if len(parts) != 3 {
+		return "", ErrMalformed.New("unexpected encrypted value format")
+	}
+
+	keyAead, found := c.keys[parts[0]]
+	if !found {
+		return "", ErrUnknownKey.New("encryption key not found: id=%v", parts[0])
+	}
+
+	encryptedDataKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrMalformed.Wrap(err, "failed to decode data key")
+	}
+
+	encryptedValue, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformed.Wrap(err, "failed to decode value")
+	}
+
+	dataKey, err := open(keyAead, encryptedDataKey)
+	if err != nil {
+		return "", err
+	}
+
+	dataAead, err := newAead(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := open(dataAead, encryptedValue)
+	if err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
+// NeedsReencryption Whether the value is not encrypted yet or is encrypted with a rotated key
+func (c *Cipher) NeedsReencryption(value string) bool {
+	if value == "" || !c.Enabled() {
+		return false
+	}
+
+	return !strings.HasPrefix(value, prefix+c.primaryKeyId+separator)
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidKey.Wrap(err, "failed to create cipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, ErrInvalidKey.Wrap(err, "failed to create cipher")
+	}
+
+	return aead, nil
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to generate nonce")
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrMalformed.New("encrypted value is too short")
+	}
+
+	nonce, data := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	result, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, ErrMalformed.Wrap(err, "failed to decrypt value")
+	}
+
+	return result, nil
+}
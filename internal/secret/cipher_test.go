@@ -0,0 +1,152 @@
+package secret
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+func newKey(b byte) string {
+	key := make([]byte, keySize)
+	for i := range key {
+		key[i] = b
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	cipher, err := ParseKeys([]string{"k1:" + newKey(1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	encrypted, err := cipher.Encrypt("password")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, strings.HasPrefix(encrypted, "enc:v1:k1:"))
+	assert.NotContains(t, encrypted, "password")
+	assert.False(t, cipher.NeedsReencryption(encrypted))
+
+	decrypted, err := cipher.Decrypt(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "password", decrypted)
+}
+
+func TestEncryptEmpty(t *testing.T) {
+	cipher, err := ParseKeys([]string{"k1:" + newKey(1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	encrypted, err := cipher.Encrypt("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", encrypted)
+	assert.False(t, cipher.NeedsReencryption(encrypted))
+}
+
+func TestDecryptPlainValue(t *testing.T) {
+	cipher, err := ParseKeys([]string{"k1:" + newKey(1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	decrypted, err := cipher.Decrypt("password")
+	assert.NoError(t, err)
+	assert.Equal(t, "password", decrypted)
+	assert.True(t, cipher.NeedsReencryption("password"))
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldCipher, err := ParseKeys([]string{"k1:" + newKey(1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	encrypted, err := oldCipher.Encrypt("password")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	newCipher, err := ParseKeys([]string{"k2:" + newKey(2), "k1:" + newKey(1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, newCipher.NeedsReencryption(encrypted))
+	decrypted, err := newCipher.Decrypt(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "password", decrypted)
+
+	reencrypted, err := newCipher.Encrypt(decrypted)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(reencrypted, "enc:v1:k2:"))
+
+	_, err = oldCipher.Decrypt(reencrypted)
+	assert.True(t, errorx.IsOfType(err, ErrUnknownKey))
+}
+
+func TestDecryptWithWrongKey(t *testing.T) {
+	cipher, err := ParseKeys([]string{"k1:" + newKey(1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	encrypted, err := cipher.Encrypt("password")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	otherCipher, err := ParseKeys([]string{"k1:" + newKey(2)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = otherCipher.Decrypt(encrypted)
+	assert.True(t, errorx.IsOfType(err, ErrMalformed))
+}
+
+func TestCipherWithoutKeys(t *testing.T) {
+	cipher, err := ParseKeys([]string{""})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.False(t, cipher.Enabled())
+	encrypted, err := cipher.Encrypt("secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", encrypted)
+	assert.False(t, cipher.NeedsReencryption("secret"))
+
+	otherCipher, err := ParseKeys([]string{"k1:" + newKey(1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	encrypted, err = otherCipher.Encrypt("secret")
+	assert.NoError(t, err)
+	_, err = cipher.Decrypt(encrypted)
+	assert.True(t, errorx.IsOfType(err, ErrUnknownKey), "encrypted values can't be read once the keys are removed")
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+	}{
+		{name: "no id", keys: []string{newKey(1)}},
+		{name: "not base64", keys: []string{"k1:not base64"}},
+		{name: "short key", keys: []string{"k1:" + base64.StdEncoding.EncodeToString([]byte("short"))}},
+		{name: "duplicate id", keys: []string{"k1:" + newKey(1), "k1:" + newKey(2)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKeys(tt.keys)
+			assert.True(t, errorx.IsOfType(err, ErrInvalidKey))
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package spb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+)
+
+// Classifier caches the portal classifier and indexes its reasons by id.
+// A stale classifier is refreshed in background, and the last good copy is served when the portal is down
+type Classifier struct {
+	logger     *zap.Logger
+	ttl        time.Duration
+	load       func(ctx context.Context) ([]CityResponse, error)
+	mutex      sync.RWMutex
+	cities     []CityResponse
+	reasons    map[int64]ReasonResponse
+	loadedAt   time.Time
+	refreshing atomic.Bool
+}
+
+func NewClassifier(
+	logger *zap.Logger, ttl time.Duration, load func(ctx context.Context) ([]CityResponse, error),
+) *Classifier {
+	return &Classifier{
+		logger: logger,
+		ttl:    ttl,
+		load:   load,
+	}
+}
+
+// Reasons Returns the whole classifier tree
+func (c *Classifier) Reasons(ctx context.Context) ([]CityResponse, error) {
+	err := c.ensureLoaded(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cities, nil
+}
+
+// Reason Finds a reason by its id
+func (c *Classifier) Reason(ctx context.Context, id int64) (*ReasonResponse, error) {
+	err := c.ensureLoaded(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	reason, found := c.reasons[id]
+	if !found {
+		return nil, ErrReasonNotFound.New("can't find reason: id=%v", id)
+	}
+
+	return &reason, nil
+}
+
+// Refresh Loads the classifier from the portal. The cached copy is kept in case of an error
+func (c *Classifier) Refresh(ctx context.Context) error {
+	cities, err := c.load(ctx)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to load classifier")
+	}
+
+	reasons := map[int64]ReasonResponse{}
+	for _, city := range cities {
+		for _, category := range city.Categories {
+			for _, reason := range category.Reasons {
+				reasons[reason.Id] = reason
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cities = cities
+	c.reasons = reasons
+	c.loadedAt = time.Now()
+	c.logger.Info("classifier loaded", zap.Int("reasons", len(reasons)))
+	return nil
+}
+
+func (c *Classifier) ensureLoaded(ctx context.Context) error {
+	c.mutex.RLock()
+	loaded := c.cities != nil
+	stale := time.Since(c.loadedAt) > c.ttl
+	c.mutex.RUnlock()
+
+	if !loaded {
+		return c.Refresh(ctx)
+	}
+
+	if stale && c.refreshing.CompareAndSwap(false, true) {
+		// the refresh outlives the request that triggered it
+		refreshCtx := context.WithoutCancel(ctx)
+		go func() {
+			defer c.refreshing.Store(false)
+			err := c.Refresh(refreshCtx)
+			if err != nil {
+				c.logger.Warn("failed to refresh classifier, keeping the last loaded one", zap.Error(err))
+			}
+		}()
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package spb
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+var testCities = []CityResponse{{
+	Id:   1,
+	Name: "City",
+	Categories: []CategoryResponse{{
+		Id:   2,
+		Name: "Category",
+		Reasons: []ReasonResponse{
+			{Id: 3, Name: "Reason 3", PositionType: PositionTypeBuilding},
+			{Id: 4, Name: "Reason 4", PositionType: PositionTypeStreet},
+		},
+	}},
+}}
+
+func TestClassifierCachesReasons(t *testing.T) {
+	var loads atomic.Int32
+	classifier := NewClassifier(zap.NewNop(), time.Hour, func(ctx context.Context) ([]CityResponse, error) {
+		loads.Add(1)
+		return testCities, nil
+	})
+
+	reason, err := classifier.Reason(context.Background(), 4)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "Reason 4", reason.Name)
+
+	cities, err := classifier.Reasons(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, testCities, cities)
+	assert.Equal(t, int32(1), loads.Load())
+}
+
+func TestClassifierUnknownReason(t *testing.T) {
+	classifier := NewClassifier(zap.NewNop(), time.Hour, func(ctx context.Context) ([]CityResponse, error) {
+		return testCities, nil
+	})
+
+	_, err := classifier.Reason(context.Background(), 5)
+	assert.True(t, errorx.IsOfType(err, ErrReasonNotFound))
+}
+
+func TestClassifierFirstLoadFails(t *testing.T) {
+	classifier := NewClassifier(zap.NewNop(), time.Hour, func(ctx context.Context) ([]CityResponse, error) {
+		return nil, errors.New("portal is down")
+	})
+
+	_, err := classifier.Reasons(context.Background())
+	assert.Error(t, err)
+}
+
+func TestClassifierKeepsLastGoodCopy(t *testing.T) {
+	var loads atomic.Int32
+	classifier := NewClassifier(zap.NewNop(), time.Millisecond, func(ctx context.Context) ([]CityResponse, error) {
+		if loads.Add(1) == 1 {
+			return testCities, nil
+		}
+		return nil, errors.New("portal is down")
+	})
+
+	_, err := classifier.Reasons(context.Background())
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		reason, err := classifier.Reason(context.Background(), 3)
+		return err == nil && reason.Name == "Reason 3" && loads.Load() > 1
+	}, time.Second, 10*time.Millisecond)
+}
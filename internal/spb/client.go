@@ -1,17 +1,24 @@
 package spb
 
 import (
+	"context"
+
 	"github.com/joomcode/errorx"
 )
 
 type Client interface {
-	Login(login string, password string) (*TokenResponse, error)
-	GetNearestBuildings(latitude float64, longitude float64) (*NearestBuildingResponse, error)
-	GetReasons() ([]CityResponse, error)
-	Send(token string, fields map[string]string, files map[string][]byte) (*SentMessageResponse, error)
-	CreateSendProblemRequest(reasonId int64, body string, latitude float64, longitude float64) (
-		map[string]string, error,
-	)
+	Login(ctx context.Context, login string, password string) (*TokenResponse, error)
+	GetNearestBuildings(ctx context.Context, latitude float64, longitude float64) (*NearestBuildingResponse, error)
+	// GetReasons Returns the portal classifier, which is cached for OURSPB_CLASSIFIER_TTL
+	GetReasons(ctx context.Context) ([]CityResponse, error)
+	// GetReason Finds a reason in the cached portal classifier
+	GetReason(ctx context.Context, id int64) (*ReasonResponse, error)
+	// GetProblem Reads current status of a sent problem together with the official answers
+	GetProblem(ctx context.Context, id int64) (*ProblemResponse, error)
+	Send(ctx context.Context, token string, fields map[string]string, files map[string][]byte) (*SentMessageResponse, error)
+	CreateSendProblemRequest(
+		ctx context.Context, reasonId int64, body string, latitude float64, longitude float64, buildingId int64,
+	) (map[string]string, error)
 }
 
 var (
@@ -22,4 +29,10 @@ var (
 	ErrUnauthorized               = Errors.NewType("Unauthorized")
 	ErrExpectingNotBuildingCoords = Errors.NewType("ExpectingNotBuildingCoords")
 	ErrMatchesCoordsAndCategory   = Errors.NewType("MatchesCoordsAndCategory")
+	ErrReasonNotFound             = Errors.NewType("ReasonNotFound")
+	// ErrPortalUnavailable the portal failed to process the request, it may succeed later
+	ErrPortalUnavailable = Errors.NewType("PortalUnavailable")
+
+	// PropertyStatusCode HTTP status code of the portal response that caused the error
+	PropertyStatusCode = errorx.RegisterProperty("statusCode")
 )
@@ -1,6 +1,10 @@
 package spb
 
-import "gopkg.in/yaml.v3"
+import (
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
 
 type ErrorResponse map[string]any
 
@@ -52,6 +56,11 @@ const (
 	PositionTypeNearBuilding2 PositionType = 5
 )
 
+// RequiresBuilding Whether a problem with such a position type refers to a building
+func (t PositionType) RequiresBuilding() bool {
+	return t == PositionTypeBuilding || t == PositionTypeNearBuilding || t == PositionTypeNearBuilding2
+}
+
 type CreateProblemRequest interface {
 }
 
@@ -82,3 +91,24 @@ type Message struct {
 type SentMessageResponse struct {
 	Id int `json:"id"`
 }
+
+type ProblemResponse struct {
+	Id      int64                   `json:"id"`
+	Status  ProblemStatus           `json:"status"`
+	Answers []ProblemAnswerResponse `json:"answers"`
+}
+
+type ProblemAnswerResponse struct {
+	Id        int64     `json:"id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ProblemStatus string
+
+const (
+	ProblemStatusAccepted   ProblemStatus = "accepted"
+	ProblemStatusInProgress ProblemStatus = "in_progress"
+	ProblemStatusAnswered   ProblemStatus = "answered"
+	ProblemStatusClosed     ProblemStatus = "closed"
+)
@@ -0,0 +1,159 @@
+package spb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/samber/lo"
+)
+
+var (
+	// PropertyFields names of the request fields the portal complained about
+	PropertyFields = errorx.RegisterProperty("fields")
+)
+
+// FieldError is a single error from the portal response, bound to a request field
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+func (e FieldError) String() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%v: %v", e.Field, e.Message)
+	}
+	return fmt.Sprintf("%v: %v (%v)", e.Field, e.Message, e.Code)
+}
+
+// errorRule maps a portal error to a typed error. Empty rule fields match any value
+type errorRule struct {
+	field     string
+	code      string
+	message   string
+	errorType *errorx.Type
+}
+
+// errorRules known portal errors. The portal reports them without codes, so they are matched by message
+var errorRules = []errorRule{
+	{field: "non_field_errors", message: "Выберите не дом.", errorType: ErrExpectingNotBuildingCoords},
+	{field: "non_field_errors", message: "Вы отправили 10 сообщений за сутки.", errorType: ErrTooManyRequests},
+	{
+		field:     "non_field_errors",
+		message:   "Ваше сообщение не зарегистрировано по причине совпадения проблемы и адреса",
+		errorType: ErrMatchesCoordsAndCategory,
+	},
+}
+
+func (r errorRule) matches(fieldError FieldError) bool {
+	return (r.field == "" || r.field == fieldError.Field) &&
+		(r.code == "" || r.code == fieldError.Code) &&
+		(r.message == "" || strings.Contains(fieldError.Message, r.message))
+}
+
+// ParseErrorResponse decodes the portal error response. The portal responds with an object
+// that maps field names to an error or a list of errors, where each error is either a plain message
+// or an object with a code and a message
+func ParseErrorResponse(body []byte) ([]FieldError, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to decode error response")
+	}
+
+	var result []FieldError
+	for field, value := range fields {
+		fieldErrors, err := parseFieldErrors(field, value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, fieldErrors...)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Field < result[j].Field
+	})
+	return result, nil
+}
+
+func parseFieldErrors(field string, value json.RawMessage) ([]FieldError, error) {
+	var values []json.RawMessage
+	if err := json.Unmarshal(value, &values); err != nil {
+		values = []json.RawMessage{value}
+	}
+
+	var result []FieldError
+	for _, item := range values {
+		var message string
+		if err := json.Unmarshal(item, &message); err == nil {
+			result = append(result, FieldError{Field: field, Message: message})
+			continue
+		}
+
+		var detailed struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(item, &detailed); err == nil {
+			result = append(result, FieldError{Field: field, Code: detailed.Code, Message: detailed.Message})
+			continue
+		}
+
+		result = append(result, FieldError{Field: field, Message: string(item)})
+	}
+
+	return result, nil
+}
+
+// ClassifyErrorResponse converts a failed portal response to a typed error
+func ClassifyErrorResponse(statusCode int, body []byte) *errorx.Error {
+	return classifyErrorResponse(statusCode, body).WithProperty(PropertyStatusCode, statusCode)
+}
+
+func classifyErrorResponse(statusCode int, body []byte) *errorx.Error {
+	fieldErrors, err := ParseErrorResponse(body)
+	if err != nil {
+		if statusCode == http.StatusUnauthorized {
+			return ErrUnauthorized.New("token expired")
+		}
+		if statusCode == http.StatusTooManyRequests {
+			return ErrTooManyRequests.New("too many requests")
+		}
+		// error pages of the portal or its gateway, they are not related to the request itself
+		return ErrPortalUnavailable.Wrap(err, "unexpected error response: status=%v, response=%v", statusCode, string(body))
+	}
+
+	for _, fieldError := range fieldErrors {
+		for _, rule := range errorRules {
+			if rule.matches(fieldError) {
+				return rule.errorType.New("%v", fieldError.Message)
+			}
+		}
+	}
+
+	if statusCode == http.StatusUnauthorized {
+		return ErrUnauthorized.New("token expired")
+	}
+
+	if statusCode == http.StatusTooManyRequests {
+		return ErrTooManyRequests.New("too many requests")
+	}
+
+	details := strings.Join(lo.Map(fieldErrors, func(item FieldError, _ int) string {
+		return item.String()
+	}), "; ")
+	if statusCode >= http.StatusInternalServerError {
+		return ErrPortalUnavailable.New("portal failed to process the request: status=%v, errors=%v", statusCode, details)
+	}
+
+	fields := lo.Uniq(lo.Map(fieldErrors, func(item FieldError, _ int) string {
+		return item.Field
+	}))
+	return ErrBadRequest.New(
+		"portal rejected the request: status=%v, errors=%v", statusCode, details,
+	).WithProperty(PropertyFields, fields)
+}
@@ -0,0 +1,101 @@
+package spb
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyErrorResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		sourceFile     string
+		statusCode     int
+		expectedType   *errorx.Type
+		expectedFields []string
+		expectedText   string
+	}{
+		{
+			name:         "expecting not a building",
+			sourceFile:   "testdata/errors/expecting_not_building.json",
+			statusCode:   http.StatusBadRequest,
+			expectedType: ErrExpectingNotBuildingCoords,
+			expectedText: "Выберите не дом.",
+		},
+		{
+			name:         "too many requests",
+			sourceFile:   "testdata/errors/too_many_requests.json",
+			statusCode:   http.StatusBadRequest,
+			expectedType: ErrTooManyRequests,
+			expectedText: "Вы отправили 10 сообщений за сутки. Попробуйте отправить сообщение завтра.",
+		},
+		{
+			name:         "matches coords and category",
+			sourceFile:   "testdata/errors/matches_coords_and_category.json",
+			statusCode:   http.StatusBadRequest,
+			expectedType: ErrMatchesCoordsAndCategory,
+			expectedText: "Ваше сообщение не зарегистрировано по причине совпадения проблемы и адреса с ранее отправленным сообщением.",
+		},
+		{
+			name:         "unauthorized",
+			sourceFile:   "testdata/errors/unauthorized.json",
+			statusCode:   http.StatusUnauthorized,
+			expectedType: ErrUnauthorized,
+			expectedText: "token expired",
+		},
+		{
+			name:           "unknown fields",
+			sourceFile:     "testdata/errors/unknown_fields.json",
+			statusCode:     http.StatusBadRequest,
+			expectedType:   ErrBadRequest,
+			expectedFields: []string{"body", "files"},
+			expectedText:   "portal rejected the request: status=400, errors=body: Это поле не может быть пустым.; files: Обязательное поле. (required)",
+		},
+		{
+			name:         "bad gateway html",
+			sourceFile:   "testdata/errors/not_json.html",
+			statusCode:   http.StatusBadGateway,
+			expectedType: ErrPortalUnavailable,
+			expectedText: "unexpected error response: status=502, response=<html><body><h1>502 Bad Gateway</h1></body></html>\n",
+		},
+		{
+			name:         "too many requests with empty body",
+			sourceFile:   "testdata/errors/empty.txt",
+			statusCode:   http.StatusTooManyRequests,
+			expectedType: ErrTooManyRequests,
+			expectedText: "too many requests",
+		},
+		{
+			name:         "internal server error json",
+			sourceFile:   "testdata/errors/unknown_fields.json",
+			statusCode:   http.StatusInternalServerError,
+			expectedType: ErrPortalUnavailable,
+			expectedText: "portal failed to process the request: status=500, errors=body: Это поле не может быть пустым.; files: Обязательное поле. (required)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bytes, err := os.ReadFile(test.sourceFile)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			actual := ClassifyErrorResponse(test.statusCode, bytes)
+			assert.True(t, actual.IsOfType(test.expectedType), "unexpected type: %v", actual.Type())
+			assert.Equal(t, test.expectedText, actual.Message())
+
+			statusCode, _ := actual.Property(PropertyStatusCode)
+			assert.Equal(t, test.statusCode, statusCode)
+
+			fields, found := actual.Property(PropertyFields)
+			if test.expectedFields == nil {
+				assert.False(t, found)
+			} else {
+				assert.Equal(t, test.expectedFields, fields)
+			}
+		})
+	}
+}
@@ -1,9 +1,10 @@
 package spb
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"strings"
+	"regexp"
 	"time"
 
 	"github.com/imroc/req/v3"
@@ -13,33 +14,38 @@ import (
 )
 
 type ReqClient struct {
-	logger   *zap.Logger
-	client   *req.Client
-	clientId string
-	secret   string
+	logger     *zap.Logger
+	client     *req.Client
+	clientId   string
+	secret     string
+	classifier *Classifier
 }
 
 func NewReqClient(logger *zap.Logger, conf *config.Config) *ReqClient {
 	client := req.C().
-		SetBaseURL("https://gorod.gov.spb.ru").
+		SetBaseURL(conf.OurSpbApiEndpoint).
 		// this is to pretend to be an official client
 		SetUserAgent("okhttp/2.5.0").
 		EnableDumpEachRequest().
 		SetTimeout(conf.OurSpbClientTimeout)
 	client.GetTransport()
 
-	return &ReqClient{
+	result := &ReqClient{
 		logger:   logger,
 		client:   client,
 		clientId: conf.OurSpbClientId,
 		secret:   conf.OurSpbSecret,
 	}
+	result.classifier = NewClassifier(logger, conf.OurSpbClassifierTtl, result.fetchReasons)
+	return result
 }
 
-func (r *ReqClient) GetNearestBuildings(latitude float64, longitude float64) (*NearestBuildingResponse, error) {
+func (r *ReqClient) GetNearestBuildings(
+	ctx context.Context, latitude float64, longitude float64,
+) (*NearestBuildingResponse, error) {
 	var result NearestBuildingResponse
 	var errorResponse ErrorResponse
-	request := r.client.R()
+	request := r.client.R().SetContext(ctx)
 	request.SetSuccessResult(&result)
 	request.SetErrorResult(&result)
 	r.configureRetries(request)
@@ -60,10 +66,18 @@ func (r *ReqClient) GetNearestBuildings(latitude float64, longitude float64) (*N
 	return &result, nil
 }
 
-func (r *ReqClient) GetReasons() ([]CityResponse, error) {
+func (r *ReqClient) GetReasons(ctx context.Context) ([]CityResponse, error) {
+	return r.classifier.Reasons(ctx)
+}
+
+func (r *ReqClient) GetReason(ctx context.Context, id int64) (*ReasonResponse, error) {
+	return r.classifier.Reason(ctx, id)
+}
+
+func (r *ReqClient) fetchReasons(ctx context.Context) ([]CityResponse, error) {
 	var result []CityResponse
 	var errorResponse ErrorResponse
-	request := r.client.R()
+	request := r.client.R().SetContext(ctx)
 	request.SetSuccessResult(&result)
 	request.SetErrorResult(&result)
 	r.configureRetries(request)
@@ -82,14 +96,36 @@ func (r *ReqClient) GetReasons() ([]CityResponse, error) {
 	return result, nil
 }
 
-func (r *ReqClient) Send(token string, fields map[string]string, files map[string][]byte) (
+func (r *ReqClient) GetProblem(ctx context.Context, id int64) (*ProblemResponse, error) {
+	var result ProblemResponse
+	var errorResponse ErrorResponse
+	request := r.client.R().SetContext(ctx)
+	request.SetSuccessResult(&result)
+	request.SetErrorResult(&errorResponse)
+	r.configureRetries(request)
+	response, err := request.
+		SetPathParam("id", fmt.Sprint(id)).
+		Get("/api/v4.0/problems/{id}/")
+	if err != nil {
+		r.printDebugDump(response)
+		return nil, errorx.EnhanceStackTrace(err, "failed to get problem: id=%v", id)
+	}
+
+	if response.IsErrorState() || !response.IsSuccessState() {
+		return nil, ErrBadRequest.New(
+			"failed to get problem: id=%v, status=%v, response=%v", id, response.StatusCode, errorResponse.String(),
+		)
+	}
+
+	return &result, nil
+}
+
+func (r *ReqClient) Send(ctx context.Context, token string, fields map[string]string, files map[string][]byte) (
 	*SentMessageResponse, error,
 ) {
 	var result SentMessageResponse
-	var errorResponse ErrorResponse
-	request := r.client.R()
+	request := r.client.R().SetContext(ctx)
 	request.SetSuccessResult(&result)
-	request.SetErrorResult(&errorResponse)
 	r.configureRetries(request)
 	request.SetHeader("Authorization", "Bearer "+token)
 	request.SetFormData(fields)
@@ -104,32 +140,17 @@ func (r *ReqClient) Send(token string, fields map[string]string, files map[strin
 	}
 
 	if response.IsErrorState() || !response.IsSuccessState() {
-		if strings.Contains(errorResponse.String(), "Выберите не дом.") {
-			return nil, ErrExpectingNotBuildingCoords.New("failed to send a message, expecting not a building coordinates")
-		}
-		if strings.Contains(errorResponse.String(), "Вы отправили 10 сообщений за сутки.") {
-			return nil, ErrTooManyRequests.Wrap(err, "too many requests")
-		}
-		if strings.Contains(
-			errorResponse.String(), "Ваше сообщение не зарегистрировано по причине совпадения проблемы и адреса",
-		) {
-			return nil, ErrTooManyRequests.Wrap(err, "too many requests")
-		}
-		if response.StatusCode == http.StatusUnauthorized {
-			return nil, ErrUnauthorized.Wrap(err, "token expired")
-		}
-		return nil, ErrBadRequest.New(
-			"failed to send a message: status=%v, response=%v", response.StatusCode, errorResponse.String(),
-		)
+		body, _ := response.ToBytes()
+		return nil, ClassifyErrorResponse(response.StatusCode, body)
 	}
 
 	return &result, nil
 }
 
 func (r *ReqClient) CreateSendProblemRequest(
-	reasonId int64, body string, latitude float64, longitude float64,
+	ctx context.Context, reasonId int64, body string, latitude float64, longitude float64, buildingId int64,
 ) (map[string]string, error) {
-	reason, err := r.getReason(reasonId)
+	reason, err := r.GetReason(ctx, reasonId)
 	if err != nil {
 		return nil, ErrBadRequest.Wrap(err, "failed to get reason")
 	}
@@ -144,23 +165,23 @@ func (r *ReqClient) CreateSendProblemRequest(
 
 	switch reason.PositionType {
 	case PositionTypeBuilding:
-		nearestBuilding, err := r.getNearestBuilding(latitude, longitude)
+		buildingId, err := r.resolveBuildingId(ctx, buildingId, latitude, longitude)
 		if err != nil {
-			return nil, errorx.EnhanceStackTrace(err, "failed to get nearest building")
+			return nil, err
 		}
 
-		result["building"] = fmt.Sprint(nearestBuilding.Id)
+		result["building"] = fmt.Sprint(buildingId)
 	case PositionTypeStreet:
 		//do nothing, no additional fields required
 	case PositionTypeNearBuilding:
 		fallthrough
 	case PositionTypeNearBuilding2:
-		nearestBuilding, err := r.getNearestBuilding(latitude, longitude)
+		buildingId, err := r.resolveBuildingId(ctx, buildingId, latitude, longitude)
 		if err != nil {
-			return nil, errorx.EnhanceStackTrace(err, "failed to get nearest building")
+			return nil, err
 		}
 
-		result["nearest_building"] = fmt.Sprint(nearestBuilding.Id)
+		result["nearest_building"] = fmt.Sprint(buildingId)
 	default:
 		return nil, errorx.IllegalArgument.New("unsupported position type: type=%v", reason.PositionType)
 	}
@@ -169,10 +190,10 @@ func (r *ReqClient) CreateSendProblemRequest(
 
 }
 
-func (r *ReqClient) Login(login string, password string) (*TokenResponse, error) {
+func (r *ReqClient) Login(ctx context.Context, login string, password string) (*TokenResponse, error) {
 	var result TokenResponse
 	var responseError ErrorResponse
-	request := r.client.R()
+	request := r.client.R().SetContext(ctx)
 	request.SetFormData(
 		map[string]string{
 			"username":      login,
@@ -191,6 +212,12 @@ func (r *ReqClient) Login(login string, password string) (*TokenResponse, error)
 		return nil, errorx.EnhanceStackTrace(err, "failed to login")
 	}
 
+	if response.StatusCode >= http.StatusInternalServerError {
+		return nil, ErrPortalUnavailable.New(
+			"failed to login: status=%v, response=%v", response.StatusCode, responseError.String(),
+		)
+	}
+
 	if response.IsErrorState() || !response.IsSuccessState() {
 		return nil, ErrUnauthorized.New(
 			"failed to login: status=%v, response=%v", response.StatusCode, responseError.String(),
@@ -218,33 +245,37 @@ func (r *ReqClient) configureRetries(request *req.Request) {
 	)
 }
 
+var secretsInDump = regexp.MustCompile(`(?i)(authorization: bearer |password=|client_secret=)[^\s&]+`)
+
 func (r *ReqClient) printDebugDump(response *req.Response) {
 	if ce := r.logger.Check(zap.DebugLevel, "response"); ce != nil {
-		println(response.Dump())
+		println(redactDump(response.Dump()))
 	}
 }
 
-func (r *ReqClient) getReason(id int64) (*ReasonResponse, error) {
-	cityResponses, err := r.GetReasons()
-	if err != nil {
-		return nil, errorx.EnhanceStackTrace(err, "failed to get reasons")
+// redactDump Hides tokens and passwords, so that they never get into logs
+func redactDump(dump string) string {
+	return secretsInDump.ReplaceAllString(dump, "${1}***")
+}
+
+// resolveBuildingId Uses the building chosen by the user, or the nearest one for messages queued without a choice
+func (r *ReqClient) resolveBuildingId(
+	ctx context.Context, buildingId int64, latitude float64, longitude float64,
+) (int64, error) {
+	if buildingId != 0 {
+		return buildingId, nil
 	}
 
-	for _, cityResponse := range cityResponses {
-		for _, categoryResponse := range cityResponse.Categories {
-			for _, reason := range categoryResponse.Reasons {
-				if reason.Id == id {
-					return &reason, nil
-				}
-			}
-		}
+	nearestBuilding, err := r.getNearestBuilding(ctx, latitude, longitude)
+	if err != nil {
+		return 0, errorx.EnhanceStackTrace(err, "failed to get nearest building")
 	}
 
-	return nil, errorx.IllegalArgument.New("can't find reason: id=%v", id)
+	return nearestBuilding.Id, nil
 }
 
-func (r *ReqClient) getNearestBuilding(latitude float64, longitude float64) (*BuildingResponse, error) {
-	nearestBuildings, err := r.GetNearestBuildings(latitude, longitude)
+func (r *ReqClient) getNearestBuilding(ctx context.Context, latitude float64, longitude float64) (*BuildingResponse, error) {
+	nearestBuildings, err := r.GetNearestBuildings(ctx, latitude, longitude)
 	if err != nil {
 		return nil, errorx.EnhanceStackTrace(err, "failed to get nearest buildings")
 	}
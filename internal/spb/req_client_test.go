@@ -0,0 +1,93 @@
+package spb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func newFakePortal(t *testing.T, handler http.HandlerFunc) *ReqClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return NewReqClient(zap.NewNop(), &config.Config{
+		OurSpbApiEndpoint:   server.URL,
+		OurSpbClientTimeout: time.Second,
+	})
+}
+
+func TestGetProblem(t *testing.T) {
+	client := newFakePortal(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v4.0/problems/42/", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id": 42, "status": "answered", "answers": [{"id": 1, "body": "Работы выполнены", "created_at": "2023-10-06T10:00:00+03:00"}]}`))
+	})
+
+	actual, err := client.GetProblem(context.Background(), 42)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, int64(42), actual.Id)
+	assert.Equal(t, ProblemStatusAnswered, actual.Status)
+	assert.Len(t, actual.Answers, 1)
+	assert.Equal(t, "Работы выполнены", actual.Answers[0].Body)
+}
+
+func TestGetProblemNotFound(t *testing.T) {
+	client := newFakePortal(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"detail": "Not found."}`))
+	})
+
+	_, err := client.GetProblem(context.Background(), 42)
+	assert.Error(t, err)
+}
+
+func TestCreateSendProblemRequestBuilding(t *testing.T) {
+	tests := []struct {
+		name       string
+		buildingId int64
+		expected   string
+	}{
+		{name: "chosen building", buildingId: 7, expected: "7"},
+		{name: "nearest building", buildingId: 0, expected: "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakePortal(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Path {
+				case "/api/v4.0/classifier":
+					_, _ = w.Write([]byte(`[{"id": 1, "name": "Город", "categories": [{"id": 2, "name": "Дворы", "reasons": [{"id": 3, "name": "Мусор", "wizard_widget": 1}]}]}]`))
+				case "/public_api/maps/get_nearest/":
+					_, _ = w.Write([]byte(`{"buildings": [{"id": 5, "full_address": "Невский пр., 1"}, {"id": 7, "full_address": "Невский пр., 3"}]}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			actual, err := client.CreateSendProblemRequest(context.Background(), 3, "Текст", 59.93, 30.33, tt.buildingId)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tt.expected, actual["building"])
+		})
+	}
+}
+
+func TestRedactDump(t *testing.T) {
+	dump := "POST /api/v4.0/token/ HTTP/1.1\r\nAuthorization: Bearer abc.def\r\n\r\n" +
+		"username=user&password=p@ss&grant_type=password&client_secret=s3cr3t"
+
+	assert.Equal(t, "POST /api/v4.0/token/ HTTP/1.1\r\nAuthorization: Bearer ***\r\n\r\n"+
+		"username=user&password=***&grant_type=password&client_secret=***", redactDump(dump))
+}
@@ -0,0 +1,157 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var bucket = []byte(collection)
+
+// BoltStates Keeps user states in an embedded single-file database. Each state is stored as JSON under the user id
+type BoltStates struct {
+	logger *zap.Logger
+	db     *bbolt.DB
+	cipher *secret.Cipher
+}
+
+func NewBoltStates(logger *zap.Logger, db *bbolt.DB, cipher *secret.Cipher) (*BoltStates, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to create user states bucket")
+	}
+
+	return &BoltStates{
+		logger: logger,
+		db:     db,
+		cipher: cipher,
+	}, nil
+}
+
+func (b *BoltStates) GetState(ctx context.Context, userId int64) (*UserState, error) {
+	var result *UserState
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		result, err = b.readState(tx, userId)
+		return err
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to get user state: userId=%v", userId)
+	}
+
+	if result == nil {
+		return b.Update(ctx, userId, func(state *UserState) error {
+			return nil
+		})
+	}
+
+	debugUserState(b.logger, result, "read user state")
+
+	return result, nil
+}
+
+// Update Runs in a single read-write transaction. Such transactions are serialized by the database,
+// so the change is never applied concurrently and never retried. Local transactions are short, so they are not cancelled
+func (b *BoltStates) Update(ctx context.Context, userId int64, update func(state *UserState) error) (*UserState, error) {
+	var result *UserState
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		state, err := b.readState(tx, userId)
+		if err != nil {
+			return err
+		}
+
+		if state == nil {
+			state = &UserState{
+				UserId: userId,
+				logger: b.logger,
+			}
+		}
+
+		err = update(state)
+		if err != nil {
+			return err
+		}
+
+		state.LastAccessAt = time.Now()
+		debugUserState(b.logger, state, "saving user state")
+
+		encryptedState, err := encryptSecrets(state, b.cipher)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to encrypt user state: userId=%v", userId)
+		}
+
+		data, err := json.Marshal(encryptedState)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to serialize user state: userId=%v", userId)
+		}
+
+		result = state
+		return tx.Bucket(bucket).Put(stateKey(userId), data)
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to update user state: userId=%v", userId)
+	}
+
+	b.logger.Debug("user state saved",
+		zap.Int64("userId", userId))
+
+	return result, nil
+}
+
+func (b *BoltStates) GetAllStates(ctx context.Context) ([]*UserState, error) {
+	var states []*UserState
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(key, value []byte) error {
+			state, err := b.decodeState(value)
+			if err != nil {
+				return err
+			}
+
+			states = append(states, state)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to get all user states")
+	}
+
+	return states, nil
+}
+
+// readState Returns nil when the user has no state yet
+func (b *BoltStates) readState(tx *bbolt.Tx, userId int64) (*UserState, error) {
+	data := tx.Bucket(bucket).Get(stateKey(userId))
+	if data == nil {
+		return nil, nil
+	}
+
+	return b.decodeState(data)
+}
+
+func (b *BoltStates) decodeState(data []byte) (*UserState, error) {
+	var state UserState
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to deserialize user state data")
+	}
+
+	err = restoreState(&state, b.cipher, b.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func stateKey(userId int64) []byte {
+	return []byte(strconv.FormatInt(userId, 10))
+}
@@ -0,0 +1,24 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"go.etcd.io/bbolt"
+)
+
+func TestBoltStates(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	states, err := NewBoltStates(log.NewLogger(), db, newTestCipher(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runStatesConformance(t, states)
+}
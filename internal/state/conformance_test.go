@@ -0,0 +1,125 @@
+package state
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/stretchr/testify/assert"
+)
+
+// runStatesConformance Checks the behaviour every States implementation has to provide.
+// User ids are unique for each run, so that a shared storage can be used
+func runStatesConformance(t *testing.T, states States) {
+	ctx := context.Background()
+	userId := time.Now().UnixNano()
+
+	t.Run("GetStateCreatesState", func(t *testing.T) {
+		actual, err := states.GetState(ctx, userId)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, userId, actual.UserId)
+	})
+
+	t.Run("UpdateStoresState", func(t *testing.T) {
+		updated, err := states.Update(ctx, userId+1, func(state *UserState) error {
+			state.Accounts = []Account{{Login: "login", Password: "password", Token: "token", State: AccountStateEnabled}}
+			state.SentMessagesCount = 3
+			state.SetFormField(FormFieldLatitude, 59.93)
+			state.AddValueToStringSlice(FormFieldFiles, "file")
+			state.PutValueToMap(FormFieldBuildings, "1", "address")
+			return nil
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 3, updated.SentMessagesCount)
+		assert.False(t, updated.LastAccessAt.IsZero())
+
+		actual, err := states.GetState(ctx, userId+1)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 3, actual.SentMessagesCount)
+		assert.Equal(t, string(category.DefaultCategoriesText), actual.Categories)
+		assert.Equal(t, "password", actual.Accounts[0].Password)
+		assert.Equal(t, "token", actual.Accounts[0].Token)
+		assert.Equal(t, 59.93, actual.GetFloatFormField(FormFieldLatitude))
+		assert.Equal(t, []string{"file"}, actual.GetStringSlice(FormFieldFiles))
+		assert.Equal(t, map[string]string{"1": "address"}, actual.GetStringMap(FormFieldBuildings))
+	})
+
+	t.Run("UpdateAppliesToStoredState", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, err := states.Update(ctx, userId+2, func(state *UserState) error {
+				state.SentMessagesCount++
+				return nil
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+		}
+
+		actual, err := states.GetState(ctx, userId+2)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 3, actual.SentMessagesCount)
+	})
+
+	t.Run("UpdateErrorCancelsUpdate", func(t *testing.T) {
+		_, err := states.Update(ctx, userId+3, func(state *UserState) error {
+			state.SentMessagesCount = 1
+			return nil
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		_, err = states.Update(ctx, userId+3, func(state *UserState) error {
+			state.SentMessagesCount = 2
+			return ErrAccountNotFound.New("account not found")
+		})
+		assert.True(t, errorx.IsOfType(err, ErrAccountNotFound))
+
+		actual, err := states.GetState(ctx, userId+3)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 1, actual.SentMessagesCount)
+	})
+
+	t.Run("GetAllStates", func(t *testing.T) {
+		actual, err := states.GetAllStates(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		userIds := map[int64]bool{}
+		for _, state := range actual {
+			userIds[state.UserId] = true
+		}
+		for i := int64(0); i < 4; i++ {
+			assert.True(t, userIds[userId+i], "user %v is not found", userId+i)
+		}
+	})
+}
+
+func newTestCipher(t *testing.T) *secret.Cipher {
+	cipher, err := secret.ParseKeys([]string{"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cipher
+}
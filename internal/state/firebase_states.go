@@ -7,38 +7,41 @@ import (
 
 	"cloud.google.com/go/firestore"
 	"github.com/joomcode/errorx"
-	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"gopkg.in/yaml.v3"
 )
 
 const (
 	collection = "states"
+	// maxUpdateAttempts limits retries of a transaction that conflicts with concurrent updates
+	maxUpdateAttempts = 5
 )
 
 type FirebaseStates struct {
 	logger  *zap.Logger
 	storage *firestore.Client
+	cipher  *secret.Cipher
 }
 
-func NewFirebaseState(logger *zap.Logger, storage *firestore.Client) *FirebaseStates {
+func NewFirebaseState(logger *zap.Logger, storage *firestore.Client, cipher *secret.Cipher) *FirebaseStates {
 	return &FirebaseStates{
 		logger:  logger,
 		storage: storage,
+		cipher:  cipher,
 	}
 }
 
-func (f *FirebaseStates) GetState(userId int64) (*UserState, error) {
+func (f *FirebaseStates) GetState(ctx context.Context, userId int64) (*UserState, error) {
 	doc := f.storage.Collection(collection).Doc(strconv.FormatInt(userId, 10))
-	snapshot, err := doc.Get(context.Background())
+	snapshot, err := doc.Get(ctx)
 	if err != nil {
 		if status.Code(err) == codes.NotFound {
 			newState := UserState{
 				UserId: userId,
 			}
-			_, err := doc.Create(context.Background(), &newState)
+			_, err := doc.Create(ctx, &newState)
 			if err != nil {
 				return nil, errorx.EnhanceStackTrace(err, "failed to create user state: userId=%v", userId)
 			}
@@ -52,64 +55,95 @@ func (f *FirebaseStates) GetState(userId int64) (*UserState, error) {
 		return nil, errorx.EnhanceStackTrace(err, "failed to get state document snapshot")
 	}
 
-	var state UserState
-	err = snapshot.DataTo(&state)
+	state, err := f.readState(snapshot)
 	if err != nil {
-		return nil, errorx.EnhanceStackTrace(err, "failed to deserialize user state data: userId=%v", userId)
-	}
-
-	if state.Categories == "" {
-		state.Categories = string(category.DefaultCategoriesText)
+		return nil, err
 	}
 
-	state.logger = f.logger
-	f.debugUserState(&state, "read user state")
+	debugUserState(f.logger, state, "read user state")
 
-	return &state, nil
+	return state, nil
 }
 
-func (f *FirebaseStates) SetState(state *UserState) error {
-	state.LastAccessAt = time.Now()
-	f.debugUserState(state, "saving user state")
+func (f *FirebaseStates) Update(ctx context.Context, userId int64, update func(state *UserState) error) (*UserState, error) {
+	doc := f.storage.Collection(collection).Doc(strconv.FormatInt(userId, 10))
+	var result *UserState
+	err := f.storage.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		state := &UserState{
+			UserId: userId,
+			logger: f.logger,
+		}
+		snapshot, err := tx.Get(doc)
+		if err != nil {
+			if status.Code(err) != codes.NotFound {
+				return err
+			}
+		} else {
+			state, err = f.readState(snapshot)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = update(state)
+		if err != nil {
+			return err
+		}
 
-	wr, err := f.storage.Collection(collection).Doc(strconv.FormatInt(state.UserId, 10)).Set(context.Background(), state)
+		state.LastAccessAt = time.Now()
+		debugUserState(f.logger, state, "saving user state")
+
+		encryptedState, err := encryptSecrets(state, f.cipher)
+		if err != nil {
+			return errorx.EnhanceStackTrace(err, "failed to encrypt user state: userId=%v", userId)
+		}
+
+		result = state
+		return tx.Set(doc, encryptedState)
+	}, firestore.MaxAttempts(maxUpdateAttempts))
 	if err != nil {
-		return errorx.EnhanceStackTrace(err, "failed to set user state: userId=%v", state.UserId)
-	} else {
-		f.logger.Debug("user state saved",
-			zap.Int64("userId", state.UserId),
-			zap.Time("updateTime", wr.UpdateTime))
+		if status.Code(err) == codes.ResourceExhausted {
+			return nil, ErrRateLimited.New("failed to update user state")
+		}
+
+		return nil, errorx.EnhanceStackTrace(err, "failed to update user state: userId=%v", userId)
 	}
 
-	return nil
+	f.logger.Debug("user state saved",
+		zap.Int64("userId", userId))
+
+	return result, nil
 }
 
-func (f *FirebaseStates) GetAllStates() ([]*UserState, error) {
-	snapshots, err := f.storage.Collection(collection).Documents(context.Background()).GetAll()
+func (f *FirebaseStates) GetAllStates(ctx context.Context) ([]*UserState, error) {
+	snapshots, err := f.storage.Collection(collection).Documents(ctx).GetAll()
 	if err != nil {
 		return nil, errorx.EnhanceStackTrace(err, "failed to get all user states")
 	}
 
 	var states []*UserState
 	for _, snapshot := range snapshots {
-		var state UserState
-		err = snapshot.DataTo(&state)
+		state, err := f.readState(snapshot)
 		if err != nil {
-			return nil, errorx.EnhanceStackTrace(err, "failed to deserialize user state data: userId=%v", snapshot.Ref.ID)
+			return nil, err
 		}
-		states = append(states, &state)
+		states = append(states, state)
 	}
 
 	return states, nil
 }
 
-func (f *FirebaseStates) debugUserState(state *UserState, message string) {
-	if ce := f.logger.Check(zap.DebugLevel, message); ce != nil {
-		stateYaml, err := yaml.Marshal(state)
-		if err != nil {
-			ce.Write(zap.Int64("userId", state.UserId), zap.Error(err))
-		} else {
-			ce.Write(zap.String("state", string(stateYaml)))
-		}
+func (f *FirebaseStates) readState(snapshot *firestore.DocumentSnapshot) (*UserState, error) {
+	var state UserState
+	err := snapshot.DataTo(&state)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to deserialize user state data: userId=%v", snapshot.Ref.ID)
+	}
+
+	err = restoreState(&state, f.cipher, f.logger)
+	if err != nil {
+		return nil, err
 	}
+
+	return &state, nil
 }
@@ -0,0 +1,13 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/storage/storagetest"
+)
+
+func TestFirebaseStates(t *testing.T) {
+	client := storagetest.NewFirestoreClient(t)
+	runStatesConformance(t, NewFirebaseState(log.NewLogger(), client, newTestCipher(t)))
+}
@@ -0,0 +1,68 @@
+package state
+
+import (
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+)
+
+const maskedSecret = "***"
+
+// encryptSecrets Returns a copy of the state with account passwords and tokens encrypted, the state itself is kept as is
+func encryptSecrets(state *UserState, cipher *secret.Cipher) (*UserState, error) {
+	result := *state
+	result.Accounts = make([]Account, len(state.Accounts))
+	for i, account := range state.Accounts {
+		password, err := cipher.Encrypt(account.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		token, err := cipher.Encrypt(account.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		account.Password = password
+		account.Token = token
+		result.Accounts[i] = account
+	}
+
+	return &result, nil
+}
+
+// decryptSecrets Decrypts account passwords and tokens in place and remembers whether they should be encrypted again
+func decryptSecrets(state *UserState, cipher *secret.Cipher) error {
+	for i := range state.Accounts {
+		account := &state.Accounts[i]
+		if cipher.NeedsReencryption(account.Password) || cipher.NeedsReencryption(account.Token) {
+			state.needsReencryption = true
+		}
+
+		password, err := cipher.Decrypt(account.Password)
+		if err != nil {
+			return err
+		}
+
+		token, err := cipher.Decrypt(account.Token)
+		if err != nil {
+			return err
+		}
+
+		account.Password = password
+		account.Token = token
+	}
+
+	return nil
+}
+
+// MarshalYAML Hides the password and the token, so that they never get into logs
+func (a Account) MarshalYAML() (any, error) {
+	type plainAccount Account
+	result := plainAccount(a)
+	if result.Password != "" {
+		result.Password = maskedSecret
+	}
+	if result.Token != "" {
+		result.Token = maskedSecret
+	}
+	return result, nil
+}
@@ -0,0 +1,49 @@
+package state
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestEncryptDecryptSecrets(t *testing.T) {
+	cipher, err := secret.ParseKeys([]string{"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32))})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	state := &UserState{Accounts: []Account{{Login: "login", Password: "password", Token: "token"}}}
+	encrypted, err := encryptSecrets(state, cipher)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "password", state.Accounts[0].Password, "original state must be kept")
+	assert.True(t, secret.IsEncrypted(encrypted.Accounts[0].Password))
+	assert.True(t, secret.IsEncrypted(encrypted.Accounts[0].Token))
+	assert.Equal(t, "login", encrypted.Accounts[0].Login)
+
+	err = decryptSecrets(encrypted, cipher)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Accounts, encrypted.Accounts)
+	assert.False(t, encrypted.NeedsReencryption())
+
+	err = decryptSecrets(state, cipher)
+	assert.NoError(t, err)
+	assert.True(t, state.NeedsReencryption())
+}
+
+func TestAccountMarshalYamlHidesSecrets(t *testing.T) {
+	state := UserState{Accounts: []Account{{Login: "login", Password: "password", Token: "token"}}}
+	actual, err := yaml.Marshal(state)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Contains(t, string(actual), "login")
+	assert.NotContains(t, string(actual), "password: password")
+	assert.NotContains(t, string(actual), "token: token")
+}
@@ -1,26 +1,34 @@
 package state
 
 import (
+	"context"
 	"reflect"
 	"time"
 
 	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/category"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
 	"github.com/samber/lo"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 )
 
 type States interface {
 	// GetState Reads a user from the storage
-	GetState(userId int64) (*UserState, error)
-	// SetState Puts a new user into the storage. If the user already exists in the context, it's kept,
-	SetState(state *UserState) error
+	GetState(ctx context.Context, userId int64) (*UserState, error)
+	// Update Reads a user from the storage, applies the change and stores the user atomically.
+	// The change is applied again to a fresh copy of the user when it's modified concurrently,
+	// so it must not have side effects. An error returned by the change cancels the update
+	Update(ctx context.Context, userId int64, update func(state *UserState) error) (*UserState, error)
 	// GetAllStates Reads all users from the storage
-	GetAllStates() ([]*UserState, error)
+	GetAllStates(ctx context.Context) ([]*UserState, error)
 }
 
 var (
-	Errors         = errorx.NewNamespace("States")
-	ErrRateLimited = Errors.NewType("RateLimited")
+	Errors             = errorx.NewNamespace("States")
+	ErrRateLimited     = Errors.NewType("RateLimited")
+	ErrAccountNotFound = Errors.NewType("AccountNotFound")
 )
 
 type FormField string
@@ -31,10 +39,25 @@ const (
 	FormFieldMessageText         FormField = "messageText"
 	FormFieldFiles               FormField = "files"
 	FormFieldMessageIdFile       FormField = "messageIdFile"
+	FormFieldLatitude            FormField = "latitude"
+	FormFieldLongitude           FormField = "longitude"
+	FormFieldBuildings           FormField = "buildings"
+	FormFieldPriority            FormField = "priority"
+	// FormFieldSendAt is the time the message is sent at in RFC3339 format, empty to send as soon as possible
+	FormFieldSendAt FormField = "sendAt"
+	// FormFieldSendAtMessageId is the queued message to reschedule, empty to schedule the message being composed
+	FormFieldSendAtMessageId FormField = "sendAtMessageId"
+	// FormFieldEditMessageId is the queued message that is being edited, empty when a new message is composed
+	FormFieldEditMessageId FormField = "editMessageId"
+	// FormFieldBuildingId is the building of the edited message, kept until a new location is sent
+	FormFieldBuildingId FormField = "buildingId"
+	// FormFieldReturnHandler is the message handler to return to after an intermediate step
+	FormFieldReturnHandler FormField = "returnHandler"
 )
 
 type UserState struct {
 	logger             *zap.Logger
+	needsReencryption  bool
 	UserId             int64          `firestore:"userId"`
 	FullName           string         `firestore:"fullName"`
 	Accounts           []Account      `firestore:"accounts"`
@@ -43,6 +66,55 @@ type UserState struct {
 	LastAccessAt       time.Time      `firestore:"lastAccessAt"`
 	Form               map[string]any `firestore:"form"`
 	Categories         string         `firestore:"categories"`
+	// AccountStrategy defines how an account is chosen to send a message
+	AccountStrategy AccountStrategy `firestore:"accountStrategy"`
+}
+
+type AccountStrategy string
+
+const (
+	AccountStrategyRoundRobin     AccountStrategy = "round_robin"
+	AccountStrategyLeastUsedToday AccountStrategy = "least_used_today"
+	AccountStrategyPinned         AccountStrategy = "pinned"
+)
+
+var AccountStrategies = []AccountStrategy{
+	AccountStrategyRoundRobin, AccountStrategyLeastUsedToday, AccountStrategyPinned,
+}
+
+func (s AccountStrategy) Name() string {
+	switch s {
+	case AccountStrategyLeastUsedToday:
+		return "Наименее загруженный сегодня"
+	case AccountStrategyPinned:
+		return "Закреплённый за категорией"
+	default:
+		return "По очереди"
+	}
+}
+
+// FindAccount Returns the account with the given login or nil
+func (s *UserState) FindAccount(login string) *Account {
+	for i := range s.Accounts {
+		if s.Accounts[i].Login == login {
+			return &s.Accounts[i]
+		}
+	}
+	return nil
+}
+
+// NeedsReencryption Whether the stored secrets are not encrypted or encrypted with a rotated key
+func (s *UserState) NeedsReencryption() bool {
+	return s.needsReencryption
+}
+
+// GetAccountStrategy Returns the chosen strategy, round robin is used by default
+func (s *UserState) GetAccountStrategy() AccountStrategy {
+	if s.AccountStrategy == "" {
+		return AccountStrategyRoundRobin
+	}
+
+	return s.AccountStrategy
 }
 
 func (s *UserState) ClearForm() {
@@ -93,6 +165,61 @@ func (s *UserState) GetIntFormField(key FormField) int {
 	return intValue
 }
 
+func (s *UserState) GetBoolFormField(key FormField) bool {
+	if s.Form == nil {
+		return false
+	}
+
+	value, exists := s.Form[string(key)]
+	if !exists {
+		return false
+	}
+
+	boolValue, ok := value.(bool)
+	if !ok {
+		return false
+	}
+
+	return boolValue
+}
+
+// SetTimeFormField Keeps the time as a string, so that it's read the same way from any storage
+func (s *UserState) SetTimeFormField(key FormField, value time.Time) {
+	if value.IsZero() {
+		s.SetFormField(key, "")
+		return
+	}
+
+	s.SetFormField(key, value.Format(time.RFC3339))
+}
+
+func (s *UserState) GetTimeFormField(key FormField) time.Time {
+	value, err := time.Parse(time.RFC3339, s.GetStringFormField(key))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return value
+}
+
+func (s *UserState) GetFloatFormField(key FormField) float64 {
+	if s.Form == nil {
+		return 0
+	}
+
+	value, exists := s.Form[string(key)]
+	if !exists {
+		return 0
+	}
+
+	floatValue, ok := value.(float64)
+	if !ok {
+		return 0
+	}
+
+	return floatValue
+}
+
 func (s *UserState) GetStringSlice(key FormField) []string {
 	if s.Form == nil {
 		return nil
@@ -173,6 +300,11 @@ func (s *UserState) GetStringMap(key FormField) map[string]string {
 		return map[string]string{}
 	}
 
+	stringMapValue, ok := value.(map[string]string)
+	if ok {
+		return stringMapValue
+	}
+
 	mapValue := value.(map[string]any)
 
 	result := map[string]string{}
@@ -202,6 +334,83 @@ type Account struct {
 	RateLimitedUntil     time.Time    `firestore:"rateLimitedUntil"`
 	RateLimitNextDayTime time.Time    `firestore:"rateLimitNextDayTime"`
 	State                AccountState `firestore:"state"`
+	LastSentAt           time.Time    `firestore:"lastSentAt"`
+	// SentToday is the number of messages sent in the portal day started at SentTodayDayStart
+	SentToday         int       `firestore:"sentToday"`
+	SentTodayDayStart time.Time `firestore:"sentTodayDayStart"`
+	// PinnedCategories are sent with this account only when the pinned strategy is chosen
+	PinnedCategories []int64 `firestore:"pinnedCategories"`
+	// SendingLeaseId identifies the sender that sends a message with the account until SendingLeaseExpiresAt.
+	// Several bot instances share the user state, so an account sends one message at a time across all of them
+	SendingLeaseId        string    `firestore:"sendingLeaseId"`
+	SendingLeaseExpiresAt time.Time `firestore:"sendingLeaseExpiresAt"`
+}
+
+// AccountDailyQuota is the number of messages the portal accepts from an account in a day
+const AccountDailyQuota = 10
+
+// NextDayTime Returns the time of day the portal day of the account starts at.
+// Accounts added without the time start their day at util.DefaultSendTime
+func (a *Account) NextDayTime() time.Time {
+	if a.RateLimitNextDayTime.IsZero() {
+		return util.DefaultSendTime
+	}
+
+	return a.RateLimitNextDayTime
+}
+
+// DayStart Returns the start of the current portal day. The day starts at NextDayTime
+func (a *Account) DayStart(now time.Time) time.Time {
+	year, month, day := now.In(util.SpbLocation).Date()
+	hour, minute, _ := a.NextDayTime().In(util.SpbLocation).Clock()
+	result := time.Date(year, month, day, hour, minute, 0, 0, util.SpbLocation)
+	if result.After(now) {
+		result = result.AddDate(0, 0, -1)
+	}
+	return result
+}
+
+// NextQuotaReset Returns the time the next portal day starts at
+func (a *Account) NextQuotaReset(now time.Time) time.Time {
+	return a.DayStart(now).AddDate(0, 0, 1)
+}
+
+// UsedToday Number of messages sent with the account in the current portal day
+func (a *Account) UsedToday(now time.Time) int {
+	if !a.SentTodayDayStart.Equal(a.DayStart(now)) {
+		return 0
+	}
+
+	return a.SentToday
+}
+
+func (a *Account) QuotaExhausted(now time.Time) bool {
+	return a.UsedToday(now) >= AccountDailyQuota
+}
+
+// AvailableFrom Returns the time the account can send messages from, considering both rate limit and daily quota
+func (a *Account) AvailableFrom(now time.Time) time.Time {
+	result := a.RateLimitedUntil
+	if a.QuotaExhausted(now) && a.NextQuotaReset(now).After(result) {
+		result = a.NextQuotaReset(now)
+	}
+	return result
+}
+
+// RecordSent Updates the account usage after a message is sent
+func (a *Account) RecordSent(now time.Time) {
+	a.SentToday = a.UsedToday(now) + 1
+	a.SentTodayDayStart = a.DayStart(now)
+	a.LastSentAt = now
+}
+
+// IsSending Checks whether a sender holds the account lease
+func (a *Account) IsSending(now time.Time) bool {
+	return a.SendingLeaseId != "" && a.SendingLeaseExpiresAt.After(now)
+}
+
+func (a *Account) IsPinned(categoryId int64) bool {
+	return lo.Contains(a.PinnedCategories, categoryId)
 }
 
 func (a *Account) GetStateName() (string, error) {
@@ -215,3 +424,29 @@ func (a *Account) GetStateName() (string, error) {
 	}
 
 }
+
+// restoreState Prepares a state read from a storage to be used by the application
+func restoreState(state *UserState, cipher *secret.Cipher, logger *zap.Logger) error {
+	err := decryptSecrets(state, cipher)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to decrypt user state: userId=%v", state.UserId)
+	}
+
+	if state.Categories == "" {
+		state.Categories = string(category.DefaultCategoriesText)
+	}
+
+	state.logger = logger
+	return nil
+}
+
+func debugUserState(logger *zap.Logger, state *UserState, message string) {
+	if ce := logger.Check(zap.DebugLevel, message); ce != nil {
+		stateYaml, err := yaml.Marshal(state)
+		if err != nil {
+			ce.Write(zap.Int64("userId", state.UserId), zap.Error(err))
+		} else {
+			ce.Write(zap.String("state", string(stateYaml)))
+		}
+	}
+}
@@ -2,7 +2,9 @@ package state
 
 import (
 	"testing"
+	"time"
 
+	"github.com/mih-kopylov/our-spb-bot/internal/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,6 +22,13 @@ func TestFormIntValue(t *testing.T) {
 	assert.Equal(t, "", actual)
 }
 
+func TestFormFloatValue(t *testing.T) {
+	state := UserState{}
+	state.SetFormField("key", 59.93)
+	actual := state.GetFloatFormField("key")
+	assert.Equal(t, 59.93, actual)
+}
+
 func TestFormBoolValue(t *testing.T) {
 	state := UserState{}
 	state.SetFormField("key", true)
@@ -54,3 +63,93 @@ func TestFormStringSliceSameValue(t *testing.T) {
 	actual := state.GetStringSlice("key")
 	assert.Equal(t, []string{"value", "value"}, actual)
 }
+
+func TestAccountDailyQuota(t *testing.T) {
+	nextDayTime := time.Date(2023, time.January, 1, 5, 0, 0, 0, util.SpbLocation)
+	tests := []struct {
+		name          string
+		now           time.Time
+		sent          []time.Time
+		expectedUsed  int
+		expectedReset time.Time
+	}{
+		{
+			name:          "nothing sent",
+			now:           time.Date(2024, time.March, 10, 12, 0, 0, 0, util.SpbLocation),
+			expectedUsed:  0,
+			expectedReset: time.Date(2024, time.March, 11, 5, 0, 0, 0, util.SpbLocation),
+		},
+		{
+			name: "sent in the current portal day",
+			now:  time.Date(2024, time.March, 10, 12, 0, 0, 0, util.SpbLocation),
+			sent: []time.Time{
+				time.Date(2024, time.March, 10, 5, 0, 0, 0, util.SpbLocation),
+				time.Date(2024, time.March, 10, 11, 0, 0, 0, util.SpbLocation),
+			},
+			expectedUsed:  2,
+			expectedReset: time.Date(2024, time.March, 11, 5, 0, 0, 0, util.SpbLocation),
+		},
+		{
+			name: "portal day starts before midnight is over",
+			now:  time.Date(2024, time.March, 11, 4, 0, 0, 0, util.SpbLocation),
+			sent: []time.Time{
+				time.Date(2024, time.March, 10, 23, 0, 0, 0, util.SpbLocation),
+				time.Date(2024, time.March, 11, 1, 0, 0, 0, util.SpbLocation),
+			},
+			expectedUsed:  2,
+			expectedReset: time.Date(2024, time.March, 11, 5, 0, 0, 0, util.SpbLocation),
+		},
+		{
+			name: "sent in the previous portal day",
+			now:  time.Date(2024, time.March, 11, 6, 0, 0, 0, util.SpbLocation),
+			sent: []time.Time{
+				time.Date(2024, time.March, 11, 4, 59, 0, 0, util.SpbLocation),
+			},
+			expectedUsed:  0,
+			expectedReset: time.Date(2024, time.March, 12, 5, 0, 0, 0, util.SpbLocation),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := Account{RateLimitNextDayTime: nextDayTime}
+			for _, sentAt := range tt.sent {
+				account.RecordSent(sentAt)
+			}
+
+			assert.Equal(t, tt.expectedUsed, account.UsedToday(tt.now))
+			assert.Equal(t, tt.expectedReset, account.NextQuotaReset(tt.now))
+			assert.False(t, account.QuotaExhausted(tt.now))
+		})
+	}
+}
+
+func TestAccountQuotaExhausted(t *testing.T) {
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, util.SpbLocation)
+	account := Account{RateLimitNextDayTime: util.DefaultSendTime}
+	for i := 0; i < AccountDailyQuota; i++ {
+		account.RecordSent(now)
+	}
+
+	assert.True(t, account.QuotaExhausted(now))
+	assert.Equal(t, time.Date(2024, time.March, 11, 5, 0, 0, 0, util.SpbLocation), account.AvailableFrom(now))
+}
+
+func TestAccountNextDayTimeDefault(t *testing.T) {
+	account := Account{}
+	assert.Equal(t, util.DefaultSendTime, account.NextDayTime())
+
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, util.SpbLocation)
+	assert.Equal(t, time.Date(2024, time.March, 10, 5, 0, 0, 0, util.SpbLocation), account.DayStart(now))
+}
+
+func TestFindAccount(t *testing.T) {
+	state := UserState{Accounts: []Account{{Login: "first"}, {Login: "second"}}}
+
+	actual := state.FindAccount("second")
+	if assert.NotNil(t, actual) {
+		actual.Token = "token"
+		assert.Equal(t, "token", state.Accounts[1].Token, "account is expected to be modified in place")
+	}
+
+	assert.Nil(t, state.FindAccount("third"))
+}
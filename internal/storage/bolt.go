@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"go.etcd.io/bbolt"
+)
+
+func NewBoltStorage(conf *config.Config) (*bbolt.DB, error) {
+	db, err := bbolt.Open(conf.BoltPath, 0600, &bbolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to open bolt database: path=%v", conf.BoltPath)
+	}
+
+	return db, nil
+}
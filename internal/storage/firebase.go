@@ -6,13 +6,20 @@ import (
 
 	"cloud.google.com/go/firestore"
 	firebase "firebase.google.com/go/v4"
+	"github.com/joomcode/errorx"
 	"github.com/mih-kopylov/our-spb-bot/internal/config"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 func NewFirebaseStorage(conf *config.Config) (*firestore.Client, error) {
+	if conf.FirestoreEmulatorHost != "" {
+		return newEmulatorStorage(conf)
+	}
+
 	fbConfig := firebase.Config{
-		ProjectID: "ourspbbot",
+		ProjectID: conf.FirebaseProjectId,
 	}
 	serviceAccountJson, err := base64.StdEncoding.DecodeString(conf.FirebaseServiceAccount)
 	if err != nil {
@@ -28,3 +35,28 @@ func NewFirebaseStorage(conf *config.Config) (*firestore.Client, error) {
 
 	return app.Firestore(ctx)
 }
+
+// newEmulatorStorage Connects to the Firestore emulator, it doesn't need any credentials
+func newEmulatorStorage(conf *config.Config) (*firestore.Client, error) {
+	conn, err := grpc.NewClient(
+		conf.FirestoreEmulatorHost,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(emulatorCredentials{}),
+	)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to connect to firestore emulator: host=%v", conf.FirestoreEmulatorHost)
+	}
+
+	return firestore.NewClient(context.Background(), conf.FirebaseProjectId, option.WithGRPCConn(conn))
+}
+
+// emulatorCredentials Authorizes requests to the emulator as the owner, the same way the Firestore client does
+type emulatorCredentials struct{}
+
+func (emulatorCredentials) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer owner"}, nil
+}
+
+func (emulatorCredentials) RequireTransportSecurity() bool {
+	return false
+}
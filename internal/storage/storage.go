@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"cloud.google.com/go/firestore"
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"go.etcd.io/bbolt"
+)
+
+// Storage holds the client of the storage chosen in config. Only one of the clients is initialized
+type Storage struct {
+	Type      config.StorageType
+	Firestore *firestore.Client
+	Bolt      *bbolt.DB
+}
+
+func NewStorage(conf *config.Config) (*Storage, error) {
+	result := &Storage{
+		Type: conf.StorageType,
+	}
+
+	var err error
+	switch conf.StorageType {
+	case config.StorageTypeBolt:
+		result.Bolt, err = NewBoltStorage(conf)
+	default:
+		result.Firestore, err = NewFirebaseStorage(conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Close releases the client of the storage
+func (s *Storage) Close() error {
+	var err error
+	switch {
+	case s.Bolt != nil:
+		err = s.Bolt.Close()
+	case s.Firestore != nil:
+		err = s.Firestore.Close()
+	}
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to close storage: type=%v", s.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+// Package storagetest Starts storages for integration tests
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/docker/go-connections/nat"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/storage"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	ProjectId         = "ourspbbot"
+	emulatorImage     = "mtlynch/firestore-emulator-docker:latest"
+	emulatorPort      = "8080/tcp"
+	emulatorHostVar   = "FIRESTORE_EMULATOR_HOST"
+	emulatorReadyLine = "Dev App Server is now running"
+)
+
+// RunFirestoreEmulator Starts a Firestore emulator container. The caller has to terminate it
+func RunFirestoreEmulator(ctx context.Context) (testcontainers.Container, nat.Port, error) {
+	container, err := testcontainers.GenericContainer(
+		ctx, testcontainers.GenericContainerRequest{
+			ContainerRequest: testcontainers.ContainerRequest{
+				Image:        emulatorImage,
+				ExposedPorts: []string{emulatorPort},
+				Env: map[string]string{
+					"FIRESTORE_PROJECT_ID": ProjectId,
+				},
+				WaitingFor: wait.ForLog(emulatorReadyLine),
+			},
+			Started: true,
+		},
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	port, err := container.MappedPort(ctx, emulatorPort)
+	if err != nil {
+		_ = container.Terminate(ctx)
+		return nil, "", err
+	}
+
+	return container, port, nil
+}
+
+// NewFirestoreClient Connects to the emulator from FIRESTORE_EMULATOR_HOST or starts a new one.
+// The test is skipped when there is no emulator and Docker isn't available
+func NewFirestoreClient(t *testing.T) *firestore.Client {
+	t.Helper()
+
+	host := os.Getenv(emulatorHostVar)
+	if host == "" {
+		testcontainers.SkipIfProviderIsNotHealthy(t)
+
+		ctx := context.Background()
+		container, port, err := RunFirestoreEmulator(ctx)
+		if err != nil {
+			t.Fatalf("failed to start firestore emulator: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := container.Terminate(ctx); err != nil {
+				t.Errorf("failed to terminate firestore emulator: %v", err)
+			}
+		})
+
+		host = fmt.Sprintf("localhost:%v", port.Port())
+	}
+
+	client, err := storage.NewFirebaseStorage(&config.Config{
+		FirebaseProjectId:     ProjectId,
+		FirestoreEmulatorHost: host,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect to firestore emulator: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return client
+}
@@ -0,0 +1,111 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/joomcode/errorx"
+)
+
+// checkpoint Remembers transferred records, so that an interrupted transfer continues where it stopped.
+// It belongs to the transfer between the given source and target and is removed once the transfer succeeds.
+// It's kept in memory only when the path is empty
+type checkpoint struct {
+	path     string
+	Source   string          `json:"source"`
+	Target   string          `json:"target"`
+	States   map[int64]bool  `json:"states"`
+	Messages map[string]bool `json:"messages"`
+}
+
+func loadCheckpoint(path string, source string, target string) (*checkpoint, error) {
+	result := &checkpoint{
+		path:     path,
+		Source:   source,
+		Target:   target,
+		States:   map[int64]bool{},
+		Messages: map[string]bool{},
+	}
+	if path == "" {
+		return result, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to read checkpoint: path=%v", path)
+	}
+
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to parse checkpoint: path=%v", path)
+	}
+
+	if result.Source != source || result.Target != target {
+		return nil, errorx.IllegalArgument.New(
+			"checkpoint belongs to another transfer: path=%v, source=%v, target=%v", path, result.Source, result.Target,
+		)
+	}
+
+	return result, nil
+}
+
+func (c *checkpoint) hasState(userId int64) bool {
+	return c.States[userId]
+}
+
+func (c *checkpoint) hasMessage(id string) bool {
+	return c.Messages[id]
+}
+
+func (c *checkpoint) addState(userId int64) error {
+	c.States[userId] = true
+	return c.save()
+}
+
+func (c *checkpoint) addMessage(id string) error {
+	c.Messages[id] = true
+	return c.save()
+}
+
+// remove Deletes the checkpoint file, so that the next transfer copies all the records again
+func (c *checkpoint) remove() error {
+	if c.path == "" {
+		return nil
+	}
+
+	err := os.Remove(c.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errorx.EnhanceStackTrace(err, "failed to remove checkpoint: path=%v", c.path)
+	}
+
+	return nil
+}
+
+// save Replaces the checkpoint file atomically, so that it's never left half-written
+func (c *checkpoint) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to serialize checkpoint")
+	}
+
+	tempPath := c.path + ".tmp"
+	err = os.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to write checkpoint: path=%v", tempPath)
+	}
+
+	err = os.Rename(tempPath, c.path)
+	if err != nil {
+		return errorx.EnhanceStackTrace(err, "failed to replace checkpoint: path=%v", c.path)
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+// Package transfer Copies user states and queued messages from one storage to another
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"go.uber.org/zap"
+)
+
+var (
+	Errors                = errorx.NewNamespace("Transfer")
+	ErrVerificationFailed = Errors.NewType("VerificationFailed")
+)
+
+// Backend is a storage data is transferred from or to
+type Backend struct {
+	States state.States
+	Queue  queue.MessageQueue
+}
+
+type Options struct {
+	// DryRun reads the source and reports what would be transferred without writing anything
+	DryRun bool
+	// CheckpointPath is a file with already transferred records, they are skipped when an interrupted transfer
+	// is run again. Resuming is disabled when the path is empty
+	CheckpointPath string
+	// Source and Target identify the storages, a checkpoint written for other storages is refused
+	Source string
+	Target string
+}
+
+// Report summarizes a transfer
+type Report struct {
+	DryRun          bool
+	StatesRead      int
+	StatesWritten   int
+	StatesSkipped   int
+	MessagesRead    map[queue.Status]int
+	MessagesWritten int
+	MessagesSkipped int
+	// Mismatches describe records that differ in the source and the target after the transfer
+	Mismatches []string
+}
+
+func (r *Report) String() string {
+	builder := strings.Builder{}
+	if r.DryRun {
+		builder.WriteString("dry run, nothing is written\n")
+	}
+	builder.WriteString(fmt.Sprintf(
+		"states: read %v, written %v, skipped %v\n", r.StatesRead, r.StatesWritten, r.StatesSkipped,
+	))
+	messagesRead := 0
+	for _, status := range queue.Statuses {
+		messagesRead += r.MessagesRead[status]
+	}
+	builder.WriteString(fmt.Sprintf(
+		"messages: read %v, written %v, skipped %v\n", messagesRead, r.MessagesWritten, r.MessagesSkipped,
+	))
+	for _, status := range queue.Statuses {
+		builder.WriteString(fmt.Sprintf("  %v: %v\n", status, r.MessagesRead[status]))
+	}
+	if !r.DryRun {
+		if len(r.Mismatches) == 0 {
+			builder.WriteString("verification: ok\n")
+		} else {
+			builder.WriteString(fmt.Sprintf("verification: %v mismatches\n", len(r.Mismatches)))
+			for _, mismatch := range r.Mismatches {
+				builder.WriteString("  " + mismatch + "\n")
+			}
+		}
+	}
+	return builder.String()
+}
+
+// Run Copies all user states and all messages from the source to the target.
+// Records are stored as is, so running the transfer again overwrites them with the same values
+func Run(ctx context.Context, logger *zap.Logger, source Backend, target Backend, options Options) (*Report, error) {
+	checkpoint, err := loadCheckpoint(options.CheckpointPath, options.Source, options.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		DryRun:       options.DryRun,
+		MessagesRead: map[queue.Status]int{},
+	}
+
+	states, err := source.States.GetAllStates(ctx)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to read source user states")
+	}
+
+	report.StatesRead = len(states)
+	for _, sourceState := range states {
+		if checkpoint.hasState(sourceState.UserId) {
+			report.StatesSkipped++
+			continue
+		}
+
+		if options.DryRun {
+			report.StatesWritten++
+			continue
+		}
+
+		_, err := target.States.Update(ctx, sourceState.UserId, func(targetState *state.UserState) error {
+			*targetState = *sourceState
+			return nil
+		})
+		if err != nil {
+			return report, errorx.EnhanceStackTrace(err, "failed to write user state: userId=%v", sourceState.UserId)
+		}
+
+		err = checkpoint.addState(sourceState.UserId)
+		if err != nil {
+			return report, err
+		}
+
+		report.StatesWritten++
+		logger.Info("user state transferred", zap.Int64("userId", sourceState.UserId))
+	}
+
+	var messages []*queue.Message
+	for _, status := range queue.Statuses {
+		statusMessages, err := source.Queue.FindMessages(ctx, status)
+		if err != nil {
+			return report, errorx.EnhanceStackTrace(err, "failed to read source messages: status=%v", status)
+		}
+
+		report.MessagesRead[status] = len(statusMessages)
+		messages = append(messages, statusMessages...)
+	}
+
+	for _, message := range messages {
+		if checkpoint.hasMessage(message.Id) {
+			report.MessagesSkipped++
+			continue
+		}
+
+		if options.DryRun {
+			report.MessagesWritten++
+			continue
+		}
+
+		err := target.Queue.UpdateMessage(ctx, message)
+		if err != nil {
+			return report, errorx.EnhanceStackTrace(err, "failed to write message: id=%v", message.Id)
+		}
+
+		err = checkpoint.addMessage(message.Id)
+		if err != nil {
+			return report, err
+		}
+
+		report.MessagesWritten++
+		logger.Info("message transferred", zap.String("id", message.Id))
+	}
+
+	if options.DryRun {
+		return report, nil
+	}
+
+	report.Mismatches, err = verify(ctx, states, messages, target)
+	if err != nil {
+		return report, err
+	}
+
+	if len(report.Mismatches) > 0 {
+		return report, ErrVerificationFailed.New("target differs from source: mismatches=%v", len(report.Mismatches))
+	}
+
+	err = checkpoint.remove()
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// verify Checks that every source record exists in the target. The target may contain other records too
+func verify(ctx context.Context, states []*state.UserState, messages []*queue.Message, target Backend) ([]string, error) {
+	var mismatches []string
+
+	targetStates, err := target.States.GetAllStates(ctx)
+	if err != nil {
+		return nil, errorx.EnhanceStackTrace(err, "failed to read target user states")
+	}
+
+	targetUserIds := map[int64]bool{}
+	for _, targetState := range targetStates {
+		targetUserIds[targetState.UserId] = true
+	}
+	for _, sourceState := range states {
+		if !targetUserIds[sourceState.UserId] {
+			mismatches = append(mismatches, fmt.Sprintf("user state is missing: userId=%v", sourceState.UserId))
+		}
+	}
+
+	targetStatuses := map[string]queue.Status{}
+	for _, status := range queue.Statuses {
+		targetMessages, err := target.Queue.FindMessages(ctx, status)
+		if err != nil {
+			return nil, errorx.EnhanceStackTrace(err, "failed to read target messages: status=%v", status)
+		}
+
+		for _, message := range targetMessages {
+			targetStatuses[message.Id] = message.Status
+		}
+	}
+	for _, message := range messages {
+		targetStatus, exists := targetStatuses[message.Id]
+		if !exists {
+			mismatches = append(mismatches, fmt.Sprintf("message is missing: id=%v", message.Id))
+		} else if targetStatus != message.Status {
+			mismatches = append(mismatches, fmt.Sprintf(
+				"message status differs: id=%v, source=%v, target=%v", message.Id, message.Status, targetStatus,
+			))
+		}
+	}
+
+	return mismatches, nil
+}
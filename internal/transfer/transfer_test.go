@@ -0,0 +1,164 @@
+package transfer
+
+import (
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mih-kopylov/our-spb-bot/internal/config"
+	"github.com/mih-kopylov/our-spb-bot/internal/log"
+	"github.com/mih-kopylov/our-spb-bot/internal/queue"
+	"github.com/mih-kopylov/our-spb-bot/internal/secret"
+	"github.com/mih-kopylov/our-spb-bot/internal/state"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	source := newBoltBackend(t)
+	target := newBoltBackend(t)
+	for userId := int64(1); userId <= 2; userId++ {
+		_, err := source.States.Update(ctx, userId, func(userState *state.UserState) error {
+			userState.Accounts = []state.Account{{Login: "login", Password: "password"}}
+			return nil
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	for _, message := range []*queue.Message{
+		{Id: "1", UserId: 1, Status: queue.StatusCreated},
+		{Id: "2", UserId: 1, Status: queue.StatusSent},
+		{Id: "3", UserId: 2, Status: queue.StatusFailed},
+	} {
+		if !assert.NoError(t, source.Queue.Add(ctx, message)) {
+			return
+		}
+	}
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	report, err := Run(ctx, log.NewLogger(), source, target, Options{DryRun: true, CheckpointPath: checkpointPath})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 2, report.StatesWritten)
+	assert.Equal(t, 3, report.MessagesWritten)
+	assert.NoFileExists(t, checkpointPath)
+	targetStates, err := target.States.GetAllStates(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, targetStates)
+
+	report, err = Run(ctx, log.NewLogger(), source, target, Options{CheckpointPath: checkpointPath})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 2, report.StatesRead)
+	assert.Equal(t, 2, report.StatesWritten)
+	assert.Equal(t, map[queue.Status]int{
+		queue.StatusCreated: 1, queue.StatusInProgress: 0, queue.StatusFailed: 1,
+		queue.StatusAwaitingAuthorization: 0, queue.StatusSent: 1,
+	}, report.MessagesRead)
+	assert.Equal(t, 3, report.MessagesWritten)
+	assert.Empty(t, report.Mismatches)
+	targetState, err := target.States.GetState(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "password", targetState.Accounts[0].Password)
+	targetMessage, err := target.Queue.GetMessage(ctx, "2")
+	assert.NoError(t, err)
+	assert.Equal(t, queue.StatusSent, targetMessage.Status)
+
+	assert.NoFileExists(t, checkpointPath)
+
+	message, err := source.Queue.GetMessage(ctx, "1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	message.Status = queue.StatusSent
+	if !assert.NoError(t, source.Queue.UpdateMessage(ctx, message)) {
+		return
+	}
+
+	report, err = Run(ctx, log.NewLogger(), source, target, Options{CheckpointPath: checkpointPath})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 0, report.StatesSkipped+report.MessagesSkipped)
+	assert.Equal(t, 3, report.MessagesWritten)
+	assert.Empty(t, report.Mismatches)
+}
+
+func TestRunResumesFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	source := newBoltBackend(t)
+	target := newBoltBackend(t)
+	for _, message := range []*queue.Message{
+		{Id: "1", UserId: 1, Status: queue.StatusCreated},
+		{Id: "2", UserId: 1, Status: queue.StatusSent},
+	} {
+		if !assert.NoError(t, source.Queue.Add(ctx, message)) {
+			return
+		}
+	}
+	if !assert.NoError(t, target.Queue.Add(ctx, &queue.Message{Id: "1", UserId: 1, Status: queue.StatusCreated})) {
+		return
+	}
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	interrupted, err := loadCheckpoint(checkpointPath, "source", "target")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, interrupted.addMessage("1")) {
+		return
+	}
+
+	_, err = Run(ctx, log.NewLogger(), source, target, Options{
+		CheckpointPath: checkpointPath, Source: "source", Target: "other",
+	})
+	assert.True(t, errorx.IsOfType(err, errorx.IllegalArgument))
+
+	report, err := Run(ctx, log.NewLogger(), source, target, Options{
+		CheckpointPath: checkpointPath, Source: "source", Target: "target",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 1, report.MessagesSkipped)
+	assert.Equal(t, 1, report.MessagesWritten)
+	assert.Empty(t, report.Mismatches)
+	assert.NoFileExists(t, checkpointPath)
+}
+
+func newBoltBackend(t *testing.T) Backend {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	cipher, err := secret.ParseKeys([]string{"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := state.NewBoltStates(log.NewLogger(), db, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageQueue, err := queue.NewBoltQueue(log.NewLogger(), &config.Config{QueueLeaseDuration: time.Minute}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Backend{States: states, Queue: messageQueue}
+}
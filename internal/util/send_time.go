@@ -0,0 +1,82 @@
+package util
+
+import (
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// SendTimeHint describes the formats ParseSendTime accepts
+const SendTimeHint = `Например:
+  9:30 - сегодня или завтра, если это время уже прошло
+  завтра 9:30
+  пн 9:30 - в ближайший понедельник
+  25.12 9:30
+  25.12.2025 9:30`
+
+var weekdays = map[string]time.Weekday{
+	"пн": time.Monday,
+	"вт": time.Tuesday,
+	"ср": time.Wednesday,
+	"чт": time.Thursday,
+	"пт": time.Friday,
+	"сб": time.Saturday,
+	"вс": time.Sunday,
+}
+
+// ParseSendTime Parses the time a message is sent at. The time is entered in SpbLocation and is always in the future
+func ParseSendTime(input string, now time.Time) (time.Time, error) {
+	input = strings.ToLower(strings.Join(strings.Fields(input), " "))
+	now = now.In(SpbLocation)
+
+	if day, clock, found := strings.Cut(input, " "); found {
+		clockTime, err := time.ParseInLocation("15:04", clock, SpbLocation)
+		if err == nil {
+			result := time.Date(
+				now.Year(), now.Month(), now.Day(), clockTime.Hour(), clockTime.Minute(), 0, 0, SpbLocation,
+			)
+			if day == "завтра" {
+				return result.AddDate(0, 0, 1), nil
+			}
+
+			if weekday, exists := weekdays[day]; exists {
+				result = result.AddDate(0, 0, (int(weekday)-int(now.Weekday())+7)%7)
+				if !result.After(now) {
+					result = result.AddDate(0, 0, 7)
+				}
+				return result, nil
+			}
+		}
+	}
+
+	clockTime, err := time.ParseInLocation("15:04", input, SpbLocation)
+	if err == nil {
+		result := time.Date(
+			now.Year(), now.Month(), now.Day(), clockTime.Hour(), clockTime.Minute(), 0, 0, SpbLocation,
+		)
+		if !result.After(now) {
+			result = result.AddDate(0, 0, 1)
+		}
+		return result, nil
+	}
+
+	result, err := time.ParseInLocation("2.1.2006 15:04", input, SpbLocation)
+	if err == nil {
+		if !result.After(now) {
+			return time.Time{}, errorx.IllegalArgument.New("send time has passed: %v", input)
+		}
+		return result, nil
+	}
+
+	result, err = time.ParseInLocation("2.1 15:04", input, SpbLocation)
+	if err == nil {
+		result = result.AddDate(now.Year()-result.Year(), 0, 0)
+		if !result.After(now) {
+			result = result.AddDate(1, 0, 0)
+		}
+		return result, nil
+	}
+
+	return time.Time{}, errorx.IllegalFormat.New("unsupported send time format: %v", input)
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSendTime(t *testing.T) {
+	// Wednesday
+	now := time.Date(2025, time.December, 24, 12, 0, 0, 0, SpbLocation)
+
+	tests := []struct {
+		input    string
+		expected time.Time
+	}{
+		{"13:30", time.Date(2025, time.December, 24, 13, 30, 0, 0, SpbLocation)},
+		{" 9:05 ", time.Date(2025, time.December, 25, 9, 5, 0, 0, SpbLocation)},
+		{"12:00", time.Date(2025, time.December, 25, 12, 0, 0, 0, SpbLocation)},
+		{"Завтра 9:30", time.Date(2025, time.December, 25, 9, 30, 0, 0, SpbLocation)},
+		{"пн 9:30", time.Date(2025, time.December, 29, 9, 30, 0, 0, SpbLocation)},
+		{"ср 13:00", time.Date(2025, time.December, 24, 13, 0, 0, 0, SpbLocation)},
+		{"ср 11:00", time.Date(2025, time.December, 31, 11, 0, 0, 0, SpbLocation)},
+		{"31.12 23:59", time.Date(2025, time.December, 31, 23, 59, 0, 0, SpbLocation)},
+		{"1.01 10:00", time.Date(2026, time.January, 1, 10, 0, 0, 0, SpbLocation)},
+		{"02.01.2026 10:00", time.Date(2026, time.January, 2, 10, 0, 0, 0, SpbLocation)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			actual, err := ParseSendTime(test.input, now)
+			if assert.NoError(t, err) {
+				assert.True(t, test.expected.Equal(actual), "expected %v, actual %v", test.expected, actual)
+			}
+		})
+	}
+
+	for _, input := range []string{"", "завтра", "25:00", "пн", "31.02.2025 10:00", "01.01.2025 10:00", "после обеда"} {
+		t.Run("invalid "+input, func(t *testing.T) {
+			_, err := ParseSendTime(input, now)
+			assert.Error(t, err)
+		})
+	}
+}
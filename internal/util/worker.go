@@ -0,0 +1,60 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// cancelledJobTimeout is how long a cancelled job has to clean up, e.g. to return a message back to the queue
+const cancelledJobTimeout = 5 * time.Second
+
+// Worker runs a job repeatedly in background until it's stopped
+type Worker struct {
+	stopping chan struct{}
+	done     chan struct{}
+	cancel   context.CancelFunc
+}
+
+// StartWorker Runs the job in a loop, the job returns how long to sleep before the next run.
+// The job context is cancelled only when the worker fails to stop in time, so that the job in progress can complete
+func StartWorker(job func(ctx context.Context) time.Duration) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	worker := &Worker{
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+	}
+
+	go func() {
+		defer close(worker.done)
+		for {
+			sleep := job(ctx)
+			select {
+			case <-worker.stopping:
+				return
+			case <-time.After(sleep):
+			}
+		}
+	}()
+
+	return worker
+}
+
+// Stop Waits for the job in progress to complete. The job is cancelled when ctx is done first
+func (w *Worker) Stop(ctx context.Context) error {
+	close(w.stopping)
+	select {
+	case <-w.done:
+		w.cancel()
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		select {
+		case <-w.done:
+		case <-time.After(cancelledJobTimeout):
+		}
+		return errorx.EnhanceStackTrace(ctx.Err(), "worker didn't stop in time")
+	}
+}